@@ -0,0 +1,399 @@
+// Package config loads configuration file describing feeds and publishers.
+// The file is yaml, json accepted as well as it is a subset of yaml.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// publisher types
+const (
+	TypeTwitter   = "twitter"
+	TypeTwitterV2 = "twitter_v2"
+	TypeMastodon  = "mastodon"
+	TypeBluesky   = "bluesky"
+	TypeTelegram  = "telegram"
+	TypeWebhook   = "webhook"
+	TypeStdout    = "stdout"
+)
+
+// Config defines feeds and publishers of the service
+type Config struct {
+	Feeds      []Feed               `yaml:"feeds"`
+	Publishers map[string]Publisher `yaml:"publishers"`
+}
+
+// thread link positions
+const (
+	ThreadLinkFirst = "first"
+	ThreadLinkLast  = "last"
+)
+
+// updated items handling
+const (
+	UpdatesIgnore = "ignore"
+	UpdatesPost   = "post"
+	UpdatesEdit   = "edit"
+)
+
+// Feed defines a single rss feed, how to make messages from its items and where to publish them.
+// Zero values of Refresh, Timeout, MaxBatch, Template, Identity, DedupWindow, Updates and UpdateTemplate
+// replaced by defaults.
+type Feed struct {
+	URL         string        `yaml:"url"`
+	Refresh     time.Duration `yaml:"refresh"`
+	Adaptive    bool          `yaml:"adaptive"` // learn refresh interval from the feed, refresh is the min interval
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxBatch    int           `yaml:"max_batch"`
+	Template    string        `yaml:"template"`
+	Exclude     []string      `yaml:"exclude"`      // exclusion patterns, regular expressions
+	ExcludeFile string        `yaml:"exclude_file"` // file with exclusion patterns, one per line
+	Publisher   string        `yaml:"publisher"`    // name of publisher from publishers section
+	Publishers  []string      `yaml:"publishers"`   // names of publishers, for publishing to multiple destinations
+	Thread      bool          `yaml:"thread"`       // split long text to thread of replies, for publishers supporting replies
+	ThreadLink  string        `yaml:"thread_link"`  // link position in thread, first (default) or last message
+	Identity    string        `yaml:"identity"`     // item identity, guid (default), link, normalized_link or title_date
+	DedupWindow time.Duration `yaml:"dedup_window"` // items matching recent ones by guid, link or title and date not published again
+
+	Updates        string `yaml:"updates"`         // updated items handling, ignore (default), post or edit
+	UpdateTemplate string `yaml:"update_template"` // message template of updated items, with updates: post
+}
+
+// PublisherNames returns names of all publishers of the feed, set by publisher and publishers keys
+func (f Feed) PublisherNames() []string {
+	res := []string{}
+	if f.Publisher != "" {
+		res = append(res, f.Publisher)
+	}
+	return append(res, f.Publishers...)
+}
+
+// Publisher defines destination of messages. Credentials can be set directly,
+// referenced as ${ENV_VAR} or as file:/path/to/secret
+type Publisher struct {
+	Type string `yaml:"type"`
+
+	AccessToken string `yaml:"access_token"` // twitter and mastodon
+
+	// twitter, OAuth 1.0a user context
+	ConsumerKey    string `yaml:"consumer_key"`
+	ConsumerSecret string `yaml:"consumer_secret"`
+	AccessSecret   string `yaml:"access_secret"`
+
+	// twitter_v2, OAuth 2.0 user token, used instead of OAuth 1.0a if client_id set
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"` // confidential clients only
+	RefreshToken string `yaml:"refresh_token"` // initial token, rotated tokens kept in state
+
+	Server   string `yaml:"server"`    // mastodon instance or bluesky PDS url
+	MaxLen   int    `yaml:"max_len"`   // max message length for mastodon and webhook
+	NoImages bool   `yaml:"no_images"` // don't attach item images to posts
+
+	// mastodon
+	Visibility  string `yaml:"visibility"`   // public, unlisted, private or direct
+	SpoilerText string `yaml:"spoiler_text"` // content warning
+
+	// bluesky
+	Handle      string `yaml:"handle"`
+	AppPassword string `yaml:"app_password"`
+
+	// telegram
+	Token          string `yaml:"token"`           // bot token
+	Channel        string `yaml:"channel"`         // channel name (@name) or chat id
+	ParseMode      string `yaml:"parse_mode"`      // HTML or MarkdownV2, plain text if not set
+	DisablePreview bool   `yaml:"disable_preview"` // disable link preview
+
+	// webhook
+	URL             string            `yaml:"url"`
+	Method          string            `yaml:"method"`    // POST if not set
+	BodyType        string            `yaml:"body_type"` // json, form or text
+	Body            string            `yaml:"body"`      // body template
+	Headers         map[string]string `yaml:"headers"`   // values can be credentials references
+	Secret          string            `yaml:"secret"`    // hmac key for body signature
+	SignatureHeader string            `yaml:"signature_header"`
+	Retries         *int              `yaml:"retries"` // nil if not set, 0 for no retries
+	RetryDelay      time.Duration     `yaml:"retry_delay"`
+}
+
+// Load reads config file, resolves credentials references and validates the result
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path) // nolint
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read config %s", path)
+	}
+	return Parse(content)
+}
+
+// Parse config from yaml or json, resolves credentials references and validates the result.
+// Unknown keys rejected.
+func Parse(content []byte) (*Config, error) {
+	res := Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "can't parse config")
+	}
+	if err := res.resolve(); err != nil {
+		return nil, err
+	}
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SetDefaults fills zero feed values with defaults from d
+func (c *Config) SetDefaults(d Feed) {
+	for i := range c.Feeds {
+		f := &c.Feeds[i]
+		if f.Refresh == 0 {
+			f.Refresh = d.Refresh
+		}
+		if f.Timeout == 0 {
+			f.Timeout = d.Timeout
+		}
+		if f.MaxBatch == 0 {
+			f.MaxBatch = d.MaxBatch
+		}
+		if f.Template == "" {
+			f.Template = d.Template
+		}
+		if f.Identity == "" {
+			f.Identity = d.Identity
+		}
+		if f.DedupWindow == 0 {
+			f.DedupWindow = d.DedupWindow
+		}
+		if f.Updates == "" {
+			f.Updates = d.Updates
+		}
+		if f.UpdateTemplate == "" {
+			f.UpdateTemplate = d.UpdateTemplate
+		}
+		if f.ExcludeFile == "" && len(f.Exclude) == 0 {
+			f.ExcludeFile = d.ExcludeFile
+		}
+	}
+}
+
+// Validate checks config for missing and inconsistent values. Reports all problems found,
+// each prefixed by the path of the offending key, i.e. "feeds[1].publisher"
+func (c *Config) Validate() error {
+	var errs []string
+	addErr := func(key, format string, args ...interface{}) {
+		errs = append(errs, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(c.Feeds) == 0 {
+		addErr("feeds", "no feeds defined")
+	}
+	urls := map[string]int{}
+	for i, f := range c.Feeds {
+		key := fmt.Sprintf("feeds[%d]", i)
+		if f.URL == "" {
+			addErr(key+".url", "missing")
+		}
+		if prev, ok := urls[f.URL]; ok && f.URL != "" {
+			addErr(key+".url", "duplicate of feeds[%d].url", prev)
+		}
+		urls[f.URL] = i
+		if f.Refresh < 0 {
+			addErr(key+".refresh", "negative duration %v", f.Refresh)
+		}
+		if f.Timeout < 0 {
+			addErr(key+".timeout", "negative duration %v", f.Timeout)
+		}
+		if f.MaxBatch < 0 {
+			addErr(key+".max_batch", "negative value %d", f.MaxBatch)
+		}
+		switch f.ThreadLink {
+		case "", ThreadLinkFirst, ThreadLinkLast:
+		default:
+			addErr(key+".thread_link", "unknown link position %q, should be first or last", f.ThreadLink)
+		}
+		switch f.Identity {
+		case "", "guid", "link", "normalized_link", "title_date":
+		default:
+			addErr(key+".identity", "unknown identity %q, should be guid, link, normalized_link or title_date", f.Identity)
+		}
+		switch f.Updates {
+		case "", UpdatesIgnore, UpdatesPost, UpdatesEdit:
+		default:
+			addErr(key+".updates", "unknown updates handling %q, should be ignore, post or edit", f.Updates)
+		}
+		if f.DedupWindow < 0 {
+			addErr(key+".dedup_window", "negative duration %v", f.DedupWindow)
+		}
+		for j, p := range f.Exclude {
+			if _, err := regexp.Compile(p); err != nil {
+				addErr(fmt.Sprintf("%s.exclude[%d]", key, j), "bad pattern %q, %v", p, err)
+			}
+		}
+		if len(f.PublisherNames()) == 0 {
+			addErr(key+".publisher", "missing")
+			continue
+		}
+		if _, ok := c.Publishers[f.Publisher]; !ok && f.Publisher != "" {
+			addErr(key+".publisher", "unknown publisher %q", f.Publisher)
+		}
+		names := map[string]bool{f.Publisher: true}
+		for j, name := range f.Publishers {
+			if _, ok := c.Publishers[name]; !ok {
+				addErr(fmt.Sprintf("%s.publishers[%d]", key, j), "unknown publisher %q", name)
+			}
+			if names[name] {
+				addErr(fmt.Sprintf("%s.publishers[%d]", key, j), "duplicate publisher %q", name)
+			}
+			names[name] = true
+		}
+	}
+
+	for _, name := range c.publisherNames() {
+		p := c.Publishers[name]
+		key := "publishers." + name
+		if u, err := url.Parse(p.Server); p.Server != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			addErr(key+".server", "invalid url %q", p.Server)
+		}
+		if p.MaxLen < 0 {
+			addErr(key+".max_len", "negative value %d", p.MaxLen)
+		}
+		required := func(fields map[string]string) {
+			for k, v := range fields {
+				if v == "" {
+					addErr(key+"."+k, "required for %s publisher", p.Type)
+				}
+			}
+		}
+		switch p.Type {
+		case TypeTwitter:
+			required(map[string]string{"consumer_key": p.ConsumerKey, "consumer_secret": p.ConsumerSecret,
+				"access_token": p.AccessToken, "access_secret": p.AccessSecret})
+		case TypeTwitterV2:
+			if p.ClientID != "" {
+				required(map[string]string{"refresh_token": p.RefreshToken})
+				break
+			}
+			required(map[string]string{"consumer_key": p.ConsumerKey, "consumer_secret": p.ConsumerSecret,
+				"access_token": p.AccessToken, "access_secret": p.AccessSecret})
+		case TypeMastodon:
+			required(map[string]string{"server": p.Server, "access_token": p.AccessToken})
+			switch p.Visibility {
+			case "", "public", "unlisted", "private", "direct":
+			default:
+				addErr(key+".visibility", "unknown visibility %q", p.Visibility)
+			}
+		case TypeBluesky:
+			required(map[string]string{"handle": p.Handle, "app_password": p.AppPassword})
+		case TypeTelegram:
+			required(map[string]string{"token": p.Token, "channel": p.Channel})
+			switch p.ParseMode {
+			case "", "HTML", "MarkdownV2":
+			default:
+				addErr(key+".parse_mode", "unknown parse mode %q, should be HTML or MarkdownV2", p.ParseMode)
+			}
+		case TypeWebhook:
+			required(map[string]string{"url": p.URL})
+			if u, err := url.Parse(p.URL); p.URL != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+				addErr(key+".url", "invalid url %q", p.URL)
+			}
+			switch p.BodyType {
+			case "", "json", "form", "text":
+			default:
+				addErr(key+".body_type", "unknown body type %q, should be json, form or text", p.BodyType)
+			}
+			if p.Retries != nil && *p.Retries < 0 {
+				addErr(key+".retries", "negative value %d", *p.Retries)
+			}
+		case TypeStdout:
+		case "":
+			addErr(key+".type", "missing")
+		default:
+			addErr(key+".type", "unknown type %q", p.Type)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.Errorf("invalid config:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// resolve replaces credentials references with actual values
+func (c *Config) resolve() error {
+	for _, name := range c.publisherNames() {
+		p := c.Publishers[name]
+		for k, v := range p.secrets() {
+			val, err := resolveRef(*v)
+			if err != nil {
+				return errors.Wrapf(err, "publishers.%s.%s", name, k)
+			}
+			*v = val
+		}
+		for k, v := range p.Headers {
+			val, err := resolveRef(v)
+			if err != nil {
+				return errors.Wrapf(err, "publishers.%s.headers.%s", name, k)
+			}
+			p.Headers[k] = val
+		}
+		c.Publishers[name] = p
+	}
+	return nil
+}
+
+// secrets returns pointers to credentials fields of the publisher, keyed by yaml key
+func (p *Publisher) secrets() map[string]*string {
+	return map[string]*string{
+		"consumer_key":    &p.ConsumerKey,
+		"consumer_secret": &p.ConsumerSecret,
+		"access_token":    &p.AccessToken,
+		"access_secret":   &p.AccessSecret,
+		"client_secret":   &p.ClientSecret,
+		"refresh_token":   &p.RefreshToken,
+		"app_password":    &p.AppPassword,
+		"token":           &p.Token,
+		"secret":          &p.Secret,
+		"url":             &p.URL, // webhook urls often include tokens
+	}
+}
+
+func (c *Config) publisherNames() []string {
+	res := make([]string, 0, len(c.Publishers))
+	for name := range c.Publishers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+var envRef = regexp.MustCompile(`^\$\{(\w+)}$`)
+
+// resolveRef returns value of ${ENV_VAR} or file:/path reference, other values returned as is
+func resolveRef(v string) (string, error) {
+	if m := envRef.FindStringSubmatch(v); m != nil {
+		res, ok := os.LookupEnv(m[1])
+		if !ok {
+			return "", errors.Errorf("environment variable %s is not set", m[1])
+		}
+		return res, nil
+	}
+	if strings.HasPrefix(v, "file:") {
+		content, err := os.ReadFile(strings.TrimPrefix(v, "file:"))
+		if err != nil {
+			return "", errors.Wrap(err, "can't read secret file")
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return v, nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	require.NoError(t, os.Setenv("TEST_TWI_CONSUMER_KEY", "consumer-key-from-env"))
+	defer os.Unsetenv("TEST_TWI_CONSUMER_KEY") // nolint
+
+	conf, err := Load("testdata/config.yml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(conf.Feeds))
+	assert.Equal(t, Feed{URL: "https://radio-t.com/podcast.rss", Refresh: time.Minute, Template: "{{.Title}} - {{.Link}} #podcast",
+		Exclude: []string{"^Темы"}, Publisher: "radiot"}, conf.Feeds[0])
+	assert.Equal(t, Feed{URL: "https://example.com/blog.rss", Timeout: 10 * time.Second, MaxBatch: 3,
+		ExcludeFile: "exclusion-patterns.txt", Publisher: "blog"}, conf.Feeds[1])
+
+	assert.Equal(t, Publisher{Type: TypeTwitter, ConsumerKey: "consumer-key-from-env", ConsumerSecret: "consumer-secret-from-file",
+		AccessToken: "token", AccessSecret: "secret"}, conf.Publishers["radiot"])
+	assert.Equal(t, Publisher{Type: TypeStdout}, conf.Publishers["blog"])
+
+	conf.SetDefaults(Feed{Refresh: time.Second, Timeout: 5 * time.Second, MaxBatch: 10, Template: "{{.Title}}", ExcludeFile: "ex.txt",
+		Identity: "guid"})
+	assert.Equal(t, Feed{URL: "https://radio-t.com/podcast.rss", Refresh: time.Minute, Timeout: 5 * time.Second, MaxBatch: 10,
+		Template: "{{.Title}} - {{.Link}} #podcast", Exclude: []string{"^Темы"}, Publisher: "radiot", Identity: "guid"}, conf.Feeds[0])
+	assert.Equal(t, Feed{URL: "https://example.com/blog.rss", Refresh: time.Second, Timeout: 10 * time.Second, MaxBatch: 3,
+		Template: "{{.Title}}", ExcludeFile: "exclusion-patterns.txt", Publisher: "blog", Identity: "guid"}, conf.Feeds[1])
+}
+
+func TestFeedPublisherNames(t *testing.T) {
+	assert.Equal(t, []string{}, Feed{}.PublisherNames())
+	assert.Equal(t, []string{"p1"}, Feed{Publisher: "p1"}.PublisherNames())
+	assert.Equal(t, []string{"p1", "p2", "p3"}, Feed{Publisher: "p1", Publishers: []string{"p2", "p3"}}.PublisherNames())
+}
+
+func TestLoadFailed(t *testing.T) {
+	_, err := Load("testdata/config.yml")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "publishers.radiot.consumer_key: environment variable TEST_TWI_CONSUMER_KEY is not set")
+
+	_, err = Load("testdata/not-found.yml")
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	tbl := []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"json", `{"feeds": [{"url": "http://example.com/rss", "publisher": "p1"}], "publishers": {"p1": {"type": "stdout"}}}`, ""},
+		{"unknown key", "feeds:\n  - url: http://example.com/rss\n    publisherz: p1\n", "field publisherz not found"},
+		{"bad duration", "feeds:\n  - url: http://example.com/rss\n    refresh: blah\n", "cannot unmarshal !!str `blah` into time.Duration"},
+		{"no feeds", "publishers:\n  p1:\n    type: stdout\n", "feeds: no feeds defined"},
+		{"no url", "feeds:\n  - publisher: p1\npublishers:\n  p1:\n    type: stdout\n", "feeds[0].url: missing"},
+		{"duplicate url", "feeds:\n  - {url: u1, publisher: p1}\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: stdout}}",
+			"feeds[1].url: duplicate of feeds[0].url"},
+		{"no publisher", "feeds:\n  - url: u1\n", "feeds[0].publisher: missing"},
+		{"unknown publisher", "feeds:\n  - {url: u1, publisher: p2}\npublishers: {p1: {type: stdout}}",
+			`feeds[0].publisher: unknown publisher "p2"`},
+		{"bad pattern", "feeds:\n  - {url: u1, publisher: p1, exclude: [ok, \"(bad\"]}\npublishers: {p1: {type: stdout}}",
+			`feeds[0].exclude[1]: bad pattern "(bad"`},
+		{"negative", "feeds:\n  - {url: u1, publisher: p1, refresh: -1s, max_batch: -1}\npublishers: {p1: {type: stdout}}",
+			"feeds[0].max_batch: negative value -1\n\tfeeds[0].refresh: negative duration -1s"},
+		{"thread", "feeds:\n  - {url: u1, publisher: p1, thread: true, thread_link: last}\npublishers: {p1: {type: stdout}}", ""},
+		{"bad thread link", "feeds:\n  - {url: u1, publisher: p1, thread: true, thread_link: middle}\npublishers: {p1: {type: stdout}}",
+			`feeds[0].thread_link: unknown link position "middle", should be first or last`},
+		{"identity", "feeds:\n  - {url: u1, publisher: p1, identity: normalized_link, dedup_window: 24h}\npublishers: {p1: {type: stdout}}", ""},
+		{"bad identity", "feeds:\n  - {url: u1, publisher: p1, identity: uuid, dedup_window: -1h}\npublishers: {p1: {type: stdout}}",
+			"feeds[0].dedup_window: negative duration -1h0m0s\n\tfeeds[0].identity: unknown identity \"uuid\", should be guid, link, normalized_link or title_date"},
+		{"updates", "feeds:\n  - {url: u1, publisher: p1, updates: edit}\npublishers: {p1: {type: stdout}}", ""},
+		{"bad updates", "feeds:\n  - {url: u1, publisher: p1, updates: delete}\npublishers: {p1: {type: stdout}}",
+			`feeds[0].updates: unknown updates handling "delete", should be ignore, post or edit`},
+		{"no type", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {}}", "publishers.p1.type: missing"},
+		{"bad type", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: blah}}", `publishers.p1.type: unknown type "blah"`},
+		{"twitter creds", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: twitter, consumer_key: k, consumer_secret: s}}",
+			"publishers.p1.access_secret: required for twitter publisher\n\tpublishers.p1.access_token: required for twitter publisher"},
+		{"twitter v2 oauth1", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: twitter_v2, consumer_key: k, " +
+			"consumer_secret: s, access_token: t, access_secret: s}}", ""},
+		{"twitter v2 oauth2", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: twitter_v2, client_id: id, refresh_token: t}}", ""},
+		{"twitter v2 missing", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: twitter_v2, client_id: id}}",
+			"publishers.p1.refresh_token: required for twitter_v2 publisher"},
+		{"twitter v2 missing oauth1", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: twitter_v2, access_token: t}}",
+			"publishers.p1.access_secret: required for twitter_v2 publisher\n\tpublishers.p1.consumer_key: required for twitter_v2 publisher"},
+		{"mastodon", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: mastodon, server: https://mastodon.social, access_token: t}}", ""},
+		{"mastodon missing", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: mastodon}}",
+			"publishers.p1.access_token: required for mastodon publisher\n\tpublishers.p1.server: required for mastodon publisher"},
+		{"mastodon bad values", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: mastodon, server: blah, access_token: t, visibility: all, max_len: -1}}",
+			"publishers.p1.max_len: negative value -1\n\tpublishers.p1.server: invalid url \"blah\"\n\tpublishers.p1.visibility: unknown visibility \"all\""},
+		{"bluesky", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: bluesky, handle: h.bsky.social, app_password: p}}", ""},
+		{"bluesky missing", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: bluesky, server: \"ftp:\"}}",
+			"publishers.p1.app_password: required for bluesky publisher\n\tpublishers.p1.handle: required for bluesky publisher\n\t" +
+				"publishers.p1.server: invalid url \"ftp:\""},
+		{"telegram", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: telegram, token: t, channel: \"@ch\", parse_mode: HTML}}", ""},
+		{"telegram missing", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: telegram, parse_mode: markdown}}",
+			"publishers.p1.channel: required for telegram publisher\n\tpublishers.p1.parse_mode: unknown parse mode \"markdown\", " +
+				"should be HTML or MarkdownV2\n\tpublishers.p1.token: required for telegram publisher"},
+		{"webhook", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: webhook, url: \"http://example.com/hook\", body_type: form}}", ""},
+		{"webhook bad", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: webhook, url: blah, body_type: xml, retries: -1}}",
+			"publishers.p1.body_type: unknown body type \"xml\", should be json, form or text\n\t" +
+				"publishers.p1.retries: negative value -1\n\tpublishers.p1.url: invalid url \"blah\""},
+		{"webhook header ref", "feeds:\n  - {url: u1, publisher: p1}\npublishers: {p1: {type: webhook, url: \"http://example.com\", " +
+			"headers: {Authorization: \"${NOT_SET_ENV_VAR}\"}}}", "publishers.p1.headers.Authorization: environment variable NOT_SET_ENV_VAR is not set"},
+		{"multiple publishers", "feeds:\n  - {url: u1, publisher: p1, publishers: [p2]}\npublishers: {p1: {type: stdout}, p2: {type: stdout}}", ""},
+		{"bad publishers", "feeds:\n  - {url: u1, publishers: [p1, p3, p1]}\npublishers: {p1: {type: stdout}}",
+			"feeds[0].publishers[1]: unknown publisher \"p3\"\n\tfeeds[0].publishers[2]: duplicate publisher \"p1\""},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.conf))
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
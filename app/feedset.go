@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+type notifier interface {
+	Go(ctx context.Context) <-chan rss.Event
+}
+
+// healthReporter is implemented by notifiers reporting their health
+type healthReporter interface {
+	Health() rss.Health
+}
+
+// feed combines notifier of a single rss feed with its message template and publisher
+type feed struct {
+	conf     config.Feed
+	notif    notifier
+	pub      publisher.Interface
+	tmpl     *msgTemplate
+	updTmpl  *msgTemplate // template of updated items
+	excludes []string     // exclusion patterns of the feed, matched against the message
+}
+
+// feedEvent is rss event with the feed it came from
+type feedEvent struct {
+	rss.Event
+	feed feed
+}
+
+// feedSet runs notifiers of all feeds and merges their events into a single channel.
+// The set can be replaced on the fly with update, events already received by the set are not lost.
+type feedSet struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	ch      chan feedEvent
+	running map[string]*runningFeed // keyed by feed url
+	active  int                     // number of active notifier goroutines, ch closed when drops to zero
+	closed  bool
+}
+
+// runningFeed is a feed with started notifier
+type runningFeed struct {
+	feed   feed
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newFeedSet(feeds []feed) *feedSet {
+	res := feedSet{running: map[string]*runningFeed{}}
+	for _, f := range feeds {
+		res.running[f.conf.URL] = &runningFeed{feed: f}
+	}
+	return &res
+}
+
+// Go starts notifiers of all feeds and returns merged events channel.
+// The channel closed when all notifiers are done, i.e. on ctx cancellation.
+func (s *feedSet) Go(ctx context.Context) <-chan feedEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	s.ch = make(chan feedEvent)
+	if len(s.running) == 0 {
+		close(s.ch)
+		s.closed = true
+		return s.ch
+	}
+	for _, rf := range s.running {
+		s.start(rf, nil)
+	}
+	return s.ch
+}
+
+// update replaces feeds of the running set. Notifiers of removed feeds stopped, notifiers of new feeds started.
+// Feeds with the same url and notifier's parameters keep running notifier, and only get new template and publisher.
+// Notifier of the changed feed restarted after the previous one is done, so the same item won't be sent twice.
+func (s *feedSet) update(feeds []feed) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ctx == nil {
+		return errors.New("feed set is not running")
+	}
+
+	updated := map[string]*runningFeed{}
+	for _, f := range feeds {
+		prev, ok := s.running[f.conf.URL]
+		if ok && sameNotifier(prev.feed.conf, f.conf) {
+			f.notif = prev.feed.notif
+			prev.feed = f
+			updated[f.conf.URL] = prev
+			log.Printf("[INFO] feed %s updated, template - %q", f.conf.URL, f.tmpl)
+			continue
+		}
+		rf := &runningFeed{feed: f}
+		s.start(rf, prev)
+		updated[f.conf.URL] = rf
+		if ok {
+			prev.cancel()
+			log.Printf("[INFO] feed %s restarted", f.conf.URL)
+			continue
+		}
+		log.Printf("[INFO] feed %s added", f.conf.URL)
+	}
+
+	for url, rf := range s.running {
+		if _, ok := updated[url]; !ok {
+			rf.cancel()
+			log.Printf("[INFO] feed %s removed", url)
+		}
+	}
+	s.running = updated
+	return nil
+}
+
+// start runs notifier of the feed in a goroutine, forwarding its events to the merged channel.
+// If prev defined, the notifier started after prev is done. Should be called under lock.
+func (s *feedSet) start(rf, prev *runningFeed) {
+	var ctx context.Context
+	ctx, rf.cancel = context.WithCancel(s.ctx)
+	rf.done = make(chan struct{})
+	s.active++
+	log.Printf("[INFO] message template for %s - %q", rf.feed.conf.URL, rf.feed.tmpl)
+
+	go func() {
+		defer func() {
+			close(rf.done)
+			s.mu.Lock()
+			s.active--
+			if s.active == 0 {
+				close(s.ch)
+				s.closed = true
+			}
+			s.mu.Unlock()
+		}()
+		if prev != nil {
+			<-prev.done
+		}
+		for ev := range rf.feed.notif.Go(ctx) {
+			s.mu.Lock()
+			f := rf.feed // feed may be updated while the notifier is running
+			s.mu.Unlock()
+			s.ch <- feedEvent{Event: ev, feed: f}
+		}
+	}()
+}
+
+// sameNotifier checks if feeds can share the same notifier
+func sameNotifier(f1, f2 config.Feed) bool {
+	return f1.URL == f2.URL && f1.Refresh == f2.Refresh && f1.Timeout == f2.Timeout && f1.MaxBatch == f2.MaxBatch &&
+		f1.Adaptive == f2.Adaptive && f1.Identity == f2.Identity && f1.DedupWindow == f2.DedupWindow &&
+		f1.Updates == f2.Updates
+}
+
+// get returns running feed by url
+func (s *feedSet) get(url string) (feed, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rf, ok := s.running[url]
+	if !ok {
+		return feed{}, false
+	}
+	return rf.feed, true
+}
+
+// health returns health of running feeds, by feed url. Feeds with notifiers not reporting health not included
+func (s *feedSet) health() map[string]rss.Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[string]rss.Health{}
+	for url, rf := range s.running {
+		if hr, ok := rf.feed.notif.(healthReporter); ok {
+			res[url] = hr.Health()
+		}
+	}
+	return res
+}
+
+// files returns list of all exclusion files used by running feeds
+func (s *feedSet) files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []string{}
+	seen := map[string]bool{}
+	for _, rf := range s.running {
+		if f := rf.feed.conf.ExcludeFile; f != "" && !seen[f] {
+			res = append(res, f)
+			seen[f] = true
+		}
+	}
+	return res
+}
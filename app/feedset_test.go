@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestFeedSetUpdate(t *testing.T) {
+	n1, n2, n3 := &tickNotifier{feed: "f1"}, &tickNotifier{feed: "f2"}, &tickNotifier{feed: "f3"}
+	fs := newFeedSet([]feed{
+		{conf: config.Feed{URL: "f1", Refresh: time.Second}, notif: n1, tmpl: mustTemplate("t1")},
+		{conf: config.Feed{URL: "f2", Refresh: time.Second}, notif: n2, tmpl: mustTemplate("t2")},
+	})
+	assert.Error(t, fs.update(nil), "not started yet")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := fs.Go(ctx)
+
+	// wait for both feeds to send events with initial templates
+	waitFor := func(feed, tmpl string) {
+		for {
+			select {
+			case ev := <-ch:
+				if ev.Feed == feed && ev.feed.tmpl.String() == tmpl {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no event for %s with template %s", feed, tmpl)
+			}
+		}
+	}
+	waitFor("f1", "t1")
+	waitFor("f2", "t2")
+
+	// f1 template changed, f2 removed, f3 added
+	n1new := &tickNotifier{feed: "f1"}
+	err := fs.update([]feed{
+		{conf: config.Feed{URL: "f1", Refresh: time.Second}, notif: n1new, tmpl: mustTemplate("t1-new")},
+		{conf: config.Feed{URL: "f3", Refresh: time.Second}, notif: n3, tmpl: mustTemplate("t3")},
+	})
+	require.NoError(t, err)
+	waitFor("f1", "t1-new")
+	waitFor("f3", "t3")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&n1new.started), "notifier kept running")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&n1.started))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&n2.stopped) == 1 }, time.Second, 10*time.Millisecond)
+
+	// f1 refresh changed, notifier restarted
+	n1restarted := &tickNotifier{feed: "f1"}
+	err = fs.update([]feed{
+		{conf: config.Feed{URL: "f1", Refresh: time.Minute}, notif: n1restarted, tmpl: mustTemplate("t1-restarted")},
+		{conf: config.Feed{URL: "f3", Refresh: time.Second}, notif: n3, tmpl: mustTemplate("t3")},
+	})
+	require.NoError(t, err)
+	waitFor("f1", "t1-restarted")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&n1.stopped))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&n1restarted.started))
+
+	cancel()
+	for range ch { // drain until closed
+	}
+	assert.Error(t, fs.update(nil), "closed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&n3.stopped))
+}
+
+func TestFeedSetFiles(t *testing.T) {
+	fs := newFeedSet([]feed{
+		{conf: config.Feed{URL: "f1", ExcludeFile: "ex1.txt"}},
+		{conf: config.Feed{URL: "f2", ExcludeFile: "ex1.txt"}},
+		{conf: config.Feed{URL: "f3"}},
+	})
+	assert.Equal(t, []string{"ex1.txt"}, fs.files())
+}
+
+func TestFeedSetHealth(t *testing.T) {
+	fs := newFeedSet([]feed{
+		{conf: config.Feed{URL: "f1"}, notif: &rss.Notify{Feed: "f1"}},
+		{conf: config.Feed{URL: "f2"}, notif: &tickNotifier{}},
+	})
+	assert.Equal(t, map[string]rss.Health{"f1": {}}, fs.health(), "notifier without health not included")
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	f1, f2 := filepath.Join(dir, "f1.txt"), filepath.Join(dir, "f2.txt")
+	require.NoError(t, os.WriteFile(f1, []byte("1"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan struct{}, 1)
+	go watchFiles(ctx, 10*time.Millisecond, func() []string { return []string{f1, f2, ""} }, reload)
+
+	select {
+	case <-reload:
+		t.Fatal("unexpected reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.Chtimes(f1, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("no reload on file change")
+	}
+}
+
+// tickNotifier sends event every 5ms until canceled
+type tickNotifier struct {
+	feed    string
+	started int32
+	stopped int32
+}
+
+func (n *tickNotifier) Go(ctx context.Context) <-chan rss.Event {
+	atomic.AddInt32(&n.started, 1)
+	ch := make(chan rss.Event)
+	go func() {
+		defer func() {
+			atomic.AddInt32(&n.stopped, 1)
+			close(ch)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- rss.Event{Feed: n.feed}:
+			}
+		}
+	}()
+	return ch
+}
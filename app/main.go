@@ -3,44 +3,71 @@ package main
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
-	"text/template"
 	"time"
 
 	"github.com/denisbrodbeck/striphtmltags"
 	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
 	"github.com/umputun/go-flags"
 
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/outbox"
 	"github.com/umputun/rss2twitter/app/publisher"
 	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
 )
 
 type opts struct {
-	Refresh time.Duration `short:"r" long:"refresh" env:"REFRESH" default:"30s" description:"refresh interval"`
-	TimeOut time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"5s" description:"rss feed timeout"`
-	Feed    string        `short:"f" long:"feed" env:"FEED" required:"true" description:"rss feed url"`
+	Refresh  time.Duration `short:"r" long:"refresh" env:"REFRESH" default:"30s" description:"refresh interval"`
+	TimeOut  time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"5s" description:"rss feed timeout"`
+	Feeds    []string      `short:"f" long:"feed" env:"FEED" env-delim:"," description:"rss feed url, repeat for multiple feeds"`
+	State    string        `long:"state" env:"STATE" description:"state file, keeps seen items between restarts"`
+	MaxBatch int           `long:"max-batch" env:"MAX_BATCH" default:"10" description:"max number of items published per refresh"`
+
+	RetryAttempts int           `long:"retry-attempts" env:"RETRY_ATTEMPTS" default:"5" description:"max publishing attempts before event goes to dead letters"`
+	RetryDelay    time.Duration `long:"retry-delay" env:"RETRY_DELAY" default:"1m" description:"delay before the first retry of failed publishing"`
+	RetryMaxDelay time.Duration `long:"retry-max-delay" env:"RETRY_MAX_DELAY" default:"1h" description:"max delay between retries"`
 
 	ConsumerKey    string `long:"consumer-key" env:"TWI_CONSUMER_KEY" description:"twitter consumer key"`
 	ConsumerSecret string `long:"consumer-secret" env:"TWI_CONSUMER_SECRET" description:"twitter consumer secret"`
 	AccessToken    string `long:"access-token" env:"TWI_ACCESS_TOKEN" description:"twitter access token"`
 	AccessSecret   string `long:"access-secret" env:"TWI_ACCESS_SECRET" description:"twitter access secret"`
 
-	Template string `long:"template" env:"TEMPLATE" default:"{{.Title}} - {{.Link}}" description:"twitter message template"`
-	Dry      bool   `long:"dry" env:"DRY" description:"dry mode"`
-	Dbg      bool   `long:"dbg" env:"DEBUG" description:"debug mode"`
+	Template     string        `long:"template" env:"TEMPLATE" default:"{{.Title}} - {{.Link}}" description:"twitter message template"`
+	Thread       bool          `long:"thread" env:"THREAD" description:"split long text to thread of replies"`
+	Adaptive     bool          `long:"adaptive" env:"ADAPTIVE" description:"learn refresh interval from the feed, --refresh is the min interval"`
+	Identity     string        `long:"identity" env:"IDENTITY" default:"guid" choice:"guid" choice:"link" choice:"normalized_link" choice:"title_date" description:"item identity for seen items detection"`
+	DedupWindow  time.Duration `long:"dedup-window" env:"DEDUP_WINDOW" description:"don't publish items matching recent ones by guid, link or title and date within this window"`
+	Updates      string        `long:"updates" env:"UPDATES" default:"ignore" choice:"ignore" choice:"post" choice:"edit" description:"updated items handling"`
+	UpdateTmpl   string        `long:"update-template" env:"UPDATE_TEMPLATE" default:"Updated: {{.Title}} - {{.Link}}" description:"message template of updated items"`
+	ExcludeFile  string        `long:"exclude" env:"EXCLUDE_FILE" default:"exclusion-patterns.txt" description:"exclusion patterns file"`
+	Config       string        `long:"config" env:"CONFIG" description:"config file with feeds and publishers, yaml or json"`
+	Watch        time.Duration `long:"watch" env:"WATCH" default:"10s" description:"check interval for config and exclusion files change, 0 to disable"`
+	Degraded     int           `long:"degraded-after" env:"DEGRADED_AFTER" default:"5" description:"number of consecutive fetch failures making feed degraded"`
+	HealthLog    time.Duration `long:"health-log" env:"HEALTH_LOG" default:"1h" description:"interval of feeds health summary in the log, 0 to disable"`
+	WebSubURL    string        `long:"websub-url" env:"WEBSUB_URL" description:"public url of websub callback, enables push updates from feed hubs"`
+	WebSubListen string        `long:"websub-listen" env:"WEBSUB_LISTEN" default:":8080" description:"listen address of websub callback server"`
+	Dry          bool          `long:"dry" env:"DRY" description:"dry mode"`
+	CheckTmpl    string        `long:"check-template" description:"render the latest items of the feed with its template and exit"`
+	TwiAuth      string        `long:"twitter-auth" description:"client id of twitter app, get oauth2 refresh token and exit"`
+	TwiSecret    string        `long:"twitter-auth-secret" description:"client secret of twitter app, confidential clients only"`
+	TwiRedirect  string        `long:"twitter-auth-redirect" default:"http://127.0.0.1:8085/callback" description:"callback url registered for twitter app"`
+	Dbg          bool          `long:"dbg" env:"DEBUG" description:"debug mode"`
 }
 
 var revision = "unknown"
 
-type notifier interface {
-	Go(ctx context.Context) <-chan rss.Event
-}
+const retryInterval = 10 * time.Second // how often outbox checked for due retries
 
 func main() {
 	fmt.Printf("rss2twitter - %s\n", revision)
@@ -53,12 +80,38 @@ func main() {
 		log.Setup(log.Debug)
 	}
 
-	catchSignals()
+	if o.CheckTmpl != "" {
+		if err := checkTemplate(o, os.Stdout); err != nil {
+			log.Printf("[PANIC] failed to check template, %v", err)
+		}
+		return
+	}
+
+	if o.TwiAuth != "" {
+		auth := publisher.TwitterAuth{ClientID: o.TwiAuth, ClientSecret: o.TwiSecret, RedirectURL: o.TwiRedirect}
+		token, err := auth.Run(context.Background(), os.Stdout)
+		if err != nil {
+			log.Printf("[PANIC] failed to get twitter refresh token, %v", err)
+		}
+		fmt.Printf("refresh_token: %s\n", token)
+		return
+	}
+
+	reload := make(chan struct{}, 1)
+	catchSignals(reload)
+
+	st, err := makeStore(o.State)
+	if err != nil {
+		log.Printf("[PANIC] failed to make state store, %v", err)
+	}
 
-	notif, pub, err := setup(o)
+	ws := makeWebSub(o)
+	pubs := &pubSet{}
+	feeds, err := setup(o, st, ws, pubs)
 	if err != nil {
 		log.Printf("[PANIC] failed to setup, %v", err)
 	}
+	pubs.commit()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() { // catch SIGTERM signal and invoke graceful termination
@@ -69,111 +122,680 @@ func main() {
 		cancel()
 	}()
 
-	do(ctx, notif, pub, o.Template)
+	if ws != nil {
+		go runWebSub(ctx, o.WebSubListen, ws)
+	}
+
+	fs := newFeedSet(feeds)
+	go func() { // reload feeds on SIGHUP or files change
+		for range reload {
+			if err := reloadFeeds(o, st, ws, pubs, fs); err != nil {
+				log.Printf("[WARN] failed to reload, keep running with the current config, %v", err)
+			}
+		}
+	}()
+	if o.Watch > 0 {
+		go watchFiles(ctx, o.Watch, func() []string { return append(fs.files(), o.Config) }, reload)
+	}
+	if o.HealthLog > 0 {
+		go logHealth(ctx, o.HealthLog, fs)
+	}
+
+	ob := &outbox.Outbox{Store: st, MaxAttempts: o.RetryAttempts, MinDelay: o.RetryDelay, MaxDelay: o.RetryMaxDelay}
+	go ob.Run(ctx, retryInterval, retryFunc(fs, st))
+
+	do(ctx, fs, st, ob)
 	log.Print("[INFO] terminated")
 }
 
-func setup(o opts) (n notifier, p publisher.Interface, err error) {
-	content, err := os.ReadFile("exclusion-patterns.txt")
+// retryFunc makes function publishing event from outbox with the current publisher and template of its feed.
+// Outcome of the event updated with the result of retry.
+func retryFunc(fs *feedSet, st store.Interface) outbox.PublishFunc {
+	return func(event rss.Event, dest string) error {
+		f, ok := fs.get(event.Feed)
+		if !ok {
+			return publisher.Permanent(errors.Errorf("feed %s removed", event.Feed))
+		}
+		pub := f.pub
+		if m, ok := pub.(publisher.Multi); ok {
+			pub = m[dest]
+		}
+		if names := f.conf.PublisherNames(); pub == nil || (len(names) == 1 && names[0] != dest) {
+			return publisher.Permanent(errors.Errorf("publisher %s removed from %s", dest, event.Feed))
+		}
+		err := publish(f, pub, event)
+		saveOutcome(st, event, dest, err)
+		return err
+	}
+}
+
+// reloadFeeds makes feeds from the current config and exclusion files and replaces running feeds.
+// Publishers made for the new config replace the current ones only if the whole reload succeeded.
+func reloadFeeds(o opts, st store.Interface, ws *rss.WebSub, pubs *pubSet, fs *feedSet) error {
+	log.Print("[INFO] reload config")
+	feeds, err := setup(o, st, ws, pubs)
 	if err != nil {
-		log.Printf("[WARN] could not read 'exclusion-patterns.txt' file: %v", err)
-		content = []byte{}
+		return err
 	}
-	lines := strings.Split(string(content), "\n")
-	n = &rss.Notify{Feed: o.Feed, Duration: o.Refresh, Timeout: o.TimeOut}
-	p = publisher.Twitter{
-		ConsumerKey:    o.ConsumerKey,
-		ConsumerSecret: o.ConsumerSecret,
-		AccessToken:    o.AccessToken,
-		AccessSecret:   o.AccessSecret,
-		ExcludeList:    lines,
+	if err = fs.update(feeds); err != nil {
+		return err
 	}
+	pubs.commit()
+	return nil
+}
 
-	if o.Dry { // override publisher to stdout only, no actual twitter publishing
-		p = publisher.Stdout{
-			ExcludeList: lines,
+// watchFiles checks modification time of files every interval and triggers reload on change
+func watchFiles(ctx context.Context, interval time.Duration, files func() []string, reload chan<- struct{}) {
+	modTimes := map[string]time.Time{}
+	check := func() (changed bool) {
+		for _, f := range files() {
+			if f == "" {
+				continue
+			}
+			fi, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			if prev, ok := modTimes[f]; ok && !prev.Equal(fi.ModTime()) {
+				log.Printf("[INFO] file %s changed", f)
+				changed = true
+			}
+			modTimes[f] = fi.ModTime()
 		}
-		log.Print("[INFO] dry mode")
+		return changed
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if check() {
+				select {
+				case reload <- struct{}{}:
+				default: // reload already pending
+				}
+			}
+		}
+	}
+}
+
+// makeWebSub returns websub callback if its url defined, nil otherwise
+func makeWebSub(o opts) *rss.WebSub {
+	if o.WebSubURL == "" {
+		return nil
+	}
+	log.Printf("[INFO] websub callback %s", o.WebSubURL)
+	return &rss.WebSub{URL: o.WebSubURL}
+}
+
+// runWebSub runs http server of websub callback till ctx canceled
+func runWebSub(ctx context.Context, addr string, ws *rss.WebSub) {
+	srv := &http.Server{Addr: addr, Handler: ws, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			log.Printf("[WARN] can't close websub server, %v", err)
+		}
+	}()
+	log.Printf("[INFO] websub server on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("[ERROR] websub server failed, %v", err)
 	}
+}
 
-	if !o.Dry && (o.ConsumerKey == "" || o.ConsumerSecret == "" || o.AccessToken == "" || o.AccessSecret == "") {
-		return n, p, errors.New("token credentials missing")
+// makeStore returns file store if path defined, in-memory store otherwise
+func makeStore(path string) (store.Interface, error) {
+	if path == "" {
+		log.Print("[WARN] no state file defined, state won't survive restart, pending retries of failed events lost")
+		return &store.Memory{}, nil
 	}
-	return n, p, nil
+	log.Printf("[INFO] state file %s", path)
+	return store.NewFile(path)
 }
 
-// do runs event loop getting rss events, formatting and publishing them
-func do(ctx context.Context, notif notifier, pub publisher.Interface, tmpl string) {
-	log.Printf("[INFO] message template - %q", tmpl)
-	ch := notif.Go(ctx)
-	for event := range ch {
-		err := pub.Publish(event, func(r rss.Event) string { return formatMsg(event, tmpl, 279) })
+// setup makes feeds from config file if defined, or from command line options otherwise.
+// Feeds subscribed to websub hubs with ws callback, if defined. Publishers taken from pubs, made once per name
+// and shared by all feeds using it, so feeds share its rate limit and tokens. Unchanged publishers kept on reload.
+// The caller commits pubs once the feeds are in use.
+func setup(o opts, st store.Interface, ws *rss.WebSub, pubs *pubSet) (res []feed, err error) {
+	conf, err := loadConfig(o)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range conf.Feeds {
+		names = append(names, f.PublisherNames()...)
+	}
+	made, err := pubs.make(conf.Publishers, names, st)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range conf.Feeds {
+		tmpl, err := newTemplate(f.Template)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad template for %s", f.URL)
+		}
+		updTmpl, err := newTemplate(f.UpdateTemplate)
 		if err != nil {
-			log.Printf("[WARN] failed to publish, %s", err)
+			return nil, errors.Wrapf(err, "bad update template for %s", f.URL)
+		}
+		excludes := f.Exclude
+		if f.ExcludeFile != "" {
+			excludes = append(excludes, readExcludes(f.ExcludeFile)...)
+		}
+		feedPubs := publisher.Multi{}
+		for _, name := range f.PublisherNames() {
+			feedPubs[name] = made[name]
+		}
+		var p publisher.Interface = feedPubs
+		if len(feedPubs) == 1 { // no need for multi-publisher
+			p = feedPubs[f.PublisherNames()[0]]
+		}
+		n := &rss.Notify{Feed: f.URL, Duration: f.Refresh, Timeout: f.Timeout, Store: st, MaxBatch: f.MaxBatch, WebSub: ws,
+			Adaptive: f.Adaptive, DegradedAfter: o.Degraded, Identity: f.Identity, DedupWindow: f.DedupWindow,
+			Updates: f.Updates == config.UpdatesPost || f.Updates == config.UpdatesEdit}
+		res = append(res, feed{conf: f, notif: n, pub: p, tmpl: tmpl, updTmpl: updTmpl, excludes: excludes})
+	}
+	return res, nil
+}
+
+// loadConfig loads config file or makes config with a single twitter publisher from command line options.
+// Values not set in config file taken from command line options. In dry mode all publishers replaced by stdout.
+func loadConfig(o opts) (*config.Config, error) {
+	conf := &config.Config{}
+	if o.Config == "" {
+		if len(o.Feeds) == 0 {
+			return nil, errors.New("no feed defined, set --feed or --config")
+		}
+		conf.Publishers = map[string]config.Publisher{"twitter": {Type: config.TypeTwitter,
+			ConsumerKey: o.ConsumerKey, ConsumerSecret: o.ConsumerSecret, AccessToken: o.AccessToken, AccessSecret: o.AccessSecret}}
+		for _, f := range o.Feeds {
+			conf.Feeds = append(conf.Feeds, config.Feed{URL: f, Publisher: "twitter", Thread: o.Thread, Adaptive: o.Adaptive})
+		}
+	}
+
+	if o.Config != "" {
+		log.Printf("[INFO] load config %s", o.Config)
+		c, err := config.Load(o.Config)
+		if err != nil {
+			return nil, err
+		}
+		conf = c
+	}
+
+	if o.Dry { // override publishers to stdout only, no actual publishing
+		for name := range conf.Publishers {
+			conf.Publishers[name] = config.Publisher{Type: config.TypeStdout}
+		}
+		log.Print("[INFO] dry mode")
+	}
+
+	conf.SetDefaults(config.Feed{Refresh: o.Refresh, Timeout: o.TimeOut, MaxBatch: o.MaxBatch,
+		Template: o.Template, ExcludeFile: o.ExcludeFile, Identity: o.Identity, DedupWindow: o.DedupWindow,
+		Updates: o.Updates, UpdateTemplate: o.UpdateTmpl})
+	return conf, conf.Validate()
+}
+
+// makePublisher makes publisher for config definition, st keeps publisher's tokens and published posts.
+// Exclusions are per feed and checked before publishing, not by publisher shared by feeds.
+func makePublisher(p config.Publisher, st store.Interface) (publisher.Interface, error) {
+	switch p.Type {
+	case config.TypeTwitter:
+		return &publisher.Twitter{
+			ConsumerKey:    p.ConsumerKey,
+			ConsumerSecret: p.ConsumerSecret,
+			AccessToken:    p.AccessToken,
+			AccessSecret:   p.AccessSecret,
+			NoImages:       p.NoImages,
+		}, nil
+	case config.TypeTwitterV2:
+		return &publisher.TwitterV2{
+			ConsumerKey:    p.ConsumerKey,
+			ConsumerSecret: p.ConsumerSecret,
+			AccessToken:    p.AccessToken,
+			AccessSecret:   p.AccessSecret,
+			ClientID:       p.ClientID,
+			ClientSecret:   p.ClientSecret,
+			RefreshToken:   p.RefreshToken,
+			TokenStore:     st,
+			NoImages:       p.NoImages,
+		}, nil
+	case config.TypeMastodon:
+		return &publisher.Mastodon{
+			Server:      p.Server,
+			AccessToken: p.AccessToken,
+			Visibility:  p.Visibility,
+			SpoilerText: p.SpoilerText,
+			MaxLen:      p.MaxLen,
+			NoImages:    p.NoImages,
+			PostStore:   st,
+		}, nil
+	case config.TypeBluesky:
+		return &publisher.Bluesky{
+			Server:      p.Server,
+			Handle:      p.Handle,
+			AppPassword: p.AppPassword,
+			NoImages:    p.NoImages,
+		}, nil
+	case config.TypeTelegram:
+		return &publisher.Telegram{
+			Token:          p.Token,
+			Channel:        p.Channel,
+			ParseMode:      p.ParseMode,
+			DisablePreview: p.DisablePreview,
+			Server:         p.Server,
+			NoImages:       p.NoImages,
+			PostStore:      st,
+		}, nil
+	case config.TypeWebhook:
+		retries := publisher.WebhookDefaultRetries
+		if p.Retries != nil {
+			retries = *p.Retries
+		}
+		wh := &publisher.Webhook{
+			URL:             p.URL,
+			Method:          p.Method,
+			BodyType:        p.BodyType,
+			Body:            p.Body,
+			Headers:         p.Headers,
+			Secret:          p.Secret,
+			SignatureHeader: p.SignatureHeader,
+			Retries:         retries,
+			RetryDelay:      p.RetryDelay,
+			MaxLen:          p.MaxLen,
+		}
+		return wh, wh.Validate()
+	case config.TypeStdout:
+		return publisher.Stdout{}, nil
+	}
+	return nil, errors.Errorf("unknown publisher type %q", p.Type)
+}
+
+// readExcludes reads exclusion patterns file, one pattern per line. Missing file is not an error.
+func readExcludes(fname string) []string {
+	content, err := os.ReadFile(fname) // nolint
+	if err != nil {
+		log.Printf("[WARN] could not read '%s' file: %v", fname, err)
+		return []string{}
+	}
+	return strings.Split(string(content), "\n")
+}
+
+// do runs event loop getting rss events from all feeds, formatting and publishing them.
+// Each destination published by its own worker in order of events, so a slow destination doesn't hold back
+// the others. Event for destination with full queue goes directly to outbox, if defined.
+// Publishing outcomes recorded to the store, failed events added to outbox for retry if ob defined
+func do(ctx context.Context, fs *feedSet, st store.Interface, ob *outbox.Outbox) {
+	workers := map[string]chan destEvent{}
+	var wg sync.WaitGroup
+	for event := range fs.Go(ctx) {
+		for name, pub := range destinations(event.feed) {
+			ch, ok := workers[name]
+			if !ok {
+				ch = make(chan destEvent, destQueue)
+				workers[name] = ch
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for de := range ch {
+						publishTo(ctx, de, st, ob)
+					}
+				}()
+			}
+			de := destEvent{feedEvent: event, dest: name, pub: pub}
+			if ob == nil {
+				ch <- de
+				continue
+			}
+			select {
+			case ch <- de:
+			default:
+				log.Printf("[WARN] %s is busy, %s from %s goes to outbox", name, event.GUID, event.Feed)
+				failed(de, errors.Errorf("%s is busy", name), st, ob)
+			}
+		}
+	}
+	for _, ch := range workers {
+		close(ch)
+	}
+	wg.Wait()
+}
+
+const destQueue = 100 // max number of events waiting for publishing to destination
+
+// destEvent is event to publish to a single destination
+type destEvent struct {
+	feedEvent
+	dest string // publisher name
+	pub  publisher.Interface
+}
+
+// destinations returns publishers of the feed keyed by name
+func destinations(f feed) map[string]publisher.Interface {
+	if m, ok := f.pub.(publisher.Multi); ok {
+		return m
+	}
+	name := ""
+	if names := f.conf.PublisherNames(); len(names) == 1 {
+		name = names[0]
+	}
+	return map[string]publisher.Interface{name: f.pub}
+}
+
+// publishTo publishes event to its destination and records outcome. Events left in queue on ctx cancellation
+// go to outbox, if defined, so they are published after restart with the state file.
+func publishTo(ctx context.Context, de destEvent, st store.Interface, ob *outbox.Outbox) {
+	if ctx.Err() != nil { // not attempted, no failure recorded
+		if ob == nil {
+			return
 		}
+		log.Printf("[INFO] %s from %s to %s not published on shutdown, goes to outbox", de.GUID, de.Feed, de.dest)
+		if err := ob.Defer(de.Event, de.dest, errors.Wrap(ctx.Err(), "not published")); err != nil {
+			log.Printf("[WARN] can't add %s to outbox, %v", de.GUID, err)
+		}
+		return
+	}
+	if err := publish(de.feed, de.pub, de.Event); err != nil {
+		failed(de, err, st, ob)
+		return
 	}
+	saveOutcome(st, de.Event, de.dest, nil)
 }
 
-// formatMsg makes a tweet message from rss event, strip html tags and shorten text if necessary
-func formatMsg(ev rss.Event, tmpl string, max int) string {
+// failed records failed outcome and adds event to outbox for retry, if defined
+func failed(de destEvent, pubErr error, st store.Interface, ob *outbox.Outbox) {
+	log.Printf("[WARN] failed to publish %s from %s to %s, %s", de.GUID, de.Feed, de.dest, pubErr)
+	if ob != nil {
+		if err := ob.Add(de.Event, de.dest, pubErr); err != nil {
+			log.Printf("[WARN] can't add %s to outbox, %v", de.GUID, err)
+		}
+	}
+	saveOutcome(st, de.Event, de.dest, pubErr)
+}
+
+// publish sends event to pub with the feed's template, as thread if enabled for the feed.
+// Update of the item posted with the update template or edits the published post, as configured for the feed.
+func publish(f feed, pub publisher.Interface, event rss.Event) error {
+	if excluded(f, event) {
+		return nil
+	}
+	if event.Update {
+		return publishUpdate(f, pub, event)
+	}
+	if !f.conf.Thread {
+		return pub.Publish(event, formatter(f.tmpl))
+	}
+	linkLast := f.conf.ThreadLink == config.ThreadLinkLast
+	return publisher.PublishThread(pub, event, formatter(f.tmpl), threadFormatter(f.tmpl, linkLast))
+}
+
+// publishUpdate posts update message made with the feed's update template, or edits the published post with
+// the feed's template. Edited thread keeps the first message of the thread, replies not changed,
+// publishers without threads get the whole message as published.
+// Publishers unable to edit skip the update.
+func publishUpdate(f feed, pub publisher.Interface, event rss.Event) error {
+	switch f.conf.Updates {
+	case config.UpdatesPost:
+		return pub.Publish(event, formatter(f.updTmpl))
+	case config.UpdatesEdit:
+		if !f.conf.Thread {
+			return publisher.Edit(pub, event, formatter(f.tmpl))
+		}
+		linkLast := f.conf.ThreadLink == config.ThreadLinkLast
+		return publisher.EditThread(pub, event, formatter(f.tmpl), threadFormatter(f.tmpl, linkLast))
+	}
+	log.Printf("[DEBUG] update of %s ignored", event.GUID)
+	return nil
+}
+
+// excluded checks the message of the event, rendered with the feed's template without length limit,
+// against the feed's exclusion patterns
+func excluded(f feed, event rss.Event) bool {
+	if len(f.excludes) == 0 {
+		return false
+	}
+	tmpl := f.tmpl
+	if event.Update && f.conf.Updates == config.UpdatesPost {
+		tmpl = f.updTmpl
+	}
+	return publisher.CheckExclusionList(f.excludes, formatMsg(event, tmpl, publisher.Limits{MaxLen: math.MaxInt32}))
+}
+
+// formatter makes publisher's formatter for the template
+func formatter(tmpl *msgTemplate) publisher.Formatter {
+	return func(r rss.Event, lim publisher.Limits) string {
+		return formatMsg(r, tmpl, lim)
+	}
+}
+
+const (
+	outcomesBucket = "outcomes" // store bucket for publishing outcomes, keyed by feed url
+	maxOutcomes    = 100        // max number of outcomes kept per feed
+)
+
+var outcomesMu sync.Mutex // serializes outcome updates by destination workers
+
+// outcome of publishing event
+type outcome struct {
+	GUID    string            `json:"guid"`
+	Version string            `json:"version,omitempty"` // version of updated item
+	Title   string            `json:"title"`
+	TS      time.Time         `json:"ts"`
+	Error   string            `json:"error,omitempty"`
+	Failed  map[string]string `json:"failed,omitempty"` // errors of failed publishers, keyed by name
+}
+
+// saveOutcome records publishing outcome of the event to dest in the list of the most recent outcomes
+// for the event's feed. Outcome of the event combines all its destinations, failure of dest cleared by success.
+func saveOutcome(st store.Interface, event rss.Event, dest string, pubErr error) {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+	var outcomes []outcome
+	if _, err := st.Load(outcomesBucket, event.Feed, &outcomes); err != nil {
+		log.Printf("[WARN] can't load outcomes for %s, %v", event.Feed, err)
+	}
+	idx := -1
+	for i := len(outcomes) - 1; i >= 0; i-- {
+		if outcomes[i].GUID == event.GUID && outcomes[i].Version == event.Version {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		outcomes = append(outcomes, outcome{GUID: event.GUID, Version: event.Version, Title: event.Title, TS: time.Now()})
+		idx = len(outcomes) - 1
+	}
+
+	rec := &outcomes[idx]
+	if rec.Failed == nil {
+		rec.Failed = map[string]string{}
+	}
+	delete(rec.Failed, dest)
+	if pubErr != nil {
+		rec.Failed[dest] = pubErr.Error()
+	}
+	rec.Error = outcomeError(rec.Failed)
+	if len(rec.Failed) == 0 {
+		rec.Failed = nil
+	}
 
-	shortLinkLen := 23 // url of any length altered to 23 characters by twitter, even if the link itself is less than 23
+	if len(outcomes) > maxOutcomes {
+		outcomes = outcomes[len(outcomes)-maxOutcomes:]
+	}
+	if err := st.Save(outcomesBucket, event.Feed, outcomes); err != nil {
+		log.Printf("[WARN] can't save outcome for %s, %v", event.GUID, err)
+	}
+}
+
+// outcomeError makes error of the outcome from errors of failed publishers, empty if nothing failed
+func outcomeError(failed map[string]string) string {
+	if len(failed) == 0 {
+		return ""
+	}
+	if msg, ok := failed[""]; ok && len(failed) == 1 { // unnamed publisher
+		return msg
+	}
+	merr := publisher.MultiError{}
+	for name, msg := range failed {
+		merr[name] = errors.New(msg)
+	}
+	return merr.Error()
+}
 
+// formatMsg makes a tweet message from rss event, strip html tags and shorten text if necessary.
+// Template rendered as is if the message fits, otherwise text and then title shortened until it fits.
+// Any template works, with fields used in functions or with spaces inside of braces, i.e. "{{ .Title }}".
+// If template fails for the event, predefined format used, the failure logged once.
+func formatMsg(ev rss.Event, tmpl *msgTemplate, lim publisher.Limits) string {
 	// strip html tags from title and text
 	ev.Title = striphtmltags.StripTags(ev.Title)
 	ev.Text = striphtmltags.StripTags(ev.Text)
 
-	trimWithDots := func(s string, max int) string {
-		if len([]rune(s)) <= max || max < 4 {
-			return s
+	if _, err := execTempl(ev, tmpl, lim); err != nil {
+		return applyTempl(ev, tmpl, lim) // logs failure and makes backup message
+	}
+	fits := func() bool {
+		msg, err := execTempl(ev, tmpl, lim)
+		return err == nil && msgLen(msg, ev.Link, lim) <= lim.MaxLen
+	}
+	for _, field := range []*string{&ev.Text, &ev.Title} { // fields shortened in this order
+		if fits() {
+			break
 		}
-		snippet := []rune(s)[:max-4] // extra 4 for dots
-		// go back in snippet and found the first space to trim nicely, on the word boundary
-		for i := len(snippet) - 1; i >= 0; i-- {
-			if snippet[i] == ' ' {
-				snippet = snippet[:i]
-				break
-			}
+		full := *field
+		// find the longest shortened field with the message still fitting, the longer field the longer message
+		n := sort.Search(lim.Len(full)+1, func(max int) bool {
+			*field = shrink(full, max, lim)
+			return !fits()
+		})
+		*field = shrink(full, n-1, lim)
+	}
+
+	msg := applyTempl(ev, tmpl, lim)
+	// constant part of template too long, trim the message directly.
+	// Not possible with escaping as trimming may break escaped sequences, and with link which would be broken
+	if msgLen(msg, ev.Link, lim) > lim.MaxLen && lim.Escape == nil && (ev.Link == "" || !strings.Contains(msg, ev.Link)) {
+		return trimWithDots(msg, lim.MaxLen, lim)
+	}
+	return msg
+}
+
+// shrink trims s with dots to fit max, empty if max too small for anything but dots
+func shrink(s string, max int, lim publisher.Limits) string {
+	if max < 4 {
+		return ""
+	}
+	return trimWithDots(s, max, lim)
+}
+
+// msgLen returns length of the message as counted by publisher, links shortened by publisher counted as lim.LinkLen
+func msgLen(msg, link string, lim publisher.Limits) int {
+	if lim.LinkLen > 0 && link != "" {
+		if lim.Escape != nil {
+			link = lim.Escape(link)
 		}
-		return string(snippet) + "... " // extra space at the end to make it look better if it has something after
+		return lim.Len(strings.Replace(msg, link, "", -1)) + strings.Count(msg, link)*lim.LinkLen
 	}
+	return lim.Len(msg)
+}
 
-	applyTempl := func(ev rss.Event, tmpl string) string {
-		var res string
-		b1 := bytes.Buffer{}
-		if err := template.Must(template.New("twi").Parse(tmpl)).Execute(&b1, ev); err != nil { // nolint
-			// template failed to parse record, backup with predefined format
-			res = trimWithDots(fmt.Sprintf("%s - %s", ev.Title, ev.Link), max)
-		} else {
-			res = b1.String()
+// trimWithDots trims s to fit max on the word boundary, adds dots if trimmed
+func trimWithDots(s string, max int, lim publisher.Limits) string {
+	if lim.Len(s) <= max || max < 4 {
+		return s
+	}
+	// find the longest snippet fitting max, extra 4 for dots
+	runes := []rune(s)
+	snippet := runes[:sort.Search(len(runes), func(i int) bool { return lim.Len(string(runes[:i+1])) > max-4 })]
+	// go back in snippet and found the first space to trim nicely, on the word boundary
+	for i := len(snippet) - 1; i >= 0; i-- {
+		if snippet[i] == ' ' {
+			snippet = snippet[:i]
+			break
 		}
-		return strings.Replace(res, `\n`, "\n", -1) // handle \n we may have in the template
 	}
+	return string(snippet) + "... " // extra space at the end to make it look better if it has something after
+}
 
-	// if no Link in rss.Event, just apply template and trim resulted message directly
-	if !strings.Contains(tmpl, "{{.Link}}") {
-		return trimWithDots(applyTempl(ev, tmpl), max)
+// applyTempl applies template to event, values escaped for publisher's markup if needed.
+// Predefined format used if template fails, with warning logged.
+func applyTempl(ev rss.Event, tmpl *msgTemplate, lim publisher.Limits) string {
+	res, err := execTempl(ev, tmpl, lim)
+	if err != nil {
+		// template failed to apply to record, backup with predefined format
+		log.Printf("[WARN] can't apply template to %s, %v", ev.GUID, err)
+		res = fallbackMsg(ev, lim)
 	}
+	return res
+}
 
-	// remove all template elements to get the len of the message without it
-	// this is needed to calculate the length of the constants parts of the message,
-	// i.e. for "{{.Title}} blah {{.Link}}" it is 6, len(" blah ")
-	noTmpl := tmpl
-	for _, t := range []string{"{{.Link}}", "{{.Title}}", "{{.Text}}"} {
-		noTmpl = strings.Replace(noTmpl, t, "", -1)
+// fallbackMsg makes message in predefined format, used if template failed. Trimmed as raw text and escaped
+// as a whole after, so separator and dots escaped as well and escaped sequences are not cut
+func fallbackMsg(ev rss.Event, lim publisher.Limits) string {
+	msg := fmt.Sprintf("%s - %s", ev.Title, ev.Link)
+	if lim.Escape == nil {
+		return trimWithDots(msg, lim.MaxLen, lim)
 	}
-	noTmplLen := len([]rune(noTmpl))
+	escaped := lim // counts length of text after escaping
+	escaped.Count = func(s string) int { return lim.Len(lim.Escape(s)) }
+	return lim.Escape(trimWithDots(msg, lim.MaxLen, escaped))
+}
 
-	textOrTitleMax := max - shortLinkLen - noTmplLen
-	switch {
-	case strings.Contains(tmpl, "{{.Text}}"): // first trim text, if in template
-		ev.Text = trimWithDots(ev.Text, textOrTitleMax)
-	case strings.Contains(tmpl, "{{.Title}}"): // if not, trim title if in template
-		ev.Title = trimWithDots(ev.Title, textOrTitleMax)
+// execTempl applies template to event, values escaped for publisher's markup if needed. Error returned as is,
+// for callers applying template many times, i.e. to find the longest fitting message, without logging each failure
+func execTempl(ev rss.Event, tmpl *msgTemplate, lim publisher.Limits) (string, error) {
+	if lim.Escape != nil { // escape values for publisher's markup after trimming, so escaped sequences not broken
+		ev = ev.Escaped(lim.Escape)
 	}
+	b1 := bytes.Buffer{}
+	if err := tmpl.Execute(&b1, ev); err != nil {
+		return "", err
+	}
+	return strings.Replace(b1.String(), `\n`, "\n", -1), nil // handle \n we may have in the template
+}
 
-	// apply template with altered event values.
-	return applyTempl(ev, tmpl)
+// logHealth logs summary of feeds health every interval, till ctx canceled
+func logHealth(ctx context.Context, interval time.Duration, fs *feedSet) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			healthSummary(fs.health())
+		}
+	}
+}
+
+// healthSummary logs number of healthy and degraded feeds, degraded feeds listed with their failures
+func healthSummary(health map[string]rss.Health) {
+	degraded := []string{}
+	for url, h := range health {
+		if h.Degraded {
+			degraded = append(degraded, url)
+		}
+	}
+	if len(degraded) == 0 {
+		log.Printf("[INFO] feeds health, %d feeds, all healthy", len(health))
+		return
+	}
+	sort.Strings(degraded)
+	log.Printf("[WARN] feeds health, %d feeds, %d degraded", len(health), len(degraded))
+	for _, url := range degraded {
+		h := health[url]
+		last := "never"
+		if !h.LastSuccess.IsZero() {
+			last = h.LastSuccess.Format(time.RFC3339)
+		}
+		log.Printf("[WARN] feed %s degraded, %d failures, last success %s, %s", url, h.Failures, last, h.LastError)
+	}
 }
 
 // getDump reads runtime stack and returns as a string
@@ -187,13 +809,22 @@ func getDump() string {
 	return string(stacktrace[:length])
 }
 
-func catchSignals() {
-	// catch SIGQUIT and print stack traces
+func catchSignals(reload chan<- struct{}) {
+	// catch SIGQUIT and print stack traces, SIGHUP triggers reload
 	sigChan := make(chan os.Signal, 1)
 	go func() {
-		for range sigChan {
-			log.Printf("[INFO] SIGQUIT detected, dump:\n%s", getDump())
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGQUIT:
+				log.Printf("[INFO] SIGQUIT detected, dump:\n%s", getDump())
+			case syscall.SIGHUP:
+				log.Print("[INFO] SIGHUP detected, reload")
+				select {
+				case reload <- struct{}{}:
+				default: // reload already pending
+				}
+			}
 		}
 	}()
-	signal.Notify(sigChan, syscall.SIGQUIT)
+	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGHUP)
 }
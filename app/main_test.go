@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,8 +20,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/outbox"
 	"github.com/umputun/rss2twitter/app/publisher"
 	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
 )
 
 func TestMainApp(t *testing.T) {
@@ -57,27 +62,105 @@ func TestMainApp(t *testing.T) {
 	wg.Wait()
 }
 func TestSetupDry(t *testing.T) {
-	o := opts{Feed: "http://example.com", Dry: true}
-	n, p, err := setup(o)
+	o := opts{Feeds: []string{"http://example.com"}, Dry: true}
+	feeds, err := setup(o, &store.Memory{}, nil, &pubSet{})
 	require.NoError(t, err)
-	assert.NotNil(t, n)
-	assert.Equal(t, "publisher.Stdout", fmt.Sprintf("%T", p))
+	require.Equal(t, 1, len(feeds))
+	assert.NotNil(t, feeds[0].notif)
+	assert.Equal(t, "publisher.Stdout", fmt.Sprintf("%T", feeds[0].pub))
 }
 
 func TestSetupFull(t *testing.T) {
-	o := opts{Feed: "http://example.com", Dry: false,
+	o := opts{Feeds: []string{"http://example.com"}, Dry: false,
 		ConsumerKey: "1", ConsumerSecret: "1", AccessToken: "1", AccessSecret: "1"}
-	n, p, err := setup(o)
+	feeds, err := setup(o, &store.Memory{}, nil, &pubSet{})
 	require.NoError(t, err)
-	assert.NotNil(t, n)
-	assert.Equal(t, "publisher.Twitter", fmt.Sprintf("%T", p))
+	require.Equal(t, 1, len(feeds))
+	assert.NotNil(t, feeds[0].notif)
+	assert.Equal(t, "*publisher.Twitter", fmt.Sprintf("%T", feeds[0].pub))
+}
+
+func TestSetupMultipleFeeds(t *testing.T) {
+	o := opts{Feeds: []string{"http://example.com/1", "http://example.com/2"}, Dry: true, Template: "{{.Title}}"}
+	feeds, err := setup(o, &store.Memory{}, nil, &pubSet{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(feeds))
+	assert.Equal(t, "http://example.com/1", feeds[0].notif.(*rss.Notify).Feed)
+	assert.Equal(t, "http://example.com/2", feeds[1].notif.(*rss.Notify).Feed)
+	assert.Equal(t, "{{.Title}}", feeds[1].tmpl.String())
+}
+
+func TestSetupConfig(t *testing.T) {
+	conf := `
+feeds:
+  - url: http://example.com/1
+    publisher: p1
+    template: "{{.Title}}"
+  - url: http://example.com/2
+    refresh: 1m
+    publisher: p2
+  - url: http://example.com/3
+    publishers: [p1, p2]
+  - url: http://example.com/4
+    publisher: p3
+publishers:
+  p1: {type: stdout}
+  p2: {type: twitter, consumer_key: k, consumer_secret: s, access_token: t, access_secret: s}
+  p3: {type: twitter_v2, client_id: id, refresh_token: t}
+`
+	fname := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(fname, []byte(conf), 0o600))
+
+	o := opts{Config: fname, Refresh: time.Second, Template: "{{.Link}}"}
+	feeds, err := setup(o, &store.Memory{}, nil, &pubSet{})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(feeds))
+	assert.Equal(t, "{{.Title}}", feeds[0].tmpl.String())
+	assert.Equal(t, time.Second, feeds[0].notif.(*rss.Notify).Duration)
+	assert.Equal(t, "publisher.Stdout", fmt.Sprintf("%T", feeds[0].pub))
+	assert.Equal(t, "{{.Link}}", feeds[1].tmpl.String())
+	assert.Equal(t, time.Minute, feeds[1].notif.(*rss.Notify).Duration)
+	assert.Equal(t, "*publisher.Twitter", fmt.Sprintf("%T", feeds[1].pub))
+
+	require.Equal(t, "publisher.Multi", fmt.Sprintf("%T", feeds[2].pub))
+	assert.Equal(t, "publisher.Stdout", fmt.Sprintf("%T", feeds[2].pub.(publisher.Multi)["p1"]))
+	assert.Equal(t, "*publisher.Twitter", fmt.Sprintf("%T", feeds[2].pub.(publisher.Multi)["p2"]))
+	assert.Equal(t, "*publisher.TwitterV2", fmt.Sprintf("%T", feeds[3].pub))
+	assert.Same(t, feeds[1].pub, feeds[2].pub.(publisher.Multi)["p2"], "publisher shared by feeds")
+
+	o.Dry = true
+	feeds, err = setup(o, &store.Memory{}, nil, &pubSet{})
+	require.NoError(t, err)
+	assert.Equal(t, "publisher.Stdout", fmt.Sprintf("%T", feeds[1].pub))
+
+	_, err = setup(opts{Config: "/tmp/not-found.yml"}, &store.Memory{}, nil, &pubSet{})
+	assert.Error(t, err)
+}
+
+func TestMakePublisherWebhookRetries(t *testing.T) {
+	zero := 0
+	tbl := []struct {
+		retries *int
+		res     int
+	}{
+		{nil, publisher.WebhookDefaultRetries},
+		{&zero, 0},
+	}
+	for _, tt := range tbl {
+		p, err := makePublisher(config.Publisher{Type: config.TypeWebhook, URL: "http://example.com", Retries: tt.retries}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, tt.res, p.(*publisher.Webhook).Retries)
+	}
 }
 
 func TestSetupFailed(t *testing.T) {
-	o := opts{Feed: "http://example.com", Dry: false,
+	o := opts{Feeds: []string{"http://example.com"}, Dry: false,
 		ConsumerKey: "1", ConsumerSecret: "1"}
-	_, _, err := setup(o)
+	_, err := setup(o, &store.Memory{}, nil, &pubSet{})
 	assert.NotNil(t, err)
+
+	_, err = setup(opts{}, &store.Memory{}, nil, &pubSet{})
+	assert.EqualError(t, err, "no feed defined, set --feed or --config")
 }
 
 func TestDo(t *testing.T) {
@@ -89,11 +172,162 @@ func TestDo(t *testing.T) {
 		{GUID: "4", Title: "t5", Link: "http://example.com", Text: "Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores "},
 	}}
 	ctx, cancel := context.WithCancel(context.Background())
-	do(ctx, &notif, &pub, "{{.Title}} - {{.Link}}")
+	do(ctx, newFeedSet([]feed{{notif: &notif, pub: &pub, tmpl: mustTemplate("{{.Title}} - {{.Link}}")}}), &store.Memory{}, nil)
 	cancel()
 	assert.Equal(t, "t1 - l1\nt2 - l2\nt4 - l3\nt5 - http://example.com\n", pub.buf.String())
 }
 
+func TestDoOutcomes(t *testing.T) {
+	pub := pubMock{buf: bytes.Buffer{}}
+	notif := notifierMock{delay: 10 * time.Millisecond, events: []rss.Event{
+		{Feed: "f1", GUID: "1", Title: "t1", Link: "l1"},
+		{Feed: "f1", GUID: "2", Title: "t2", Link: "l2"},
+	}}
+	st := &store.Memory{}
+	do(context.Background(), newFeedSet([]feed{{notif: &notif, pub: &pub, tmpl: mustTemplate("{{.Title}} - {{.Link}}")}}), st, nil)
+
+	var res []outcome
+	found, err := st.Load(outcomesBucket, "f1", &res)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "1", res[0].GUID)
+	assert.Equal(t, "t2", res[1].Title)
+	assert.Equal(t, "", res[1].Error)
+
+	saveOutcome(st, rss.Event{Feed: "f1", GUID: "3"}, "p1", errors.New("failed"))
+	saveOutcome(st, rss.Event{Feed: "f1", GUID: "3"}, "p2", nil)
+	found, err = st.Load(outcomesBucket, "f1", &res)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "failed to publish to p1: failed", res[2].Error)
+	assert.Equal(t, map[string]string{"p1": "failed"}, res[2].Failed)
+
+	saveOutcome(st, rss.Event{Feed: "f1", GUID: "3"}, "p1", nil)
+	res = nil
+	found, err = st.Load(outcomesBucket, "f1", &res)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "", res[2].Error, "failure cleared by success")
+	assert.Nil(t, res[2].Failed)
+}
+
+func TestDoSlowDestination(t *testing.T) {
+	slow, fast := &blockMock{release: make(chan struct{})}, &countMock{}
+	notif := notifierMock{delay: time.Millisecond, events: []rss.Event{
+		{Feed: "f1", GUID: "1", Title: "t1"}, {Feed: "f1", GUID: "2", Title: "t2"}, {Feed: "f1", GUID: "3", Title: "t3"},
+	}}
+	fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1", Publishers: []string{"slow", "fast"}}, notif: &notif,
+		pub: publisher.Multi{"slow": slow, "fast": fast}, tmpl: mustTemplate("{{.Title}}")}})
+	done := make(chan struct{})
+	go func() {
+		do(context.Background(), fs, &store.Memory{}, nil)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&fast.n) == 3 }, time.Second, 10*time.Millisecond,
+		"fast destination not held back by the slow one")
+	close(slow.release)
+	<-done
+	assert.Equal(t, "t1\nt2\nt3\n", slow.buf.String(), "slow destination gets all events in order")
+}
+
+func TestDoOutbox(t *testing.T) {
+	good, bad, dup := &pubMock{}, &pubMock{err: errors.New("rate limit")}, &pubMock{err: publisher.Permanent(errors.New("duplicate"))}
+	notif := notifierMock{delay: 10 * time.Millisecond, events: []rss.Event{{Feed: "f1", GUID: "1", Title: "t1", Link: "l1"}}}
+	fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1", Publishers: []string{"good", "bad", "dup"}}, notif: &notif,
+		pub: publisher.Multi{"good": good, "bad": bad, "dup": dup}, tmpl: mustTemplate("{{.Title}} - {{.Link}}")}})
+	ob := &outbox.Outbox{Store: &store.Memory{}}
+	st := &store.Memory{}
+	do(context.Background(), fs, st, ob)
+	assert.Equal(t, "t1 - l1\n", good.buf.String())
+
+	pending, err := ob.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+	assert.Equal(t, "bad", pending[0].Destination)
+	assert.Equal(t, "rate limit", pending[0].LastError)
+	dead, err := ob.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dead))
+	assert.Equal(t, "dup", dead[0].Destination)
+
+	var res []outcome
+	_, err = st.Load(outcomesBucket, "f1", &res)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, map[string]string{"bad": "rate limit", "dup": "duplicate"}, res[0].Failed)
+
+	retry := retryFunc(fs, st)
+	bad.err = nil
+	require.NoError(t, retry(pending[0].Event, "bad"))
+	assert.Equal(t, "t1 - l1\n", bad.buf.String())
+	res = nil
+	_, err = st.Load(outcomesBucket, "f1", &res)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, map[string]string{"dup": "duplicate"}, res[0].Failed, "outcome updated by successful retry")
+	assert.Equal(t, "failed to publish to dup: duplicate", res[0].Error)
+
+	err = retry(pending[0].Event, "removed")
+	assert.True(t, publisher.IsPermanent(err), "unknown publisher")
+	err = retry(rss.Event{Feed: "f2", GUID: "1"}, "bad")
+	assert.True(t, publisher.IsPermanent(err), "unknown feed")
+}
+
+func TestPublishToShutdown(t *testing.T) {
+	pub := &pubMock{}
+	f := feed{conf: config.Feed{URL: "f1"}, pub: pub, tmpl: mustTemplate("{{.Title}} - {{.Link}}")}
+	de := destEvent{feedEvent: feedEvent{Event: rss.Event{Feed: "f1", GUID: "1", Title: "t1"}, feed: f}, dest: "twitter", pub: pub}
+	ob := &outbox.Outbox{Store: &store.Memory{}}
+	st := &store.Memory{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	publishTo(ctx, de, st, ob)
+	assert.Equal(t, "", pub.buf.String())
+
+	pending, err := ob.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+	assert.Equal(t, 0, pending[0].Attempts, "not attempted")
+	assert.Equal(t, "not published: context canceled", pending[0].LastError)
+	found, err := st.Load(outcomesBucket, "f1", &[]outcome{})
+	require.NoError(t, err)
+	assert.False(t, found, "no outcome recorded")
+}
+
+func TestDoExcluded(t *testing.T) {
+	pub := pubMock{}
+	notif := notifierMock{delay: 10 * time.Millisecond, events: []rss.Event{
+		{Feed: "f1", GUID: "1", Title: "Weekly digest", Link: "l1"},
+		{Feed: "f1", GUID: "2", Title: "t2", Link: "l2", Text: strings.Repeat("long text ", 50) + "sponsored"},
+		{Feed: "f1", GUID: "3", Title: "t3", Link: "l3"},
+	}}
+	fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1"}, notif: &notif, pub: &pub, excludes: []string{"^weekly", "sponsored"},
+		tmpl: mustTemplate("{{.Title}} - {{.Link}} {{.Text}}")}})
+	do(context.Background(), fs, &store.Memory{}, nil)
+	assert.Equal(t, "t3 - l3 \n", pub.buf.String(), "excluded by untrimmed message")
+}
+
+func TestDoMultipleFeeds(t *testing.T) {
+	pub1, pub2 := pubMock{buf: bytes.Buffer{}}, pubMock{buf: bytes.Buffer{}}
+	notif1 := notifierMock{delay: 10 * time.Millisecond, events: []rss.Event{
+		{Feed: "f1", GUID: "1", Title: "t1", Link: "l1"},
+		{Feed: "f1", GUID: "2", Title: "t2", Link: "l2"},
+	}}
+	notif2 := notifierMock{delay: 15 * time.Millisecond, events: []rss.Event{
+		{Feed: "f2", GUID: "1", Title: "t3", Link: "l3"},
+	}}
+	feeds := []feed{
+		{conf: config.Feed{URL: "f1"}, notif: &notif1, pub: &pub1, tmpl: mustTemplate("{{.Title}} - {{.Link}}")},
+		{conf: config.Feed{URL: "f2"}, notif: &notif2, pub: &pub2, tmpl: mustTemplate("{{.Link}} {{.Title}}")},
+	}
+	do(context.Background(), newFeedSet(feeds), &store.Memory{}, nil)
+	assert.Equal(t, "t1 - l1\nt2 - l2\n", pub1.buf.String())
+	assert.Equal(t, "l3 t3\n", pub2.buf.String())
+}
+
 func TestDoWithText(t *testing.T) {
 	pub := pubMock{buf: bytes.Buffer{}}
 	notif := notifierMock{delay: 100 * time.Millisecond, events: []rss.Event{
@@ -103,11 +337,66 @@ func TestDoWithText(t *testing.T) {
 		{GUID: "4", Title: "t5", Link: "http://example.com", Text: "Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores "},
 	}}
 	ctx, cancel := context.WithCancel(context.Background())
-	do(ctx, &notif, &pub, "{{.Text}} - {{.Link}}")
+	do(ctx, newFeedSet([]feed{{notif: &notif, pub: &pub, tmpl: mustTemplate("{{.Text}} - {{.Link}}")}}), &store.Memory{}, nil)
 	cancel()
 	assert.Equal(t, "ttt2 - l1\nttt2 - l2\nttt3 - l3\nLorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores  - http://example.com\n", pub.buf.String())
 }
 
+func TestDoThread(t *testing.T) {
+	pub, thread := &pubMock{}, &threadMock{}
+	text := "First sentence of the text. Second sentence of the text, which makes it too long for a single message."
+	notif := notifierMock{delay: 10 * time.Millisecond, events: []rss.Event{{Feed: "f1", GUID: "1", Title: "t1", Link: "l1", Text: text}}}
+	fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1", Publishers: []string{"single", "thread"}, Thread: true,
+		ThreadLink: config.ThreadLinkLast}, notif: &notif, pub: publisher.Multi{"single": pub, "thread": thread},
+		tmpl: mustTemplate("{{.Title}}: {{.Text}} {{.Link}}")}})
+	do(context.Background(), fs, &store.Memory{}, nil)
+	assert.Equal(t, "t1: "+text+" l1\n", pub.buf.String(), "publisher without thread support gets single message")
+	assert.Equal(t, []string{"t1: First sentence of the text. 1/3", "Second sentence of the text, which makes it too long 2/3",
+		"for a single message.\nl1 3/3"}, thread.msgs)
+}
+
+func TestDoUpdates(t *testing.T) {
+	events := []rss.Event{{Feed: "f1", GUID: "1", Title: "t1", Link: "l1"}, {Feed: "f1", GUID: "1", Title: "t1 fixed", Link: "l1", Update: true}}
+	tbl := []struct {
+		updates   string
+		pub, edit string
+	}{
+		{config.UpdatesIgnore, "t1 - l1\n", ""},
+		{config.UpdatesPost, "t1 - l1\nUpdated: t1 fixed - l1\n", ""},
+		{config.UpdatesEdit, "t1 - l1\n", "t1 fixed - l1\n"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.updates, func(t *testing.T) {
+			pub, edit := &pubMock{}, &editMock{}
+			notif := notifierMock{delay: time.Millisecond, events: events}
+			fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1", Publishers: []string{"p1", "p2"}, Updates: tt.updates},
+				notif: &notif, pub: publisher.Multi{"p1": pub, "p2": edit}, tmpl: mustTemplate("{{.Title}} - {{.Link}}"),
+				updTmpl: mustTemplate("Updated: {{.Title}} - {{.Link}}")}})
+			do(context.Background(), fs, &store.Memory{}, nil)
+			assert.Equal(t, tt.pub, edit.pubMock.buf.String())
+			assert.Equal(t, tt.edit, edit.edited.String())
+			if tt.updates == config.UpdatesEdit {
+				assert.Equal(t, "t1 - l1\n", pub.buf.String(), "publisher without editing skips update")
+			}
+		})
+	}
+}
+
+func TestDoUpdatesEditThread(t *testing.T) {
+	text := "First sentence of the text. Second sentence of the text, which makes it too long for a single message."
+	events := []rss.Event{{Feed: "f1", GUID: "1", Title: "t1", Link: "l1", Text: text},
+		{Feed: "f1", GUID: "1", Title: "t2", Link: "l1", Text: text, Update: true}}
+	edit, thread := &editMock{}, &threadEditMock{}
+	notif := notifierMock{delay: time.Millisecond, events: events}
+	fs := newFeedSet([]feed{{conf: config.Feed{URL: "f1", Publishers: []string{"edit", "thread"}, Thread: true,
+		Updates: config.UpdatesEdit}, notif: &notif, pub: publisher.Multi{"edit": edit, "thread": thread},
+		tmpl: mustTemplate("{{.Title}}: {{.Text}} {{.Link}}")}})
+	do(context.Background(), fs, &store.Memory{}, nil)
+	assert.Equal(t, "t1: "+text+" l1\n", edit.pubMock.buf.String())
+	assert.Equal(t, "t2: "+text+" l1\n", edit.edited.String(), "editor without threads gets the whole message")
+	assert.Equal(t, []string{"t2: First sentence of the text. l1 1/3"}, thread.edited, "thread editor gets the first message")
+}
+
 func TestDoCanceled(t *testing.T) {
 	pub := pubMock{buf: bytes.Buffer{}}
 	notif := notifierMock{delay: 100 * time.Millisecond, events: []rss.Event{
@@ -117,7 +406,7 @@ func TestDoCanceled(t *testing.T) {
 	}}
 	ctx, cancel := context.WithCancel(context.Background())
 	time.AfterFunc(time.Millisecond*150, func() { cancel() })
-	do(ctx, &notif, &pub, "{{.Title}} - {{.Link}} {{.Text}}")
+	do(ctx, newFeedSet([]feed{{notif: &notif, pub: &pub, tmpl: mustTemplate("{{.Title}} - {{.Link}} {{.Text}}")}}), &store.Memory{}, nil)
 	assert.Equal(t, "t1 - l1 ttt2\n", pub.buf.String())
 }
 
@@ -138,13 +427,13 @@ func Test_formatMsg(t *testing.T) {
 			rss.Event{Text: "test too long to fit to a tweet", Link: "link5678901234567890123"},
 			"12345 {{.Link}} xxx {{.Text}} yes",
 			50,
-			"12345 link5678901234567890123 xxx test...  yes",
+			"12345 link5678901234567890123 xxx test too...  yes",
 		},
 		{
 			rss.Event{Text: "test too long to fit to a <a href=example.com>tweet</a>"},
 			"12345 xxx blah blah {{.Text}} \n hmm 123456",
 			50,
-			"12345 xxx blah blah test too long to fit to a... ",
+			"12345 xxx blah blah test too long...  \n hmm 123456",
 		},
 		{
 			rss.Event{Text: `test <a href="https://example.com">ok\n yes?`, Link: "link5678901234567890123"},
@@ -186,13 +475,109 @@ func Test_formatMsg(t *testing.T) {
 
 	for i, tt := range tbl {
 		t.Run(fmt.Sprintf("check-%d", i), func(t *testing.T) {
-			res := formatMsg(tt.inp, tt.tmpl, tt.max)
+			res := formatMsg(tt.inp, mustTemplate(tt.tmpl), publisher.Limits{MaxLen: tt.max, LinkLen: 23})
 			assert.Equal(t, tt.res, res)
 			t.Logf("res len: %d", len(res))
 		})
 	}
 }
 
+func Test_formatMsgLimits(t *testing.T) {
+	ev := rss.Event{Title: "Заголовок достаточно длинный, чтобы не влезть", Link: "https://example.com/link"}
+
+	// link counted as is, message fits 50 runes
+	res := formatMsg(ev, mustTemplate("{{.Title}} {{.Link}}"), publisher.Limits{MaxLen: 50})
+	assert.Equal(t, "Заголовок достаточно...  https://example.com/link", res)
+
+	// custom counter, each rune counted as 2
+	res = formatMsg(ev, mustTemplate("{{.Title}} {{.Link}}"), publisher.Limits{MaxLen: 70, LinkLen: 23,
+		Count: func(s string) int { return 2 * len([]rune(s)) }})
+	assert.Equal(t, "Заголовок...  https://example.com/link", res)
+
+	// twitter weighted length, cjk counted as 2
+	ev.Title = strings.Repeat("日本語のテキスト ", 20)
+	res = formatMsg(ev, mustTemplate("{{.Title}} {{.Link}}"), publisher.TwitterLimits)
+	assert.Equal(t, strings.TrimSpace(strings.Repeat("日本語のテキスト ", 14))+"...  https://example.com/link", res)
+	assert.Equal(t, 265, publisher.TwitterLimits.Len(res), "the next word doesn't fit, 17 more")
+}
+
+func Test_formatMsgEscape(t *testing.T) {
+	lim := publisher.Limits{MaxLen: 60, Escape: func(s string) string { return strings.Replace(s, "&", "&amp;", -1) }}
+	ev := rss.Event{Title: "Tom & Jerry", Link: "https://example.com/?a=1&b=2", Text: "cats & mice & dogs & birds & fish"}
+	assert.Equal(t, "<b>Tom &amp; Jerry</b> https://example.com/?a=1&amp;b=2",
+		formatMsg(ev, mustTemplate("<b>{{.Title}}</b> {{.Link}}"), lim))
+	lim.MaxLen = 30
+	assert.Equal(t, "<i>cats &amp; mice... </i>", formatMsg(ev, mustTemplate("<i>{{.Text}}</i>"), lim),
+		"text trimmed before escaping, escaped message fits")
+}
+
+func Test_formatMsgTemplates(t *testing.T) {
+	text := "Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore"
+	ev := rss.Event{Title: "Some title of the post", Link: "https://example.com/some/long/link/to/the/post", Text: text,
+		Author: "John Doe", Categories: []string{"golang", "machine learning"}}
+	lim := publisher.Limits{MaxLen: 80, LinkLen: 23}
+
+	tbl := []struct {
+		tmpl, res string
+	}{
+		{"{{ .Title }}: {{ .Text }} {{ .Link }}", "Some title of the post: Lorem ipsum dolor sit amet,...  https://example.com/some/long/link/to/the/post"},
+		{"{{.Author}} | {{.Title}} | {{.Text}}", "John Doe | Some title of the post | Lorem ipsum dolor sit amet, consetetur... "},
+		{"{{upper .Text}} {{hashtags .Categories}}", "LOREM IPSUM DOLOR SIT AMET, CONSETETUR SADIPSCING...  #golang #MachineLearning"},
+		{"{{.Title}} {{.Link}} {{.Link}}", "Some title of the post https://example.com/some/long/link/to/the/post https://example.com/some/long/link/to/the/post"},
+		{"{{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Title}}",
+			"John Doe John Doe John Doe John Doe John Doe John Doe John Doe John Doe Some... "},
+		{"{{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Author}} {{.Title}}",
+			"John Doe John Doe John Doe John Doe John Doe John Doe John Doe John Doe... "},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			res := formatMsg(ev, mustTemplate(tt.tmpl), lim)
+			assert.Equal(t, tt.res, res)
+			assert.True(t, msgLen(res, ev.Link, lim) <= lim.MaxLen, msgLen(res, ev.Link, lim))
+		})
+	}
+}
+
+func Test_formatMsgFields(t *testing.T) {
+	ev := rss.Event{Title: "Episode 1", Link: "https://example.com/1", Duration: "1:02:03", Categories: []string{"tech", "go"},
+		Author: "Umputun", Published: time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC), EnclosureURL: "https://example.com/1.mp3",
+		ChanLink: "https://example.com", Images: []rss.Image{{URL: "https://example.com/1.jpg"}}}
+	lim := publisher.Limits{MaxLen: 279, LinkLen: 23}
+	assert.Equal(t, "New episode Episode 1 (1:02:03) #tech", formatMsg(ev, mustTemplate("New episode {{.Title}} ({{.Duration}}) #{{index .Categories 0}}"), lim))
+	assert.Equal(t, "Umputun, 2024-05-17: https://example.com/1.mp3 https://example.com/1.jpg https://example.com",
+		formatMsg(ev, mustTemplate(`{{.Author}}, {{.Published.Format "2006-01-02"}}: {{.EnclosureURL}} {{.ImageURL}} {{.ChanLink}}`), lim))
+
+	lim.Escape = func(s string) string { return strings.Replace(s, "&", "&amp;", -1) }
+	ev.Categories, ev.Author = []string{"R&D"}, "Tom & Jerry"
+	assert.Equal(t, "Tom &amp; Jerry #R&amp;D", formatMsg(ev, mustTemplate("{{.Author}} #{{index .Categories 0}}"), lim))
+}
+
+func Test_formatMsgTemplateFailed(t *testing.T) {
+	buf := bytes.Buffer{}
+	log.Setup(log.Out(&buf))
+	defer log.Setup()
+
+	ev := rss.Event{GUID: "g1", Title: "Some title", Link: "https://example.com/1", Text: strings.Repeat("long text ", 50),
+		Categories: []string{"go"}}
+	tmpl := mustTemplate("{{.Title}} {{.Text}} #{{index .Categories 1}}") // fails for event with a single category
+	assert.Equal(t, "Some title - https://example.com/1", formatMsg(ev, tmpl, publisher.Limits{MaxLen: 100, LinkLen: 23}))
+	assert.Equal(t, []string{"Some title - https://example.com/1"}, formatThread(ev, tmpl, publisher.Limits{MaxLen: 100}, false))
+	assert.Equal(t, 2, strings.Count(buf.String(), "can't apply template to g1"), "logged once per message")
+}
+
+func Test_formatMsgTemplateFailedEscaped(t *testing.T) {
+	ev := rss.Event{GUID: "g1", Title: "Tom & Jerry, the very long title of the post", Link: "https://example.com/x"}
+	tmpl := mustTemplate("{{.Title}} #{{index .Categories 0}}")
+
+	md := publisher.Limits{MaxLen: 100, Escape: strings.NewReplacer("-", `\-`, ".", `\.`).Replace} // like markdown v2
+	assert.Equal(t, `Tom & Jerry, the very long title of the post \- https://example\.com/x`, formatMsg(ev, tmpl, md))
+
+	html := publisher.Limits{MaxLen: 30, Escape: func(s string) string { return strings.Replace(s, "&", "&amp;", -1) }}
+	assert.Equal(t, "Tom &amp; Jerry, the very... ", formatMsg(ev, tmpl, html), "entity not cut")
+	md.MaxLen = 30
+	assert.Equal(t, `Tom & Jerry, the very\.\.\. `, formatMsg(ev, tmpl, md), "dots escaped")
+}
+
 func TestExclusionPatterns(t *testing.T) {
 	excludes := []string{
 		"^The",
@@ -219,6 +604,26 @@ func TestExclusionPatterns(t *testing.T) {
 	}
 }
 
+func TestHealthSummary(t *testing.T) {
+	buf := bytes.Buffer{}
+	log.Setup(log.Out(&buf))
+	defer log.Setup()
+
+	healthSummary(map[string]rss.Health{"f1": {}, "f2": {LastSuccess: time.Now()}})
+	assert.Contains(t, buf.String(), "INFO  feeds health, 2 feeds, all healthy")
+
+	buf.Reset()
+	ts := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	healthSummary(map[string]rss.Health{"f1": {},
+		"f2": {Degraded: true, Failures: 7, LastError: "status 500", LastSuccess: ts},
+		"f3": {Degraded: true, Failures: 5, LastError: "timeout"}})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 3, len(lines))
+	assert.Contains(t, lines[0], "WARN  feeds health, 3 feeds, 2 degraded")
+	assert.Contains(t, lines[1], "WARN  feed f2 degraded, 7 failures, last success 2024-05-17T10:00:00Z, status 500")
+	assert.Contains(t, lines[2], "WARN  feed f3 degraded, 5 failures, last success never, timeout")
+}
+
 func TestGetDump(t *testing.T) {
 	dump := getDump()
 	assert.True(t, strings.Contains(dump, "goroutine"))
@@ -229,13 +634,70 @@ func TestGetDump(t *testing.T) {
 
 type pubMock struct {
 	buf bytes.Buffer
+	err error // returned by Publish if set, nothing written
 }
 
-func (m *pubMock) Publish(event rss.Event, formatter func(rss.Event) string) error {
-	_, err := m.buf.WriteString(formatter(event) + "\n")
+func (m *pubMock) Publish(event rss.Event, formatter publisher.Formatter) error {
+	if m.err != nil {
+		return m.err
+	}
+	_, err := m.buf.WriteString(formatter(event, publisher.TwitterLimits) + "\n")
 	return err
 }
 
+type threadMock struct {
+	msgs []string
+}
+
+func (m *threadMock) Publish(event rss.Event, formatter publisher.Formatter) error {
+	m.msgs = append(m.msgs, formatter(event, publisher.Limits{MaxLen: 60}))
+	return nil
+}
+
+func (m *threadMock) PublishThread(event rss.Event, formatter publisher.ThreadFormatter) error {
+	m.msgs = append(m.msgs, formatter(event, publisher.Limits{MaxLen: 60})...)
+	return nil
+}
+
+type editMock struct {
+	pubMock
+	edited bytes.Buffer
+}
+
+func (m *editMock) Edit(event rss.Event, formatter publisher.Formatter) error {
+	_, err := m.edited.WriteString(formatter(event, publisher.TwitterLimits) + "\n")
+	return err
+}
+
+type blockMock struct {
+	pubMock
+	release chan struct{}
+}
+
+func (m *blockMock) Publish(event rss.Event, formatter publisher.Formatter) error {
+	<-m.release
+	return m.pubMock.Publish(event, formatter)
+}
+
+type countMock struct {
+	n int32
+}
+
+func (m *countMock) Publish(rss.Event, publisher.Formatter) error {
+	atomic.AddInt32(&m.n, 1)
+	return nil
+}
+
+type threadEditMock struct {
+	threadMock
+	edited []string
+}
+
+func (m *threadEditMock) Edit(event rss.Event, formatter publisher.Formatter) error {
+	m.edited = append(m.edited, formatter(event, publisher.Limits{MaxLen: 60}))
+	return nil
+}
+
 type notifierMock struct {
 	events []rss.Event
 	delay  time.Duration
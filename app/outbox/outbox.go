@@ -0,0 +1,221 @@
+// Package outbox keeps failed publishing attempts and retries them with exponential backoff.
+// Entries failed with permanent error or out of attempts moved to dead letters, the most recent ones kept.
+package outbox
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+const (
+	outboxBucket = "outbox" // pending entries, keyed by entry id
+	deadBucket   = "dead"   // dead letters, keyed by entry id
+
+	maxDeadLetters = 100 // max number of dead letters kept, the oldest dropped
+
+	defaultMaxAttempts = 5
+	defaultMinDelay    = time.Minute
+	defaultMaxDelay    = time.Hour
+)
+
+// Outbox stores failed events per destination and retries them
+type Outbox struct {
+	Store       store.Interface
+	MaxAttempts int           // max number of publishing attempts, including the first one, 5 if not set
+	MinDelay    time.Duration // delay before the first retry, doubled on each next one, 1m if not set
+	MaxDelay    time.Duration // max delay between retries, 1h if not set
+}
+
+// Entry is event failed to publish to destination
+type Entry struct {
+	ID          string    `json:"id"`
+	Event       rss.Event `json:"event"`
+	Destination string    `json:"destination"` // publisher name
+	Attempts    int       `json:"attempts"`
+	NextTry     time.Time `json:"next_try"`
+	LastError   string    `json:"last_error"`
+}
+
+// PublishFunc publishes event to destination, used for retries
+type PublishFunc func(event rss.Event, dest string) error
+
+// Add failed event to the outbox. Event failed with permanent error goes directly to dead letters.
+func (o *Outbox) Add(event rss.Event, dest string, pubErr error) error {
+	e := Entry{ID: entryID(event, dest), Event: event, Destination: dest}
+	return o.failed(e, pubErr)
+}
+
+// Defer adds event not attempted to publish, i.e. left in queue on shutdown, to the outbox. It is due right away
+// and no attempt counted. Entry of the event already in the outbox kept as is.
+func (o *Outbox) Defer(event rss.Event, dest string, reason error) error {
+	e := Entry{ID: entryID(event, dest), Event: event, Destination: dest, LastError: reason.Error(), NextTry: time.Now()}
+	found, err := o.Store.Load(outboxBucket, e.ID, &Entry{})
+	if err != nil {
+		return errors.Wrapf(err, "can't load %s", e.ID)
+	}
+	if found {
+		return nil
+	}
+	return errors.Wrapf(o.Store.Save(outboxBucket, e.ID, e), "can't save %s to outbox", e.ID)
+}
+
+// Run retries due entries every interval until ctx canceled
+func (o *Outbox) Run(ctx context.Context, interval time.Duration, publish PublishFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.retry(publish, time.Now())
+		}
+	}
+}
+
+// Pending returns entries waiting for retry, ordered by next try time
+func (o *Outbox) Pending() ([]Entry, error) {
+	return o.entries(outboxBucket)
+}
+
+// DeadLetters returns entries which won't be retried anymore, ordered by last try time
+func (o *Outbox) DeadLetters() ([]Entry, error) {
+	return o.entries(deadBucket)
+}
+
+// retry publishes all entries due at now. Succeeded entries removed, failed rescheduled or moved to dead letters
+func (o *Outbox) retry(publish PublishFunc, now time.Time) {
+	entries, err := o.Pending()
+	if err != nil {
+		log.Printf("[WARN] can't get outbox entries, %v", err)
+		return
+	}
+	for _, e := range entries {
+		if e.NextTry.After(now) {
+			break // sorted by next try, the rest are not due either
+		}
+		log.Printf("[INFO] retry %s to %s, attempt %d", e.Event.GUID, e.Destination, e.Attempts+1)
+		pubErr := publish(e.Event, e.Destination)
+		if pubErr == nil {
+			log.Printf("[INFO] retried %s to %s", e.Event.GUID, e.Destination)
+			if err = o.Store.Delete(outboxBucket, e.ID); err != nil {
+				log.Printf("[WARN] can't remove %s from outbox, %v", e.ID, err)
+			}
+			continue
+		}
+		if err = o.failed(e, pubErr); err != nil {
+			log.Printf("[WARN] can't update %s in outbox, %v", e.ID, err)
+		}
+	}
+}
+
+// failed records failed attempt of the entry, schedules the next one or moves entry to dead letters.
+// Attempt failed by exhausted rate limit not counted, the next one scheduled not earlier than the limit reset.
+func (o *Outbox) failed(e Entry, pubErr error) error {
+	reset, limited := publisher.RetryAfter(pubErr)
+	if !limited {
+		e.Attempts++
+	}
+	e.LastError = pubErr.Error()
+	e.NextTry = time.Now()
+
+	if publisher.IsPermanent(pubErr) || e.Attempts >= o.maxAttempts() {
+		log.Printf("[WARN] dead letter %s to %s after %d attempt(s), %v", e.Event.GUID, e.Destination, e.Attempts, pubErr)
+		if err := o.Store.Save(deadBucket, e.ID, e); err != nil {
+			return errors.Wrapf(err, "can't save dead letter %s", e.ID)
+		}
+		if err := o.trimDead(); err != nil {
+			return err
+		}
+		return errors.Wrapf(o.Store.Delete(outboxBucket, e.ID), "can't remove %s from outbox", e.ID)
+	}
+
+	e.NextTry = e.NextTry.Add(o.backoff(e.Attempts))
+	if limited && reset.After(e.NextTry) {
+		e.NextTry = reset
+	}
+	log.Printf("[INFO] %s to %s scheduled for retry at %s", e.Event.GUID, e.Destination, e.NextTry.Format(time.RFC3339))
+	return errors.Wrapf(o.Store.Save(outboxBucket, e.ID, e), "can't save %s to outbox", e.ID)
+}
+
+// backoff returns delay before the next attempt, exponential with jitter in [d/2, d)
+func (o *Outbox) backoff(attempts int) time.Duration {
+	minDelay, maxDelay := o.MinDelay, o.MaxDelay
+	if minDelay == 0 {
+		minDelay = defaultMinDelay
+	}
+	if maxDelay == 0 {
+		maxDelay = defaultMaxDelay
+	}
+	d := minDelay
+	for i := 1; i < attempts && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // nolint
+}
+
+// trimDead drops the oldest dead letters above maxDeadLetters
+func (o *Outbox) trimDead() error {
+	dead, err := o.DeadLetters()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(dead)-maxDeadLetters; i++ {
+		if err = o.Store.Delete(deadBucket, dead[i].ID); err != nil {
+			return errors.Wrapf(err, "can't remove dead letter %s", dead[i].ID)
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) maxAttempts() int {
+	if o.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *Outbox) entries(bucket string) ([]Entry, error) {
+	keys, err := o.Store.Keys(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get keys of %s", bucket)
+	}
+	res := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		e := Entry{}
+		found, err := o.Store.Load(bucket, k, &e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't load %s", k)
+		}
+		if found {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { // entries due at the same time, i.e. on rate limit reset, kept in order
+		if !res[i].NextTry.Equal(res[j].NextTry) {
+			return res[i].NextTry.Before(res[j].NextTry)
+		}
+		return res[i].Event.Published.Before(res[j].Event.Published)
+	})
+	return res, nil
+}
+
+// entryID makes unique id of event for destination, update of the item has its own id
+func entryID(event rss.Event, dest string) string {
+	if event.Update {
+		return event.Feed + "|" + dest + "|" + event.GUID + "|" + event.Version
+	}
+	return event.Feed + "|" + dest + "|" + event.GUID
+}
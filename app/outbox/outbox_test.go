@@ -0,0 +1,165 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestOutbox(t *testing.T) {
+	o := Outbox{Store: &store.Memory{}, MaxAttempts: 3, MinDelay: time.Minute, MaxDelay: time.Hour}
+	ev1 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-1", Title: "t1"}
+	ev2 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-2", Title: "t2"}
+
+	require.NoError(t, o.Add(ev1, "twitter", errors.New("rate limit")))
+	require.NoError(t, o.Add(ev2, "mastodon", errors.New("status 502")))
+	require.NoError(t, o.Add(ev2, "telegram", publisher.Permanent(errors.New("forbidden"))))
+
+	pending, err := o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pending))
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.True(t, pending[0].NextTry.After(time.Now().Add(29*time.Second)))
+	dead, err := o.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dead))
+	assert.Equal(t, "telegram", dead[0].Destination)
+	assert.Equal(t, "forbidden", dead[0].LastError)
+
+	// not due yet
+	calls := 0
+	o.retry(func(rss.Event, string) error { calls++; return nil }, time.Now())
+	assert.Equal(t, 0, calls)
+
+	// due, twitter succeeds, mastodon fails again
+	var published []string
+	o.retry(func(ev rss.Event, dest string) error {
+		published = append(published, dest+":"+ev.GUID)
+		if dest == "mastodon" {
+			return errors.New("status 503")
+		}
+		return nil
+	}, time.Now().Add(time.Minute))
+	assert.ElementsMatch(t, []string{"twitter:guid-1", "mastodon:guid-2"}, published)
+	pending, err = o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+	assert.Equal(t, "mastodon", pending[0].Destination)
+	assert.Equal(t, 2, pending[0].Attempts)
+	assert.Equal(t, "status 503", pending[0].LastError)
+
+	// out of attempts
+	o.retry(func(rss.Event, string) error { return errors.New("status 504") }, time.Now().Add(time.Hour))
+	pending, err = o.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(pending))
+	dead, err = o.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dead))
+	assert.Equal(t, 3, dead[1].Attempts)
+	assert.Equal(t, "status 504", dead[1].LastError)
+}
+
+func TestOutboxPermanentOnRetry(t *testing.T) {
+	o := Outbox{Store: &store.Memory{}}
+	ev := rss.Event{Feed: "http://example.com/feed", GUID: "guid-1"}
+	require.NoError(t, o.Add(ev, "twitter", errors.New("timeout")))
+	o.retry(func(rss.Event, string) error { return publisher.Permanent(errors.New("duplicate")) }, time.Now().Add(time.Hour))
+
+	pending, err := o.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(pending))
+	dead, err := o.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dead))
+	assert.Equal(t, 2, dead[0].Attempts)
+}
+
+func TestOutboxRateLimited(t *testing.T) {
+	o := Outbox{Store: &store.Memory{}, MaxAttempts: 2}
+	reset := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	ev1 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-1", Published: time.Now().Add(-time.Hour)}
+	ev2 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-2", Published: time.Now()}
+	require.NoError(t, o.Add(ev2, "twitter", &publisher.RateLimitError{Reset: reset}))
+	require.NoError(t, o.Add(ev1, "twitter", &publisher.RateLimitError{Reset: reset}))
+
+	pending, err := o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pending))
+	assert.Equal(t, "guid-1", pending[0].Event.GUID, "due at the same time, ordered by publication")
+	assert.True(t, reset.Equal(pending[0].NextTry), "retry after reset")
+	assert.Equal(t, 0, pending[0].Attempts, "rate limited attempt not counted")
+
+	o.retry(func(rss.Event, string) error { return &publisher.RateLimitError{Reset: reset.Add(time.Hour)} }, reset)
+	pending, err = o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pending), "not moved to dead letters")
+	assert.True(t, reset.Add(time.Hour).Equal(pending[0].NextTry))
+}
+
+func TestOutboxDefer(t *testing.T) {
+	o := Outbox{Store: &store.Memory{}, MaxAttempts: 2}
+	ev1 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-1"}
+	ev2 := rss.Event{Feed: "http://example.com/feed", GUID: "guid-2"}
+	require.NoError(t, o.Add(ev1, "twitter", errors.New("timeout")))
+	require.NoError(t, o.Defer(ev1, "twitter", errors.New("not published")))
+	require.NoError(t, o.Defer(ev2, "twitter", errors.New("not published")))
+
+	pending, err := o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pending))
+	assert.Equal(t, "guid-2", pending[0].Event.GUID, "deferred entry due right away")
+	assert.Equal(t, 0, pending[0].Attempts)
+	assert.Equal(t, "not published", pending[0].LastError)
+	assert.Equal(t, 1, pending[1].Attempts, "entry already in outbox kept")
+	assert.Equal(t, "timeout", pending[1].LastError)
+
+	o.retry(func(rss.Event, string) error { return errors.New("timeout") }, time.Now().Add(time.Hour))
+	pending, err = o.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending), "deferred entry has all attempts")
+	assert.Equal(t, "guid-2", pending[0].Event.GUID)
+	assert.Equal(t, 1, pending[0].Attempts)
+}
+
+func TestOutboxDeadLettersLimit(t *testing.T) {
+	o := Outbox{Store: &store.Memory{}}
+	for i := 0; i < maxDeadLetters+5; i++ {
+		ev := rss.Event{Feed: "http://example.com/feed", GUID: fmt.Sprintf("guid-%03d", i), Published: time.Now().Add(time.Duration(i) * time.Second)}
+		require.NoError(t, o.Add(ev, "twitter", publisher.Permanent(errors.New("duplicate"))))
+	}
+	dead, err := o.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, maxDeadLetters, len(dead))
+	assert.Equal(t, "guid-005", dead[0].Event.GUID, "the oldest dropped")
+	assert.Equal(t, fmt.Sprintf("guid-%03d", maxDeadLetters+4), dead[len(dead)-1].Event.GUID)
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := Outbox{MinDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	tbl := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, 30 * time.Second, time.Minute},
+		{2, time.Minute, 2 * time.Minute},
+		{3, 2 * time.Minute, 4 * time.Minute},
+		{4, 4 * time.Minute, 8 * time.Minute},
+		{5, 5 * time.Minute, 10 * time.Minute},
+		{20, 5 * time.Minute, 10 * time.Minute},
+	}
+	for _, tt := range tbl {
+		for i := 0; i < 10; i++ {
+			d := o.backoff(tt.attempts)
+			assert.True(t, d >= tt.min && d <= tt.max, "attempt %d, %v", tt.attempts, d)
+		}
+	}
+}
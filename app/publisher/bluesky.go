@@ -0,0 +1,341 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/denisbrodbeck/striphtmltags"
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	blueskyDefaultServer = "https://bsky.social"
+	blueskyMaxLen        = 300 // max post length in graphemes
+	blueskyMaxDescLen    = 300 // max length of link card description
+	blueskyMaxImageSize  = 1000000
+)
+
+// Bluesky implements publisher.Interface and posts to bluesky (AT protocol) with link facets and link card
+type Bluesky struct {
+	Server      string // PDS url, https://bsky.social if not set
+	Handle      string // i.e. example.bsky.social
+	AppPassword string
+	NoImages    bool         // don't attach images
+	Client      *http.Client // optional, default client with 30s timeout used if not set
+
+	once    sync.Once
+	mu      sync.Mutex
+	session *blueskySession
+}
+
+type blueskySession struct {
+	AccessJwt string `json:"accessJwt"`
+	DID       string `json:"did"`
+}
+
+type blueskyPost struct {
+	Type      string         `json:"$type"`
+	Text      string         `json:"text"`
+	CreatedAt string         `json:"createdAt"`
+	Facets    []blueskyFacet `json:"facets,omitempty"`
+	Embed     *blueskyEmbed  `json:"embed,omitempty"`
+	Reply     *blueskyReply  `json:"reply,omitempty"`
+}
+
+// blueskyRef is strong reference to record
+type blueskyRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+type blueskyReply struct {
+	Root   blueskyRef `json:"root"`
+	Parent blueskyRef `json:"parent"`
+}
+
+type blueskyFacet struct {
+	Index struct {
+		ByteStart int `json:"byteStart"`
+		ByteEnd   int `json:"byteEnd"`
+	} `json:"index"`
+	Features []blueskyFeature `json:"features"`
+}
+
+type blueskyFeature struct {
+	Type string `json:"$type"`
+	URI  string `json:"uri"`
+}
+
+type blueskyEmbed struct {
+	Type     string           `json:"$type"`
+	External *blueskyExternal `json:"external,omitempty"`
+	Images   []blueskyImage   `json:"images,omitempty"`
+}
+
+type blueskyExternal struct {
+	URI         string          `json:"uri"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Thumb       json.RawMessage `json:"thumb,omitempty"` // uploaded blob
+}
+
+type blueskyImage struct {
+	Image json.RawMessage `json:"image"` // uploaded blob
+	Alt   string          `json:"alt"`
+}
+
+// blueskyError is error response of xrpc call
+type blueskyError struct {
+	Status  int
+	Name    string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *blueskyError) Error() string {
+	return "status " + http.StatusText(e.Status) + ", " + e.Name + ": " + e.Message
+}
+
+// Publish post to bluesky. Session created on the first call and recreated if expired.
+// Event image attached as link card thumbnail, or as image if event has no link.
+func (b *Bluesky) Publish(event rss.Event, formatter Formatter) error {
+	return b.PublishThread(event, single(formatter))
+}
+
+// Limits returns limits of post, counted in graphemes
+func (b *Bluesky) Limits() Limits {
+	return Limits{MaxLen: blueskyMaxLen, Count: graphemeLen}
+}
+
+// PublishThread posts the first message with link card and image, the rest posted as replies
+func (b *Bluesky) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	log.Printf("[INFO] publish to bluesky %s %+v", b.Handle, event.Title)
+	b.once.Do(func() {
+		if b.Client == nil {
+			b.Client = &http.Client{Timeout: 30 * time.Second}
+		}
+		if b.Server == "" {
+			b.Server = blueskyDefaultServer
+		}
+	})
+
+	msgs := formatter(event, b.Limits())
+
+	var reply *blueskyReply
+	for i, msg := range msgs {
+		post := blueskyPost{
+			Type:      "app.bsky.feed.post",
+			Text:      msg,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Facets:    linkFacets(msg),
+			Reply:     reply,
+		}
+		if i == 0 {
+			post.Embed = b.embed(event)
+		}
+		ref, err := b.publishPost(post)
+		if err != nil {
+			return threadError(err, i, len(msgs))
+		}
+		log.Printf("[DEBUG] published to bluesky %s", strings.Replace(msg, "\n", " ", -1))
+		root := ref
+		if reply != nil {
+			root = reply.Root
+		}
+		reply = &blueskyReply{Root: root, Parent: ref}
+	}
+	return nil
+}
+
+// embed makes link card with image as thumbnail, or image embed if event has no link. Nil if nothing to embed.
+func (b *Bluesky) embed(event rss.Event) *blueskyEmbed {
+	var blob json.RawMessage
+	var img *imageData
+	if !b.NoImages {
+		img = loadImage(b.Client, event, blueskyMaxImageSize)
+	}
+	if img != nil {
+		var err error
+		if blob, err = b.uploadBlob(img); err != nil {
+			log.Printf("[WARN] can't upload image to bluesky, post without image, %v", err)
+		}
+	}
+	switch {
+	case event.Link != "":
+		return &blueskyEmbed{Type: "app.bsky.embed.external", External: &blueskyExternal{
+			URI:         event.Link,
+			Title:       striphtmltags.StripTags(event.Title),
+			Description: trimRunes(strings.TrimSpace(striphtmltags.StripTags(event.Text)), blueskyMaxDescLen),
+			Thumb:       blob,
+		}}
+	case blob != nil:
+		return &blueskyEmbed{Type: "app.bsky.embed.images", Images: []blueskyImage{{Image: blob, Alt: img.Alt}}}
+	}
+	return nil
+}
+
+// publishPost creates post, recreates session and tries again if expired. Returns reference to the new post.
+func (b *Bluesky) publishPost(post blueskyPost) (blueskyRef, error) {
+	ref, err := b.createPost(post)
+	if e, ok := errors.Cause(err).(*blueskyError); ok && (e.Name == "ExpiredToken" || e.Status == http.StatusUnauthorized) {
+		log.Printf("[DEBUG] bluesky session expired, recreate")
+		b.mu.Lock()
+		b.session = nil
+		b.mu.Unlock()
+		ref, err = b.createPost(post)
+	}
+	if err != nil {
+		if e, ok := errors.Cause(err).(*blueskyError); ok && permanentStatus(e.Status) {
+			return ref, Permanent(errors.Wrap(err, "can't send to bluesky"))
+		}
+		return ref, errors.Wrap(err, "can't send to bluesky")
+	}
+	return ref, nil
+}
+
+func (b *Bluesky) createPost(post blueskyPost) (blueskyRef, error) {
+	ref := blueskyRef{}
+	sess, err := b.getSession()
+	if err != nil {
+		return ref, err
+	}
+	req := struct {
+		Repo       string      `json:"repo"`
+		Collection string      `json:"collection"`
+		Record     blueskyPost `json:"record"`
+	}{Repo: sess.DID, Collection: "app.bsky.feed.post", Record: post}
+	err = b.xrpc("com.atproto.repo.createRecord", sess.AccessJwt, req, &ref)
+	return ref, err
+}
+
+// uploadBlob uploads image, returns blob reference to use in post
+func (b *Bluesky) uploadBlob(img *imageData) (json.RawMessage, error) {
+	sess, err := b.getSession()
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Blob json.RawMessage `json:"blob"`
+	}{}
+	if err = b.xrpcRaw("com.atproto.repo.uploadBlob", sess.AccessJwt, img.Type, img.Data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Blob, nil
+}
+
+// getSession returns current session, creates a new one if not created yet
+func (b *Bluesky) getSession() (blueskySession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.session != nil {
+		return *b.session, nil
+	}
+	sess := blueskySession{}
+	req := struct {
+		Identifier string `json:"identifier"`
+		Password   string `json:"password"`
+	}{Identifier: b.Handle, Password: b.AppPassword}
+	if err := b.xrpc("com.atproto.server.createSession", "", req, &sess); err != nil {
+		return sess, errors.Wrap(err, "can't create session")
+	}
+	b.session = &sess
+	return sess, nil
+}
+
+// xrpc makes procedure call with json request, decodes response to resp if not nil
+func (b *Bluesky) xrpc(method, token string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal %s request", method)
+	}
+	return b.xrpcRaw(method, token, "application/json", body, resp)
+}
+
+// xrpcRaw makes procedure call with body of given content type, decodes json response to resp if not nil
+func (b *Bluesky) xrpcRaw(method, token, contentType string, body []byte, resp interface{}) error {
+	httpReq, err := http.NewRequest("POST", strings.TrimSuffix(b.Server, "/")+"/xrpc/"+method, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "can't make %s request", method)
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpResp, err := b.Client.Do(httpReq)
+	if err != nil {
+		return errors.Wrapf(err, "%s failed", method)
+	}
+	defer httpResp.Body.Close() // nolint
+
+	if httpResp.StatusCode != http.StatusOK {
+		e := blueskyError{Status: httpResp.StatusCode}
+		_ = json.NewDecoder(httpResp.Body).Decode(&e)
+		return errors.Wrapf(&e, "%s failed", method)
+	}
+	if resp == nil {
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(httpResp.Body).Decode(resp), "can't decode %s response", method)
+}
+
+var linkRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// linkFacets makes link facets for all urls in the message. Facet positions are byte offsets in utf-8 text.
+func linkFacets(msg string) (res []blueskyFacet) {
+	for _, loc := range linkRe.FindAllStringIndex(msg, -1) {
+		start, end := loc[0], loc[1]
+		end -= len(msg[start:end]) - len(strings.TrimRight(msg[start:end], ".,;:!?)")) // trailing punctuation is not a part of link
+		f := blueskyFacet{Features: []blueskyFeature{{Type: "app.bsky.richtext.facet#link", URI: msg[start:end]}}}
+		f.Index.ByteStart, f.Index.ByteEnd = start, end
+		res = append(res, f)
+	}
+	return res
+}
+
+// graphemeLen counts user-perceived characters, approximation of unicode grapheme clusters good enough for limits.
+// Combining marks, variation selectors and zero-width joiner sequences are not counted separately,
+// as well as the second regional indicator of a flag pair.
+func graphemeLen(s string) int {
+	res := 0
+	joined, pendingFlag := false, false
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me), r >= 0xFE00 && r <= 0xFE0F, r >= 0x1F3FB && r <= 0x1F3FF: // marks, modifiers
+			continue
+		case r == 0x200D: // zero-width joiner, the next rune is a part of the same cluster
+			joined = true
+			continue
+		case joined:
+			joined = false
+			continue
+		case r >= 0x1F1E6 && r <= 0x1F1FF: // regional indicators, pair makes a flag
+			if pendingFlag {
+				pendingFlag = false
+				continue
+			}
+			pendingFlag = true
+			res++
+			continue
+		}
+		pendingFlag = false
+		res++
+	}
+	return res
+}
+
+// trimRunes cuts s to max runes
+func trimRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
@@ -0,0 +1,199 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestBlueskyPublish(t *testing.T) {
+	var sessions, posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			n := atomic.AddInt32(&sessions, 1)
+			req := map[string]string{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, map[string]string{"identifier": "user.bsky.social", "password": "app-pass"}, req)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"accessJwt":"jwt%d","did":"did:plc:123"}`, n)))
+		case "/xrpc/com.atproto.repo.createRecord":
+			if atomic.AddInt32(&posts, 1) == 1 { // first post fails with expired session
+				assert.Equal(t, "Bearer jwt1", r.Header.Get("Authorization"))
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"ExpiredToken","message":"Token has expired"}`))
+				return
+			}
+			assert.Equal(t, "Bearer jwt2", r.Header.Get("Authorization"))
+			req := struct {
+				Repo       string      `json:"repo"`
+				Collection string      `json:"collection"`
+				Record     blueskyPost `json:"record"`
+			}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "did:plc:123", req.Repo)
+			assert.Equal(t, "app.bsky.feed.post", req.Collection)
+			assert.Equal(t, "app.bsky.feed.post", req.Record.Type)
+			assert.Equal(t, "Привет - https://example.com/1", req.Record.Text)
+			require.Equal(t, 1, len(req.Record.Facets))
+			assert.Equal(t, 15, req.Record.Facets[0].Index.ByteStart)
+			assert.Equal(t, 36, req.Record.Facets[0].Index.ByteEnd)
+			assert.Equal(t, "https://example.com/1", req.Record.Facets[0].Features[0].URI)
+			require.NotNil(t, req.Record.Embed)
+			assert.Equal(t, "app.bsky.embed.external", req.Record.Embed.Type)
+			assert.Equal(t, "https://example.com/1", req.Record.Embed.External.URI)
+			assert.Equal(t, "Привет", req.Record.Embed.External.Title)
+			assert.Equal(t, "some text", req.Record.Embed.External.Description)
+			_, _ = w.Write([]byte(`{"uri":"at://did:plc:123/app.bsky.feed.post/1","cid":"cid1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	b := Bluesky{Server: ts.URL, Handle: "user.bsky.social", AppPassword: "app-pass"}
+	err := b.Publish(rss.Event{Title: "Привет", Link: "https://example.com/1", Text: "<p>some text</p>"},
+		func(e rss.Event, l Limits) string {
+			assert.Equal(t, 300, l.MaxLen)
+			assert.Equal(t, 0, l.LinkLen)
+			return e.Title + " - " + e.Link
+		})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&sessions))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&posts))
+}
+
+func TestBlueskyPublishFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"AuthenticationRequired","message":"Invalid identifier or password"}`))
+	}))
+	defer ts.Close()
+
+	b := Bluesky{Server: ts.URL, Handle: "user.bsky.social", AppPassword: "bad"}
+	err := b.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't create session")
+	assert.Contains(t, err.Error(), "AuthenticationRequired: Invalid identifier or password")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestLinkFacets(t *testing.T) {
+	facets := linkFacets("see http://example.com/a?b=1, and (https://другой.рф/путь).")
+	require.Equal(t, 2, len(facets))
+	assert.Equal(t, "http://example.com/a?b=1", facets[0].Features[0].URI)
+	assert.Equal(t, 4, facets[0].Index.ByteStart)
+	assert.Equal(t, 28, facets[0].Index.ByteEnd)
+	assert.Equal(t, "https://другой.рф/путь", facets[1].Features[0].URI)
+	assert.Equal(t, 35, facets[1].Index.ByteStart)
+	assert.Equal(t, 35+len("https://другой.рф/путь"), facets[1].Index.ByteEnd)
+
+	assert.Empty(t, linkFacets("no links here"))
+}
+
+func TestGraphemeLen(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"привет", 6},
+		{"é", 1},    // e with combining acute
+		{"👍🏽", 1},    // skin tone modifier
+		{"👨‍👩‍👧", 1}, // zwj family
+		{"🇺🇸🇩🇪", 2},  // two flags
+		{"❤️ ok", 4}, // heart with variation selector
+		{"日本語のテキスト", 8},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, graphemeLen(tt.inp), tt.inp)
+	}
+}
+
+func TestBlueskyPublishWithImage(t *testing.T) {
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			_, _ = w.Write(testPNG)
+		case "/xrpc/com.atproto.server.createSession":
+			_, _ = w.Write([]byte(`{"accessJwt":"jwt1","did":"did:plc:123"}`))
+		case "/xrpc/com.atproto.repo.uploadBlob":
+			assert.Equal(t, "Bearer jwt1", r.Header.Get("Authorization"))
+			assert.Equal(t, "image/png", r.Header.Get("Content-Type"))
+			_, _ = w.Write([]byte(`{"blob":{"$type":"blob","ref":{"$link":"bafk1"},"mimeType":"image/png","size":33}}`))
+		case "/xrpc/com.atproto.repo.createRecord":
+			req := struct {
+				Record blueskyPost `json:"record"`
+			}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			require.NotNil(t, req.Record.Embed)
+			if atomic.AddInt32(&posts, 1) == 1 { // with link, image is link card thumbnail
+				assert.Equal(t, "app.bsky.embed.external", req.Record.Embed.Type)
+				assert.JSONEq(t, `{"$type":"blob","ref":{"$link":"bafk1"},"mimeType":"image/png","size":33}`,
+					string(req.Record.Embed.External.Thumb))
+				assert.Nil(t, req.Record.Embed.Images)
+			} else { // no link, image embedded
+				assert.Equal(t, "app.bsky.embed.images", req.Record.Embed.Type)
+				assert.Nil(t, req.Record.Embed.External)
+				require.Equal(t, 1, len(req.Record.Embed.Images))
+				assert.Equal(t, "image alt", req.Record.Embed.Images[0].Alt)
+				assert.Contains(t, string(req.Record.Embed.Images[0].Image), "bafk1")
+			}
+			_, _ = w.Write([]byte(`{"uri":"at://did:plc:123/app.bsky.feed.post/1","cid":"cid1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	b := Bluesky{Server: ts.URL, Handle: "user.bsky.social", AppPassword: "app-pass"}
+	images := []rss.Image{{URL: ts.URL + "/img.png", Alt: "image alt"}}
+	fmtr := func(e rss.Event, l Limits) string { return e.Title }
+	require.NoError(t, b.Publish(rss.Event{Title: "title", Link: "https://example.com/1", Images: images}, fmtr))
+	require.NoError(t, b.Publish(rss.Event{Title: "title", Images: images}, fmtr))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&posts))
+}
+
+func TestBlueskyPublishThread(t *testing.T) {
+	var posts []blueskyPost
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			_, _ = w.Write([]byte(`{"accessJwt":"jwt1","did":"did:plc:123"}`))
+		case "/xrpc/com.atproto.repo.createRecord":
+			req := struct {
+				Record blueskyPost `json:"record"`
+			}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			posts = append(posts, req.Record)
+			n := len(posts)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"uri":"at://did:plc:123/app.bsky.feed.post/%d","cid":"cid%d"}`, n, n)))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	b := Bluesky{Server: ts.URL, Handle: "user.bsky.social", AppPassword: "app-pass"}
+	err := b.PublishThread(rss.Event{Title: "title", Link: "https://example.com/1"}, func(e rss.Event, l Limits) []string {
+		return []string{"m1", "m2", "m3"}
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(posts))
+	assert.Nil(t, posts[0].Reply)
+	require.NotNil(t, posts[0].Embed, "link card in the first post")
+	assert.Nil(t, posts[1].Embed)
+	assert.Equal(t, &blueskyReply{Root: blueskyRef{URI: "at://did:plc:123/app.bsky.feed.post/1", CID: "cid1"},
+		Parent: blueskyRef{URI: "at://did:plc:123/app.bsky.feed.post/1", CID: "cid1"}}, posts[1].Reply)
+	assert.Equal(t, &blueskyReply{Root: blueskyRef{URI: "at://did:plc:123/app.bsky.feed.post/1", CID: "cid1"},
+		Parent: blueskyRef{URI: "at://did:plc:123/app.bsky.feed.post/2", CID: "cid2"}}, posts[2].Reply)
+}
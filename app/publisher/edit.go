@@ -0,0 +1,122 @@
+package publisher
+
+import (
+	"crypto/sha1" // nolint
+	"encoding/hex"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	postsBucket = "posts"             // store bucket for published posts, keyed by destination, feed and item id
+	postsTTL    = 30 * 24 * time.Hour // published posts kept for editing this long, dropped after
+)
+
+// Editor is implemented by publishers able to edit published messages
+type Editor interface {
+	Edit(event rss.Event, formatter Formatter) error
+}
+
+// PostStore keeps ids of published posts, to edit them on item update
+type PostStore interface {
+	Load(bucket, key string, v interface{}) (bool, error)
+	Save(bucket, key string, v interface{}) error
+	Delete(bucket, key string) error
+	Keys(bucket string) ([]string, error)
+}
+
+// post published for the event, the first message of the thread
+type post struct {
+	ID      string    `json:"id"`
+	MediaID string    `json:"media_id,omitempty"` // attached media, kept on edit
+	Caption bool      `json:"caption,omitempty"`  // message is a caption of the media
+	TS      time.Time `json:"ts"`                 // publication time, post dropped after postsTTL
+}
+
+// Edit edits the message published for the event if pub supports editing, update skipped otherwise.
+// Multi edits with each of its publishers supporting editing.
+func Edit(pub Interface, event rss.Event, formatter Formatter) error {
+	switch p := pub.(type) {
+	case Multi:
+		return p.each(event, func(pub Interface) error { return Edit(pub, event, formatter) })
+	case Editor:
+		return p.Edit(event, formatter)
+	}
+	log.Printf("[DEBUG] %T can't edit messages, update of %s skipped", pub, event.GUID)
+	return nil
+}
+
+// EditThread edits the message published for the event as the first message of the thread, made by thread
+// for publishers supporting threads and by formatter for the rest, the same way PublishThread published them.
+// Replies of the thread not changed.
+func EditThread(pub Interface, event rss.Event, formatter Formatter, thread ThreadFormatter) error {
+	switch p := pub.(type) {
+	case Multi:
+		return p.each(event, func(pub Interface) error { return EditThread(pub, event, formatter, thread) })
+	case Threader:
+		return Edit(pub, event, func(ev rss.Event, lim Limits) string { return thread(ev, lim)[0] })
+	}
+	return Edit(pub, event, formatter)
+}
+
+// savePost keeps post published for the event to dest, nothing saved if st not defined.
+// Posts of dest older than postsTTL dropped, so the store doesn't grow without bound.
+func savePost(st PostStore, dest string, event rss.Event, p post) {
+	if st == nil || p.ID == "" {
+		return
+	}
+	p.TS = time.Now()
+	if err := st.Save(postsBucket, postKey(dest, event), p); err != nil {
+		log.Printf("[WARN] can't save post of %s, %v", event.GUID, err)
+	}
+	prunePosts(st, dest, p.TS.Add(-postsTTL))
+}
+
+// prunePosts deletes posts of dest published before the given time
+func prunePosts(st PostStore, dest string, before time.Time) {
+	keys, err := st.Keys(postsBucket)
+	if err != nil {
+		log.Printf("[WARN] can't get posts, %v", err)
+		return
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, dest+"|") {
+			continue
+		}
+		p := post{}
+		if _, err := st.Load(postsBucket, k, &p); err != nil || !p.TS.Before(before) {
+			continue
+		}
+		if err := st.Delete(postsBucket, k); err != nil {
+			log.Printf("[WARN] can't delete post %s, %v", k, err)
+		}
+	}
+}
+
+// loadPost gets post published for the event to dest, false if not known
+func loadPost(st PostStore, dest string, event rss.Event) (post, bool) {
+	res := post{}
+	if st == nil {
+		return res, false
+	}
+	found, err := st.Load(postsBucket, postKey(dest, event), &res)
+	if err != nil {
+		log.Printf("[WARN] can't load post of %s, %v", event.GUID, err)
+		return res, false
+	}
+	return res, found
+}
+
+func postKey(dest string, event rss.Event) string {
+	return dest + "|" + event.Feed + "|" + event.ID
+}
+
+// account makes short id of the account from its secret, to tell accounts apart without keeping the secret
+func account(secret string) string {
+	h := sha1.Sum([]byte(secret)) // nolint
+	return hex.EncodeToString(h[:4])
+}
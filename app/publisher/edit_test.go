@@ -0,0 +1,124 @@
+package publisher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestMastodonEdit(t *testing.T) {
+	var edited int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch {
+		case r.URL.Path == "/api/v1/statuses" && r.Method == "POST":
+			key := "g1"
+			if r.PostForm.Get("status") != "t1" {
+				key = "g1/v2"
+			}
+			assert.Equal(t, key, r.Header.Get("Idempotency-Key"), "update posted with another key")
+			_, _ = w.Write([]byte(`{"id":"101"}`))
+		case r.URL.Path == "/api/v1/statuses/101" && r.Method == "PUT":
+			atomic.AddInt32(&edited, 1)
+			assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+			assert.Equal(t, "t1 edited", r.PostForm.Get("status"))
+			assert.Equal(t, "spoiler", r.PostForm.Get("spoiler_text"))
+			_, _ = w.Write([]byte(`{"id":"101"}`))
+		default:
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	st := &store.Memory{}
+	m := Mastodon{Server: ts.URL, AccessToken: "token123", SpoilerText: "spoiler", MaxLen: 500, PostStore: st}
+	formatter := func(e rss.Event, _ Limits) string { return e.Title }
+	event := rss.Event{Feed: "f1", GUID: "g1", ID: "g1", Version: "v1", Title: "t1"}
+	require.NoError(t, m.Publish(event, formatter))
+
+	event.Title, event.Version, event.Update = "t1 edited", "v2", true
+	require.NoError(t, Edit(Multi{"m1": &m, "stdout": Stdout{}}, event, formatter))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&edited))
+
+	event.Title = "t1 updated"
+	require.NoError(t, m.Publish(event, formatter), "update posted")
+
+	other := Mastodon{Server: ts.URL, AccessToken: "another", MaxLen: 500, PostStore: st}
+	require.NoError(t, other.Edit(event, formatter), "not published by this account, skipped")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&edited))
+}
+
+func TestTelegramEdit(t *testing.T) {
+	var reqs []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]interface{}{"method": r.URL.Path}
+		if r.Header.Get("Content-Type") == "application/json" {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			req["method"] = r.URL.Path
+		}
+		reqs = append(reqs, req)
+		switch r.URL.Path {
+		case "/bot123:secret/sendMessage":
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":42}}`))
+		case "/bot123:secret/editMessageText":
+			if req["text"] == "same" {
+				_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: message is not modified"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":42}}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	tg := Telegram{Token: "123:secret", Channel: "@channel", ParseMode: TelegramHTML, Server: ts.URL, NoImages: true,
+		PostStore: &store.Memory{}}
+	formatter := func(e rss.Event, l Limits) string {
+		assert.Equal(t, 4096, l.MaxLen)
+		return e.Title
+	}
+	require.NoError(t, tg.Edit(rss.Event{Feed: "f1", ID: "g1", Title: "t1"}, formatter), "not published, skipped")
+	require.Equal(t, 0, len(reqs))
+
+	require.NoError(t, tg.Publish(rss.Event{Feed: "f1", ID: "g1", Title: "t1"}, formatter))
+	require.NoError(t, tg.Edit(rss.Event{Feed: "f1", ID: "g1", Title: "t1 edited", Update: true}, formatter))
+	require.NoError(t, tg.Edit(rss.Event{Feed: "f1", ID: "g1", Title: "same", Update: true}, formatter))
+	require.Equal(t, 3, len(reqs))
+	assert.Equal(t, map[string]interface{}{"method": "/bot123:secret/editMessageText", "chat_id": "@channel",
+		"message_id": float64(42), "text": "t1 edited", "parse_mode": "HTML",
+		"link_preview_options": map[string]interface{}{"is_disabled": false}}, reqs[1])
+}
+
+func TestEditNotSupported(t *testing.T) {
+	err := Edit(Stdout{}, rss.Event{Title: "t1"}, func(e rss.Event, _ Limits) string {
+		t.Fatal("should not format")
+		return ""
+	})
+	assert.NoError(t, err)
+}
+
+func TestSavePostPrune(t *testing.T) {
+	st := &store.Memory{}
+	old := post{ID: "1", TS: time.Now().Add(-postsTTL - time.Hour)}
+	require.NoError(t, st.Save(postsBucket, "d1|f1|old", old))
+	require.NoError(t, st.Save(postsBucket, "d2|f1|old", old))
+
+	savePost(st, "d1", rss.Event{Feed: "f1", ID: "new"}, post{ID: "2"})
+	keys, err := st.Keys(postsBucket)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d1|f1|new", "d2|f1|old"}, keys, "expired post of d1 dropped, other destination kept")
+	p, ok := loadPost(st, "d1", rss.Event{Feed: "f1", ID: "new"})
+	require.True(t, ok)
+	assert.Equal(t, "2", p.ID)
+	assert.WithinDuration(t, time.Now(), p.TS, time.Second)
+}
@@ -0,0 +1,55 @@
+package publisher
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// PermanentError wraps publishing error which won't be fixed by retry, i.e. duplicate status or auth failure
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap returns original error
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent marks err as permanent, nil stays nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent checks if err, or any error it wraps, is permanent
+func IsPermanent(err error) bool {
+	var perr *PermanentError
+	return errors.As(err, &perr)
+}
+
+// RateLimitError reports exhausted rate limit of the account, publishing can be retried after Reset
+type RateLimitError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded till " + e.Reset.Format(time.RFC3339)
+}
+
+// RetryAfter returns rate limit reset if err, or any error it wraps, is RateLimitError
+func RetryAfter(err error) (time.Time, bool) {
+	var rerr *RateLimitError
+	if errors.As(err, &rerr) {
+		return rerr.Reset, true
+	}
+	return time.Time{}, false
+}
+
+// permanentStatus checks if failed http request with given status won't succeed on retry.
+// All 4xx considered permanent except request timeout and rate limit
+func permanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
@@ -0,0 +1,47 @@
+package publisher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermanent(t *testing.T) {
+	assert.NoError(t, Permanent(nil))
+
+	err := Permanent(errors.New("duplicate"))
+	assert.EqualError(t, err, "duplicate")
+	assert.True(t, IsPermanent(err))
+	assert.True(t, IsPermanent(errors.Wrap(err, "can't send")))
+	assert.False(t, IsPermanent(MultiError{"p1": err}), "multi error is not permanent as a whole")
+	assert.False(t, IsPermanent(errors.New("timeout")))
+	assert.False(t, IsPermanent(nil))
+}
+
+func TestRetryAfter(t *testing.T) {
+	reset := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	err := errors.Wrap(&RateLimitError{Reset: reset}, "can't send")
+	assert.EqualError(t, err, "can't send: rate limit exceeded till 2024-05-17T10:00:00Z")
+	ts, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, reset, ts)
+	assert.False(t, IsPermanent(err))
+
+	_, ok = RetryAfter(errors.New("timeout"))
+	assert.False(t, ok)
+}
+
+func TestPermanentStatus(t *testing.T) {
+	tbl := []struct {
+		code int
+		res  bool
+	}{
+		{400, true}, {401, true}, {403, true}, {404, true}, {422, true},
+		{408, false}, {429, false}, {500, false}, {502, false}, {200, false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, permanentStatus(tt.code), "status %d", tt.code)
+	}
+}
@@ -0,0 +1,102 @@
+package publisher
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+// imageTypes are image formats accepted by all publishers, keyed by mime type with file extension as value
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageData is downloaded image ready for upload
+type imageData struct {
+	Data []byte
+	Type string // mime type, detected from content
+	Alt  string
+}
+
+// fileName makes file name for upload, some apis need it with proper extension
+func (img *imageData) fileName() string {
+	return "image" + imageTypes[img.Type]
+}
+
+// loadImage downloads image of the event, the first item image or channel image. Returns nil if event has no image,
+// or the image can't be downloaded, too large or not in supported format. The problem is logged, as the post
+// is expected to be published without image in this case.
+func loadImage(client *http.Client, event rss.Event, maxSize int64) *imageData {
+	img := event.Image()
+	if img == nil {
+		return nil
+	}
+	res, err := downloadImage(client, img.URL, maxSize)
+	if err != nil {
+		log.Printf("[WARN] can't use image %s of %s, %v", img.URL, event.GUID, err)
+		return nil
+	}
+	res.Alt = img.Alt
+	return res
+}
+
+func downloadImage(client *http.Client, url string, maxSize int64) (*imageData, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't download")
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("can't download, status %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, errors.Errorf("too large, %d bytes, max %d", resp.ContentLength, maxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read")
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.Errorf("too large, more than %d bytes", maxSize)
+	}
+	ct := http.DetectContentType(data) // don't trust content type reported by server
+	if _, ok := imageTypes[ct]; !ok {
+		return nil, errors.Errorf("unsupported format %s", ct)
+	}
+	return &imageData{Data: data, Type: ct}, nil
+}
+
+// multipartBody makes multipart/form-data body with fields and image as file field, returns body and its content type
+func multipartBody(fields map[string]string, fileField string, img *imageData) (*bytes.Buffer, string, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return nil, "", errors.Wrapf(err, "can't write field %s", k)
+		}
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="`+fileField+`"; filename="`+img.fileName()+`"`)
+	h.Set("Content-Type", img.Type)
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "can't make file part")
+	}
+	if _, err = part.Write(img.Data); err != nil {
+		return nil, "", errors.Wrap(err, "can't write file part")
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", errors.Wrap(err, "can't close multipart body")
+	}
+	return body, w.FormDataContentType(), nil
+}
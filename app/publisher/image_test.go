@@ -0,0 +1,46 @@
+package publisher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func TestLoadImage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			w.Header().Set("Content-Type", "application/octet-stream") // wrong type, detected from content
+			_, _ = w.Write(testPNG)
+		case "/large.png":
+			_, _ = w.Write(append(testPNG, []byte(strings.Repeat("x", 100))...))
+		case "/page.html":
+			_, _ = w.Write([]byte("<html><body>not an image</body></html>"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	img := loadImage(ts.Client(), rss.Event{Images: []rss.Image{{URL: ts.URL + "/img.png", Alt: "alt text"}}}, 1000)
+	require.NotNil(t, img)
+	assert.Equal(t, &imageData{Data: testPNG, Type: "image/png", Alt: "alt text"}, img)
+	assert.Equal(t, "image.png", img.fileName())
+
+	img = loadImage(ts.Client(), rss.Event{ChanImage: &rss.Image{URL: ts.URL + "/img.png", Alt: "channel"}}, 1000)
+	require.NotNil(t, img)
+	assert.Equal(t, "channel", img.Alt)
+
+	assert.Nil(t, loadImage(ts.Client(), rss.Event{}, 1000), "no image")
+	assert.Nil(t, loadImage(ts.Client(), rss.Event{Images: []rss.Image{{URL: ts.URL + "/large.png"}}}, 100), "too large")
+	assert.Nil(t, loadImage(ts.Client(), rss.Event{Images: []rss.Image{{URL: ts.URL + "/page.html"}}}, 1000), "not image")
+	assert.Nil(t, loadImage(ts.Client(), rss.Event{Images: []rss.Image{{URL: ts.URL + "/missing.png"}}}, 1000), "not found")
+}
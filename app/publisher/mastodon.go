@@ -0,0 +1,333 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	mastodonDefaultMaxLen = 500 // used if instance doesn't report its limit
+	mastodonLinkLen       = 23  // any link counted as 23 characters by mastodon
+	mastodonMaxImageSize  = 8 * 1024 * 1024
+
+	mastodonDefaultMediaWait = 30 * time.Second       // max wait for media processed asynchronously
+	mastodonMediaPoll        = 100 * time.Millisecond // the first delay between media status checks, doubled on each next
+	mastodonMaxMediaPoll     = 2 * time.Second        // max delay between media status checks
+)
+
+// Mastodon implements publisher.Interface and posts statuses to mastodon instance
+type Mastodon struct {
+	Server      string // instance url, i.e. https://mastodon.social
+	AccessToken string
+	Visibility  string        // public, unlisted, private or direct, instance default if not set
+	SpoilerText string        // content warning shown instead of status, optional
+	MaxLen      int           // max status length, retrieved from instance if not set
+	NoImages    bool          // don't attach images
+	MediaWait   time.Duration // max wait for image processed by instance, 30s if not set, posted without image after
+	PostStore   PostStore     // optional, keeps published statuses to edit them on item update
+	Client      *http.Client  // optional, default client with 30s timeout used if not set
+
+	once   sync.Once
+	maxLen int
+}
+
+// Publish status to mastodon
+func (m *Mastodon) Publish(event rss.Event, formatter Formatter) error {
+	return m.PublishThread(event, single(formatter))
+}
+
+// Limits returns max status length of the instance, retrieved from it if MaxLen not set
+func (m *Mastodon) Limits() Limits {
+	m.once.Do(m.init)
+	return Limits{MaxLen: m.maxLen, LinkLen: mastodonLinkLen}
+}
+
+// PublishThread posts status with the first message, the rest posted as replies. Image attached to the first status.
+func (m *Mastodon) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	log.Printf("[INFO] publish to mastodon %s %+v", m.Server, event.Title)
+	m.once.Do(m.init)
+
+	msgs := formatter(event, m.Limits())
+
+	mediaID := ""
+	if img := m.image(event); img != nil {
+		var err error
+		if mediaID, err = m.uploadMedia(img); err != nil {
+			log.Printf("[WARN] can't upload image to mastodon, post without image, %v", err)
+		}
+	}
+	replyTo := ""
+	for i, msg := range msgs {
+		key := event.GUID // prevents duplicate statuses on retries
+		if event.Update {
+			key += "/" + event.Version
+		}
+		if i > 0 {
+			key = fmt.Sprintf("%s/%d", key, i)
+		}
+		id, err := m.postStatus(msg, mediaID, replyTo, key)
+		if err != nil {
+			return threadError(err, i, len(msgs))
+		}
+		log.Printf("[DEBUG] published to mastodon %s", strings.Replace(msg, "\n", " ", -1))
+		if i == 0 && !event.Update {
+			savePost(m.PostStore, m.dest(), event, post{ID: id, MediaID: mediaID})
+		}
+		replyTo, mediaID = id, ""
+	}
+	return nil
+}
+
+// Edit replaces text of the status published for the event, attached image kept. Thread replies not changed.
+// Skipped if the status is not known, i.e. published before PostStore set.
+func (m *Mastodon) Edit(event rss.Event, formatter Formatter) error {
+	log.Printf("[INFO] edit on mastodon %s %+v", m.Server, event.Title)
+	m.once.Do(m.init)
+	p, ok := loadPost(m.PostStore, m.dest(), event)
+	if !ok {
+		log.Printf("[INFO] no mastodon status for %s, update skipped", event.GUID)
+		return nil
+	}
+	msg := formatter(event, m.Limits())
+
+	v := url.Values{}
+	v.Set("status", msg)
+	if m.SpoilerText != "" {
+		v.Set("spoiler_text", m.SpoilerText)
+	}
+	if p.MediaID != "" {
+		v.Set("media_ids[]", p.MediaID)
+	}
+	req, err := http.NewRequest("PUT", m.endpoint("/api/v1/statuses/"+p.ID), strings.NewReader(v.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "can't make mastodon request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "can't edit on mastodon")
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("can't edit on mastodon, %s", responseError(resp))
+		if permanentStatus(resp.StatusCode) {
+			return Permanent(err)
+		}
+		return err
+	}
+	log.Printf("[DEBUG] edited on mastodon %s", strings.Replace(msg, "\n", " ", -1))
+	return nil
+}
+
+func (m *Mastodon) init() {
+	if m.Client == nil {
+		m.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	m.maxLen = m.MaxLen
+	if m.maxLen == 0 {
+		m.maxLen = m.instanceMaxLen()
+	}
+}
+
+// dest identifies the account statuses published to, for PostStore
+func (m *Mastodon) dest() string {
+	return "mastodon:" + strings.TrimSuffix(m.Server, "/") + ":" + account(m.AccessToken)
+}
+
+// postStatus posts a single status, with media attached if mediaID defined and as reply if replyTo defined.
+// Returns id of the new status.
+func (m *Mastodon) postStatus(msg, mediaID, replyTo, idempotencyKey string) (string, error) {
+	v := url.Values{}
+	v.Set("status", msg)
+	if m.Visibility != "" {
+		v.Set("visibility", m.Visibility)
+	}
+	if m.SpoilerText != "" {
+		v.Set("spoiler_text", m.SpoilerText)
+	}
+	if mediaID != "" {
+		v.Set("media_ids[]", mediaID)
+	}
+	if replyTo != "" {
+		v.Set("in_reply_to_id", replyTo)
+	}
+	req, err := http.NewRequest("POST", m.endpoint("/api/v1/statuses"), strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "can't make mastodon request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "can't send to mastodon")
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("can't send to mastodon, %s", responseError(resp))
+		if permanentStatus(resp.StatusCode) {
+			return "", Permanent(err)
+		}
+		return "", err
+	}
+	res := struct {
+		ID string `json:"id"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		log.Printf("[WARN] can't decode mastodon status, %v", err) // published anyway
+	}
+	return res.ID, nil
+}
+
+func (m *Mastodon) image(event rss.Event) *imageData {
+	if m.NoImages {
+		return nil
+	}
+	return loadImage(m.Client, event, mastodonMaxImageSize)
+}
+
+// uploadMedia uploads image with description, returns media id to attach to status.
+// Image processed asynchronously, with 202 response, can't be attached until processed, so waits for it.
+func (m *Mastodon) uploadMedia(img *imageData) (string, error) {
+	body, contentType, err := multipartBody(map[string]string{"description": img.Alt}, "file", img)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", m.endpoint("/api/v2/media"), body)
+	if err != nil {
+		return "", errors.Wrap(err, "can't make media request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "can't upload media")
+	}
+	defer resp.Body.Close()                                                         // nolint
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted { // accepted if processed asynchronously
+		return "", errors.Errorf("can't upload media, %s", responseError(resp))
+	}
+	res := struct {
+		ID  string  `json:"id"`
+		URL *string `json:"url"` // null until processed
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.Wrap(err, "can't decode media response")
+	}
+	if resp.StatusCode == http.StatusAccepted && res.URL == nil {
+		if err = m.waitMedia(res.ID); err != nil {
+			return "", err
+		}
+	}
+	return res.ID, nil
+}
+
+// waitMedia polls media status till it is processed, error if not processed within MediaWait
+func (m *Mastodon) waitMedia(id string) error {
+	wait := m.MediaWait
+	if wait == 0 {
+		wait = mastodonDefaultMediaWait
+	}
+	deadline := time.Now().Add(wait)
+	delay := mastodonMediaPoll
+	for {
+		time.Sleep(delay)
+		processed, err := m.mediaProcessed(id)
+		if err != nil {
+			return err
+		}
+		if processed {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errors.Errorf("media %s not processed in %v", id, wait)
+		}
+		if delay *= 2; delay > mastodonMaxMediaPoll {
+			delay = mastodonMaxMediaPoll
+		}
+		if rest := time.Until(deadline); delay > rest {
+			delay = rest
+		}
+	}
+}
+
+// mediaProcessed checks if uploaded media is processed, i.e. has url
+func (m *Mastodon) mediaProcessed(id string) (bool, error) {
+	req, err := http.NewRequest("GET", m.endpoint("/api/v1/media/"+url.PathEscape(id)), http.NoBody)
+	if err != nil {
+		return false, errors.Wrap(err, "can't make media request")
+	}
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get media")
+	}
+	defer resp.Body.Close()                                                               // nolint
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent { // partial while processed
+		return false, errors.Errorf("can't get media, %s", responseError(resp))
+	}
+	res := struct {
+		URL *string `json:"url"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, errors.Wrap(err, "can't decode media response")
+	}
+	return res.URL != nil && *res.URL != "", nil
+}
+
+// instanceMaxLen gets max status length from the instance info, mastodonDefaultMaxLen on any error
+func (m *Mastodon) instanceMaxLen() int {
+	resp, err := m.Client.Get(m.endpoint("/api/v1/instance"))
+	if err != nil {
+		log.Printf("[WARN] can't get mastodon instance info, %v", err)
+		return mastodonDefaultMaxLen
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[WARN] can't get mastodon instance info, %s", responseError(resp))
+		return mastodonDefaultMaxLen
+	}
+
+	info := struct {
+		Configuration struct {
+			Statuses struct {
+				MaxCharacters int `json:"max_characters"`
+			} `json:"statuses"`
+		} `json:"configuration"`
+		MaxTootChars int `json:"max_toot_chars"` // pleroma and some forks
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		log.Printf("[WARN] can't decode mastodon instance info, %v", err)
+		return mastodonDefaultMaxLen
+	}
+	switch {
+	case info.Configuration.Statuses.MaxCharacters > 0:
+		return info.Configuration.Statuses.MaxCharacters
+	case info.MaxTootChars > 0:
+		return info.MaxTootChars
+	}
+	return mastodonDefaultMaxLen
+}
+
+func (m *Mastodon) endpoint(path string) string {
+	return strings.TrimSuffix(m.Server, "/") + path
+}
+
+// responseError makes error message from failed http response, includes status and the beginning of the body
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Sprintf("status %s, %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,193 @@
+package publisher
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestMastodonPublish(t *testing.T) {
+	var posted int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/instance":
+			_, _ = w.Write([]byte(`{"uri":"example.com","configuration":{"statuses":{"max_characters":1000}}}`))
+		case "/api/v1/statuses":
+			atomic.AddInt32(&posted, 1)
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+			assert.Equal(t, "guid1", r.Header.Get("Idempotency-Key"))
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "title1 - link1", r.PostForm.Get("status"))
+			assert.Equal(t, "unlisted", r.PostForm.Get("visibility"))
+			assert.Equal(t, "spoiler", r.PostForm.Get("spoiler_text"))
+			_, _ = w.Write([]byte(`{"id":"1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	m := Mastodon{Server: ts.URL + "/", AccessToken: "token123", Visibility: "unlisted", SpoilerText: "spoiler"}
+	var lim Limits
+	err := m.Publish(rss.Event{Title: "title1", Link: "link1", GUID: "guid1"}, func(e rss.Event, l Limits) string {
+		lim = l
+		return e.Title + " - " + e.Link
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Limits{MaxLen: 1000, LinkLen: 23}, lim)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&posted))
+}
+
+func TestMastodonPublishFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/instance" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"error":"Validation failed: Text character limit of 500 exceeded"}`))
+	}))
+	defer ts.Close()
+
+	m := Mastodon{Server: ts.URL, AccessToken: "token123"}
+	err := m.Publish(rss.Event{Title: "title1"}, func(e rss.Event, l Limits) string {
+		assert.Equal(t, mastodonDefaultMaxLen, l.MaxLen)
+		return e.Title
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "422 Unprocessable Entity")
+	assert.Contains(t, err.Error(), "character limit of 500 exceeded")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestMastodonPublishWithImage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			_, _ = w.Write(testPNG)
+		case "/api/v2/media":
+			assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+			require.NoError(t, r.ParseMultipartForm(1024))
+			assert.Equal(t, "image alt", r.FormValue("description"))
+			f, h, err := r.FormFile("file")
+			require.NoError(t, err)
+			assert.Equal(t, "image.png", h.Filename)
+			assert.Equal(t, "image/png", h.Header.Get("Content-Type"))
+			data, err := io.ReadAll(f)
+			require.NoError(t, err)
+			assert.Equal(t, testPNG, data)
+			_, _ = w.Write([]byte(`{"id":"media1"}`))
+		case "/api/v1/statuses":
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "title1", r.Form.Get("status"))
+			assert.Equal(t, []string{"media1"}, r.Form["media_ids[]"])
+			_, _ = w.Write([]byte(`{"id":"1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	m := Mastodon{Server: ts.URL, AccessToken: "token123", MaxLen: 500}
+	ev := rss.Event{Title: "title1", Images: []rss.Image{{URL: ts.URL + "/img.png", Alt: "image alt"}}}
+	err := m.Publish(ev, func(e rss.Event, l Limits) string { return e.Title })
+	require.NoError(t, err)
+
+	m = Mastodon{Server: ts.URL, AccessToken: "token123", MaxLen: 500, NoImages: true}
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/statuses", r.URL.Path, "no image requests")
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, 0, len(r.Form["media_ids[]"]))
+	})
+	require.NoError(t, m.Publish(ev, func(e rss.Event, l Limits) string { return e.Title }))
+}
+
+func TestMastodonPublishWithImageProcessed(t *testing.T) {
+	var checks int32
+	processed := int32(2) // checks till media processed
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			_, _ = w.Write(testPNG)
+		case "/api/v2/media":
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"id":"media1","url":null}`))
+		case "/api/v1/media/media1":
+			assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+			if atomic.AddInt32(&checks, 1) < atomic.LoadInt32(&processed) {
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write([]byte(`{"id":"media1","url":null}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"id":"media1","url":"https://files.example.com/media1.png"}`))
+		case "/api/v1/statuses":
+			require.NoError(t, r.ParseForm())
+			posted = append(posted, strings.Join(r.Form["media_ids[]"], ","))
+			_, _ = w.Write([]byte(`{"id":"1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	ev := rss.Event{GUID: "g1", Title: "title1", Images: []rss.Image{{URL: ts.URL + "/img.png"}}}
+	m := Mastodon{Server: ts.URL, AccessToken: "token123", MaxLen: 500}
+	require.NoError(t, m.Publish(ev, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&checks))
+	assert.Equal(t, []string{"media1"}, posted, "posted after media processed")
+
+	// not processed in time, posted without image
+	atomic.StoreInt32(&checks, 0)
+	atomic.StoreInt32(&processed, 100)
+	posted = nil
+	m = Mastodon{Server: ts.URL, AccessToken: "token123", MaxLen: 500, MediaWait: 250 * time.Millisecond}
+	st := time.Now()
+	require.NoError(t, m.Publish(ev, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.True(t, time.Since(st) < time.Second, time.Since(st))
+	assert.Equal(t, []string{""}, posted, "posted without image")
+}
+
+func TestMastodonPublishThread(t *testing.T) {
+	var posted int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch atomic.AddInt32(&posted, 1) {
+		case 1:
+			assert.Equal(t, "m1", r.PostForm.Get("status"))
+			assert.Equal(t, "", r.PostForm.Get("in_reply_to_id"))
+			assert.Equal(t, "guid1", r.Header.Get("Idempotency-Key"))
+			_, _ = w.Write([]byte(`{"id":"100"}`))
+		case 2:
+			assert.Equal(t, "m2", r.PostForm.Get("status"))
+			assert.Equal(t, "100", r.PostForm.Get("in_reply_to_id"))
+			assert.Equal(t, "guid1/1", r.Header.Get("Idempotency-Key"))
+			_, _ = w.Write([]byte(`{"id":"101"}`))
+		case 3:
+			assert.Equal(t, "101", r.PostForm.Get("in_reply_to_id"))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	m := Mastodon{Server: ts.URL, AccessToken: "token123", MaxLen: 500}
+	fmtr := func(e rss.Event, l Limits) []string { return []string{"m1", "m2"} }
+	require.NoError(t, m.PublishThread(rss.Event{GUID: "guid1"}, fmtr))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&posted))
+
+	atomic.StoreInt32(&posted, 0) // the second reply fails
+	err := m.PublishThread(rss.Event{GUID: "guid1"}, func(e rss.Event, l Limits) []string { return []string{"m1", "m2", "m3"} })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "thread incomplete, 2 of 3 messages published")
+	assert.True(t, IsPermanent(err), "not retried, published messages would be duplicated")
+}
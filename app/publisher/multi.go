@@ -0,0 +1,63 @@
+package publisher
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+// Multi implements publisher.Interface and publishes the same event to all publishers concurrently.
+// Each publisher formats the message with its own limits. Keyed by publisher name used in reports.
+type Multi map[string]Interface
+
+// MultiError reports failed publishers of Multi, keyed by publisher name
+type MultiError map[string]error
+
+// Publish event to all publishers concurrently, waits for all of them to complete.
+// Returns MultiError with failed publishers only, nil if all succeeded.
+func (m Multi) Publish(event rss.Event, formatter Formatter) error {
+	return m.each(event, func(pub Interface) error { return pub.Publish(event, formatter) })
+}
+
+// each calls publish for all publishers concurrently, collects errors to MultiError
+func (m Multi) each(event rss.Event, publish func(pub Interface) error) error {
+	var mu sync.Mutex
+	errs := MultiError{}
+	var wg sync.WaitGroup
+	for name, pub := range m {
+		wg.Add(1)
+		go func(name string, pub Interface) {
+			defer wg.Done()
+			if err := publish(pub); err != nil {
+				log.Printf("[WARN] failed to publish %s to %s, %v", event.GUID, name, err)
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+				return
+			}
+			log.Printf("[DEBUG] published %s to %s", event.GUID, name)
+		}(name, pub)
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (e MultiError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]string, 0, len(e))
+	for _, name := range names {
+		res = append(res, name+": "+e[name].Error())
+	}
+	return "failed to publish to " + strings.Join(res, "; ")
+}
@@ -0,0 +1,97 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestMultiPublish(t *testing.T) {
+	var calls int32
+	m := Multi{
+		"p1": pubFunc(func(e rss.Event, f Formatter) error {
+			atomic.AddInt32(&calls, 1)
+			assert.Equal(t, "msg 100", f(e, Limits{MaxLen: 100}))
+			return nil
+		}),
+		"p2": pubFunc(func(e rss.Event, f Formatter) error {
+			atomic.AddInt32(&calls, 1)
+			assert.Equal(t, "msg 500", f(e, Limits{MaxLen: 500}))
+			return nil
+		}),
+	}
+	err := m.Publish(rss.Event{Title: "msg"}, func(e rss.Event, l Limits) string {
+		return fmt.Sprintf("%s %d", e.Title, l.MaxLen)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestMultiPublishFailed(t *testing.T) {
+	slow := int32(0)
+	m := Multi{
+		"ok": pubFunc(func(e rss.Event, f Formatter) error { return nil }),
+		"slow": pubFunc(func(e rss.Event, f Formatter) error {
+			time.Sleep(50 * time.Millisecond)
+			atomic.StoreInt32(&slow, 1)
+			return errors.New("timeout")
+		}),
+		"bad": pubFunc(func(e rss.Event, f Formatter) error { return errors.New("auth failed") }),
+	}
+	st := time.Now()
+	err := m.Publish(rss.Event{Title: "msg"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.True(t, time.Since(st) < 100*time.Millisecond, "publishers called concurrently")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow))
+
+	merr, ok := err.(MultiError)
+	require.True(t, ok)
+	assert.Equal(t, 2, len(merr))
+	assert.EqualError(t, merr["bad"], "auth failed")
+	assert.EqualError(t, err, "failed to publish to bad: auth failed; slow: timeout")
+}
+
+type pubFunc func(event rss.Event, formatter Formatter) error
+
+func (f pubFunc) Publish(event rss.Event, formatter Formatter) error { return f(event, formatter) }
+
+func TestPublishThread(t *testing.T) {
+	var single, thread int32
+	m := Multi{
+		"single": pubFunc(func(e rss.Event, f Formatter) error {
+			atomic.AddInt32(&single, 1)
+			assert.Equal(t, "msg", f(e, Limits{}))
+			return nil
+		}),
+		"thread": threadFunc(func(e rss.Event, f ThreadFormatter) error {
+			atomic.AddInt32(&thread, 1)
+			assert.Equal(t, []string{"msg 1/2", "msg 2/2"}, f(e, Limits{}))
+			return nil
+		}),
+	}
+	fmtr := func(e rss.Event, l Limits) string { return e.Title }
+	threadFmtr := func(e rss.Event, l Limits) []string { return []string{e.Title + " 1/2", e.Title + " 2/2"} }
+	require.NoError(t, PublishThread(m, rss.Event{Title: "msg"}, fmtr, threadFmtr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&single))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&thread))
+
+	require.NoError(t, PublishThread(m["single"], rss.Event{Title: "msg"}, fmtr, threadFmtr))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&single))
+}
+
+type threadFunc func(event rss.Event, formatter ThreadFormatter) error
+
+func (f threadFunc) Publish(event rss.Event, formatter Formatter) error {
+	return f(event, single(formatter))
+}
+
+func (f threadFunc) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	return f(event, formatter)
+}
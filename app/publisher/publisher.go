@@ -1,12 +1,11 @@
-// Package publisher sends forward rss events to publisher interface (twitter)
+// Package publisher sends forward rss events to publisher interface (twitter, mastodon, bluesky, telegram)
 package publisher
 
 import (
-	"net/url"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
-	"github.com/ChimeraCoder/anaconda"
 	log "github.com/go-pkgz/lgr"
 	"github.com/pkg/errors"
 
@@ -15,19 +14,83 @@ import (
 
 // Interface for publishers
 type Interface interface {
-	Publish(event rss.Event, formatter func(rss.Event) string) error
+	Publish(event rss.Event, formatter Formatter) error
 }
 
-// Stdout implements publisher.Interface and sends to stdout
-type Stdout struct{
-	ExcludeList []string
+// Formatter makes message from rss event, fitting limits of the publisher
+type Formatter func(event rss.Event, lim Limits) string
+
+// ThreadFormatter makes thread of messages from rss event, each fitting limits of the publisher.
+// The first message is the post, the rest are replies to it. A single message returned if no thread needed.
+type ThreadFormatter func(event rss.Event, lim Limits) []string
+
+// Threader is implemented by publishers able to post thread of replies
+type Threader interface {
+	PublishThread(event rss.Event, formatter ThreadFormatter) error
+}
+
+// Limiter is implemented by publishers reporting limits of their messages, used to preview messages without publishing
+type Limiter interface {
+	Limits() Limits
+}
+
+// PublishThread publishes event as thread if pub supports threads, as a single message made by formatter otherwise.
+// Multi publishes thread to each of its publishers supporting threads.
+func PublishThread(pub Interface, event rss.Event, formatter Formatter, thread ThreadFormatter) error {
+	switch p := pub.(type) {
+	case Multi:
+		return p.each(event, func(pub Interface) error { return PublishThread(pub, event, formatter, thread) })
+	case Threader:
+		return p.PublishThread(event, thread)
+	}
+	return pub.Publish(event, formatter)
+}
+
+// single makes thread formatter returning a single message made by formatter
+func single(formatter Formatter) ThreadFormatter {
+	return func(event rss.Event, lim Limits) []string {
+		return []string{formatter(event, lim)}
+	}
+}
+
+// threadError makes error of failed thread message. Failure of a reply is permanent, as retry would publish
+// the already published messages again.
+func threadError(err error, n, total int) error {
+	if n == 0 {
+		return err
+	}
+	log.Printf("[WARN] thread incomplete, %d of %d messages published", n, total)
+	return Permanent(errors.Wrapf(err, "thread incomplete, %d of %d messages published", n, total))
+}
+
+// Limits defines restrictions of the message accepted by publisher
+type Limits struct {
+	MaxLen  int                   // max message length
+	LinkLen int                   // length of any link after shortening by publisher, 0 if links counted as is
+	Count   func(s string) int    // message length as counted by publisher, number of runes if not set
+	Escape  func(s string) string // escapes event values for publisher's markup, optional
+}
+
+// Len returns length of s as counted by publisher
+func (l Limits) Len(s string) int {
+	if l.Count != nil {
+		return l.Count(s)
+	}
+	return utf8.RuneCountInString(s)
 }
 
+// TwitterLimits used for twitter, weighted length counted as twitter does. Any link counted as 23 characters.
+// 279 instead of 280 to leave a safe gap, as counting of urls may differ from twitter's.
+var TwitterLimits = Limits{MaxLen: 279, LinkLen: twitterURLLen, Count: twitterLen}
+
+// Stdout implements publisher.Interface and sends to stdout
+type Stdout struct{}
+
 // CheckExclusionList checks the exclusion list for matches
 func CheckExclusionList(excludes []string, msg string) bool {
 	for _, value := range excludes {
 		if len(value) > 0 && !strings.HasPrefix(value, "#") {
-			match, err := regexp.MatchString(strings.ToLower(value), strings.ToLower(msg));
+			match, err := regexp.MatchString(strings.ToLower(value), strings.ToLower(msg))
 			if err != nil {
 				log.Printf("[WARN] regexp.MatchString error: %v", err)
 				return false
@@ -43,37 +106,23 @@ func CheckExclusionList(excludes []string, msg string) bool {
 }
 
 // Publish to logger
-func (s Stdout) Publish(event rss.Event, formatter func(rss.Event) string) error {
-	msg := formatter(event)
-	if CheckExclusionList(s.ExcludeList, msg) {
-		return nil
-	}
-	log.Printf("[INFO] event - %s", msg)
-	return nil
+func (s Stdout) Publish(event rss.Event, formatter Formatter) error {
+	return s.PublishThread(event, single(formatter))
 }
 
-// Twitter implements publisher.Interface and sends to twitter
-type Twitter struct {
-	ConsumerKey, ConsumerSecret string
-	AccessToken, AccessSecret   string
-	ExcludeList []string
+// Limits returns limits of twitter, the default destination
+func (s Stdout) Limits() Limits {
+	return TwitterLimits
 }
 
-// Publish to twitter
-func (t Twitter) Publish(event rss.Event, formatter func(rss.Event) string) error {
-	log.Printf("[INFO] publish to twitter %+v", event.Title)
-	api := anaconda.NewTwitterApiWithCredentials(t.AccessToken, t.AccessSecret, t.ConsumerKey, t.ConsumerSecret)
-	v := url.Values{}
-	v.Set("tweet_mode", "extended")
-	msg := formatter(event)
-	// See if it's been excluded
-	if CheckExclusionList(t.ExcludeList, msg) {
-		return nil
+// PublishThread logs all messages of the thread
+func (s Stdout) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	msgs := formatter(event, s.Limits())
+	for _, msg := range msgs {
+		log.Printf("[INFO] event - %s", msg)
 	}
-	// Post the message
-	if _, err := api.PostTweet(msg, v); err != nil {
-		return errors.Wrap(err, "can't send to twitter")
+	if img := event.Image(); img != nil {
+		log.Printf("[INFO] image - %s", img.URL)
 	}
-	log.Printf("[DEBUG] published to twitter %s", strings.Replace(msg, "\n", " ", -1))
 	return nil
 }
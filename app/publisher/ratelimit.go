@@ -0,0 +1,91 @@
+package publisher
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit keeps the state of api rate limit reported in x-rate-limit-remaining and x-rate-limit-reset headers
+type rateLimit struct {
+	mu    sync.Mutex
+	reset time.Time // no requests allowed till reset, zero if not exhausted
+}
+
+// update sets rate limit state from response headers, ignored if headers not present
+func (r *rateLimit) update(h http.Header) {
+	remaining, reset := h.Get("x-rate-limit-remaining"), h.Get("x-rate-limit-reset")
+	if remaining == "" || reset == "" {
+		return
+	}
+	rem, err := strconv.Atoi(remaining)
+	if err != nil {
+		return
+	}
+	ts, err := strconv.ParseInt(reset, 10, 64)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset = time.Time{}
+	if rem <= 0 {
+		r.reset = time.Unix(ts, 0)
+	}
+}
+
+// exhaust marks rate limit exhausted till reset, used for 429 response without reset header
+func (r *rateLimit) exhaust(reset time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reset.After(r.reset) {
+		r.reset = reset
+	}
+}
+
+// wait returns time to wait for rate limit reset, zero if requests allowed
+func (r *rateLimit) wait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d := time.Until(r.reset); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// check returns RateLimitError if rate limit exhausted. Doesn't wait for reset, the caller expected to fail
+// right away, so the event retried after reset and other publishing is not blocked.
+func (r *rateLimit) check() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.reset) {
+		return &RateLimitError{Reset: r.reset}
+	}
+	return nil
+}
+
+// rateLimitTransport updates rate limit from headers of all responses
+type rateLimitTransport struct {
+	base  http.RoundTripper
+	limit *rateLimit
+}
+
+// rateLimitClient returns copy of client updating rate limit from responses
+func rateLimitClient(c *http.Client, limit *rateLimit) *http.Client {
+	res := *c
+	if res.Transport == nil {
+		res.Transport = http.DefaultTransport
+	}
+	res.Transport = rateLimitTransport{base: res.Transport, limit: limit}
+	return &res
+}
+
+// RoundTrip makes request with base transport and updates rate limit
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.limit.update(resp.Header)
+	}
+	return resp, err
+}
@@ -0,0 +1,267 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	telegramDefaultServer = "https://api.telegram.org"
+	telegramMaxLen        = 4096 // max message length, in utf-16 code units
+	telegramMaxCaptionLen = 1024 // max photo caption length
+	telegramMaxImageSize  = 10 * 1024 * 1024
+)
+
+// telegram parse modes
+const (
+	TelegramHTML       = "HTML"
+	TelegramMarkdownV2 = "MarkdownV2"
+)
+
+// telegramLinkPreview is link preview options of the message
+type telegramLinkPreview struct {
+	IsDisabled bool `json:"is_disabled"`
+}
+
+// Telegram implements publisher.Interface and sends messages to telegram channel with bot api.
+// With parse mode set, event values escaped for the mode, template itself may contain markup.
+type Telegram struct {
+	Token          string       // bot token
+	Channel        string       // channel name, i.e. @mychannel, or chat id
+	ParseMode      string       // TelegramHTML, TelegramMarkdownV2 or empty for plain text
+	DisablePreview bool         // disables link preview
+	NoImages       bool         // don't attach images
+	Server         string       // bot api url, https://api.telegram.org if not set
+	PostStore      PostStore    // optional, keeps published messages to edit them on item update
+	Client         *http.Client // optional, default client with 30s timeout used if not set
+
+	once sync.Once
+}
+
+// Publish message to telegram channel. Event with image sent as photo with the message as caption,
+// caption is shorter than message. If telegram rejects the photo, i.e. with PHOTO_INVALID_DIMENSIONS,
+// the message sent once more without it.
+func (t *Telegram) Publish(event rss.Event, formatter Formatter) error {
+	log.Printf("[INFO] publish to telegram %s %+v", t.Channel, event.Title)
+	t.once.Do(t.init)
+
+	var img *imageData
+	if !t.NoImages {
+		img = loadImage(t.Client, event, telegramMaxImageSize)
+	}
+
+	msg := formatter(event, t.limits(img != nil))
+
+	id, err := t.send(msg, img)
+	if err != nil && img != nil && photoRejected(err) {
+		log.Printf("[WARN] photo rejected by telegram %s, send without it, %v", t.Channel, err)
+		img, msg = nil, formatter(event, t.limits(false))
+		id, err = t.send(msg, nil)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] published to telegram %s", strings.Replace(msg, "\n", " ", -1))
+	if !event.Update {
+		savePost(t.PostStore, t.dest(), event, post{ID: strconv.Itoa(id), Caption: img != nil})
+	}
+	return nil
+}
+
+// Edit replaces text (or caption) of the message published for the event. Skipped if the message is not known,
+// i.e. published before PostStore set.
+func (t *Telegram) Edit(event rss.Event, formatter Formatter) error {
+	log.Printf("[INFO] edit on telegram %s %+v", t.Channel, event.Title)
+	t.once.Do(t.init)
+	p, ok := loadPost(t.PostStore, t.dest(), event)
+	if !ok {
+		log.Printf("[INFO] no telegram message for %s, update skipped", event.GUID)
+		return nil
+	}
+	msg := formatter(event, t.limits(p.Caption))
+
+	msgID, err := strconv.Atoi(p.ID)
+	if err != nil {
+		return Permanent(errors.Wrapf(err, "bad telegram message id %q", p.ID))
+	}
+	req := struct {
+		ChatID      string               `json:"chat_id"`
+		MessageID   int                  `json:"message_id"`
+		Text        string               `json:"text,omitempty"`
+		Caption     string               `json:"caption,omitempty"`
+		ParseMode   string               `json:"parse_mode,omitempty"`
+		LinkPreview *telegramLinkPreview `json:"link_preview_options,omitempty"`
+	}{ChatID: t.Channel, MessageID: msgID, ParseMode: t.ParseMode}
+	method := "editMessageText"
+	if p.Caption {
+		method, req.Caption = "editMessageCaption", msg
+	} else {
+		req.Text, req.LinkPreview = msg, &telegramLinkPreview{IsDisabled: t.DisablePreview}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal telegram request")
+	}
+	if _, err = t.call("edit on", method, bytes.NewReader(data), "application/json"); err != nil {
+		if strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		return err
+	}
+	log.Printf("[DEBUG] edited on telegram %s", strings.Replace(msg, "\n", " ", -1))
+	return nil
+}
+
+func (t *Telegram) init() {
+	if t.Client == nil {
+		t.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if t.Server == "" {
+		t.Server = telegramDefaultServer
+	}
+}
+
+// Limits returns limits of message, photo caption is shorter
+func (t *Telegram) Limits() Limits {
+	return t.limits(false)
+}
+
+// limits of message, or of photo caption, which is shorter than message
+func (t *Telegram) limits(caption bool) Limits {
+	res := Limits{MaxLen: telegramMaxLen, Count: utf16Len}
+	if caption {
+		res.MaxLen = telegramMaxCaptionLen
+	}
+	switch t.ParseMode {
+	case TelegramHTML:
+		res.Escape = escapeHTML
+	case TelegramMarkdownV2:
+		res.Escape = escapeMarkdownV2
+	}
+	return res
+}
+
+// call makes bot api method request, returns id of the sent message if any. Action describes request in errors.
+func (t *Telegram) call(action, method string, body io.Reader, contentType string) (int, error) {
+	// token is a part of url, don't let it leak to error messages
+	resp, err := t.Client.Post(strings.TrimSuffix(t.Server, "/")+"/bot"+t.Token+"/"+method, contentType, body)
+	if err != nil {
+		return 0, errors.Errorf("can't %s telegram, %s", action, strings.Replace(err.Error(), t.Token, "***", -1))
+	}
+	defer resp.Body.Close() // nolint
+
+	res := struct {
+		OK          bool   `json:"ok"`
+		ErrorCode   int    `json:"error_code"`
+		Description string `json:"description"`
+		Result      struct {
+			MessageID int `json:"message_id"`
+		} `json:"result"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, errors.Wrapf(err, "can't decode telegram response, status %s", resp.Status)
+	}
+	if !res.OK {
+		err = errors.Errorf("can't %s telegram, error %d, %s", action, res.ErrorCode, res.Description)
+		if permanentStatus(res.ErrorCode) {
+			return 0, Permanent(err)
+		}
+		return 0, err
+	}
+	return res.Result.MessageID, nil
+}
+
+// telegramPhotoErrors are parts of error descriptions telling the photo itself was rejected
+var telegramPhotoErrors = []string{"PHOTO_", "IMAGE_PROCESS_FAILED", "wrong file identifier",
+	"failed to get HTTP URL content", "wrong type of the web page content"}
+
+// photoRejected checks if the request failed permanently because of the photo, not the message or the channel
+func photoRejected(err error) bool {
+	if !IsPermanent(err) {
+		return false
+	}
+	for _, s := range telegramPhotoErrors {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dest identifies the channel messages published to, for PostStore
+func (t *Telegram) dest() string {
+	return "telegram:" + t.Channel + ":" + account(t.Token)
+}
+
+// send sends the message, as photo caption if image defined, returns id of the sent message
+func (t *Telegram) send(msg string, img *imageData) (int, error) {
+	method, body, contentType, err := t.request(msg, img)
+	if err != nil {
+		return 0, err
+	}
+	return t.call("send to", method, body, contentType)
+}
+
+// request makes sendMessage request, or sendPhoto request if image defined
+func (t *Telegram) request(msg string, img *imageData) (method string, body io.Reader, contentType string, err error) {
+	if img != nil {
+		fields := map[string]string{"chat_id": t.Channel, "caption": msg}
+		if t.ParseMode != "" {
+			fields["parse_mode"] = t.ParseMode
+		}
+		body, contentType, err = multipartBody(fields, "photo", img)
+		return "sendPhoto", body, contentType, err
+	}
+
+	req := struct {
+		ChatID      string              `json:"chat_id"`
+		Text        string              `json:"text"`
+		ParseMode   string              `json:"parse_mode,omitempty"`
+		LinkPreview telegramLinkPreview `json:"link_preview_options"`
+	}{ChatID: t.Channel, Text: msg, ParseMode: t.ParseMode, LinkPreview: telegramLinkPreview{IsDisabled: t.DisablePreview}}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", nil, "", errors.Wrap(err, "can't marshal telegram request")
+	}
+	return "sendMessage", bytes.NewReader(data), "application/json", nil
+}
+
+// escapeHTML escapes characters telegram treats as html markup
+func escapeHTML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// escapeMarkdownV2 escapes all characters reserved by telegram's MarkdownV2
+func escapeMarkdownV2(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\_*[]()~`>#+-=|{}.!", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// utf16Len counts utf-16 code units, telegram limits message length this way
+func utf16Len(s string) int {
+	res := 0
+	for _, r := range s {
+		res++
+		if r >= 0x10000 { // surrogate pair
+			res++
+		}
+	}
+	return res
+}
@@ -0,0 +1,153 @@
+package publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestTelegramPublish(t *testing.T) {
+	var req map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/bot123:secret/sendMessage", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer ts.Close()
+
+	tg := Telegram{Token: "123:secret", Channel: "@channel", ParseMode: TelegramHTML, DisablePreview: true, Server: ts.URL}
+	err := tg.Publish(rss.Event{Title: "a < b & c", Link: "https://example.com/?a=1&b=2"}, func(e rss.Event, l Limits) string {
+		assert.Equal(t, 4096, l.MaxLen)
+		assert.Equal(t, 2, l.Len("👍"))
+		return "<b>" + l.Escape(e.Title) + "</b> " + l.Escape(e.Link)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "@channel", req["chat_id"])
+	assert.Equal(t, "HTML", req["parse_mode"])
+	assert.Equal(t, "<b>a &lt; b &amp; c</b> https://example.com/?a=1&amp;b=2", req["text"])
+	assert.Equal(t, map[string]interface{}{"is_disabled": true}, req["link_preview_options"])
+}
+
+func TestTelegramPublishFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+	}))
+	defer ts.Close()
+
+	tg := Telegram{Token: "123:secret", Channel: "@channel", Server: ts.URL}
+	err := tg.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string {
+		assert.Nil(t, l.Escape)
+		return e.Title
+	})
+	require.Error(t, err)
+	assert.EqualError(t, err, "can't send to telegram, error 400, Bad Request: chat not found")
+	assert.True(t, IsPermanent(err))
+
+	tg = Telegram{Token: "123:secret", Channel: "@channel", Server: "http://127.0.0.1:1"}
+	err = tg.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+	assert.False(t, IsPermanent(err), "network error is transient")
+}
+
+func TestTelegramPublishImageRejected(t *testing.T) {
+	methods := []string{}
+	photoErr := "PHOTO_INVALID_DIMENSIONS"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/img.png" {
+			_, _ = w.Write(testPNG)
+			return
+		}
+		methods = append(methods, strings.TrimPrefix(r.URL.Path, "/bot123:secret/"))
+		if strings.HasSuffix(r.URL.Path, "/sendPhoto") {
+			_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: ` + photoErr + `"}`))
+			return
+		}
+		req := struct {
+			Text string `json:"text"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "title 4096", req.Text, "formatted with message limits")
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":42}}`))
+	}))
+	defer ts.Close()
+
+	st := &store.Memory{}
+	tg := Telegram{Token: "123:secret", Channel: "@channel", Server: ts.URL, PostStore: st}
+	ev := rss.Event{Feed: "f", ID: "id1", Title: "title", Images: []rss.Image{{URL: ts.URL + "/img.png"}}}
+	err := tg.Publish(ev, func(e rss.Event, l Limits) string { return fmt.Sprintf("%s %d", e.Title, l.MaxLen) })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sendPhoto", "sendMessage"}, methods)
+	p, ok := loadPost(st, tg.dest(), ev)
+	require.True(t, ok)
+	assert.Equal(t, post{ID: "42", TS: p.TS}, p, "saved as message, not caption")
+
+	// rejected not because of the photo, not sent again
+	methods, photoErr = nil, "chat not found"
+	err = tg.Publish(ev, func(e rss.Event, l Limits) string { return fmt.Sprintf("%s %d", e.Title, l.MaxLen) })
+	require.Error(t, err)
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, []string{"sendPhoto"}, methods)
+}
+
+func TestPhotoRejected(t *testing.T) {
+	tbl := []struct {
+		err error
+		res bool
+	}{
+		{Permanent(errors.New("can't send to telegram, error 400, Bad Request: PHOTO_INVALID_DIMENSIONS")), true},
+		{Permanent(errors.New("can't send to telegram, error 400, Bad Request: IMAGE_PROCESS_FAILED")), true},
+		{Permanent(errors.New("can't send to telegram, error 400, Bad Request: wrong file identifier/HTTP URL specified")), true},
+		{Permanent(errors.New("can't send to telegram, error 400, Bad Request: failed to get HTTP URL content")), true},
+		{Permanent(errors.New("can't send to telegram, error 400, Bad Request: message caption is too long")), false},
+		{Permanent(errors.New("can't send to telegram, error 403, Forbidden: bot is not a member of the channel chat")), false},
+		{errors.New("can't send to telegram, error 500, Internal Server Error: PHOTO_SAVE_FILE_INVALID"), false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, photoRejected(tt.err), tt.err.Error())
+	}
+}
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	assert.Equal(t, `Hello, no\! \*bold\* \[link\]\(http://example\.com/a\_b\) 1\+1\=2 \\`,
+		escapeMarkdownV2(`Hello, no! *bold* [link](http://example.com/a_b) 1+1=2 \`))
+	assert.Equal(t, "привет", escapeMarkdownV2("привет"))
+}
+
+func TestTelegramPublishWithImage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/img.png" {
+			_, _ = w.Write(testPNG)
+			return
+		}
+		assert.Equal(t, "/bot123:secret/sendPhoto", r.URL.Path)
+		require.NoError(t, r.ParseMultipartForm(1024))
+		assert.Equal(t, "@channel", r.FormValue("chat_id"))
+		assert.Equal(t, "<b>title</b>", r.FormValue("caption"))
+		assert.Equal(t, "HTML", r.FormValue("parse_mode"))
+		_, h, err := r.FormFile("photo")
+		require.NoError(t, err)
+		assert.Equal(t, "image.png", h.Filename)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+
+	tg := Telegram{Token: "123:secret", Channel: "@channel", ParseMode: TelegramHTML, Server: ts.URL}
+	ev := rss.Event{Title: "title", Images: []rss.Image{{URL: ts.URL + "/img.png"}}}
+	err := tg.Publish(ev, func(e rss.Event, l Limits) string {
+		assert.Equal(t, telegramMaxCaptionLen, l.MaxLen)
+		return "<b>" + e.Title + "</b>"
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,126 @@
+package publisher
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	twitterDefaultLimitReset = 15 * time.Minute // used for 429 response without reset header, twitter's rate limit window
+	twitterMaxImageSize      = 5 * 1024 * 1024
+)
+
+// Twitter implements publisher.Interface and sends to twitter.
+// Publishing fails with RateLimitError right away while rate limit exhausted, the event retried after reset.
+// Event image uploaded without alt text, not supported by the client library.
+type Twitter struct {
+	ConsumerKey, ConsumerSecret string
+	AccessToken, AccessSecret   string
+	NoImages                    bool         // don't attach images
+	BaseURL                     string       // api url, https://api.twitter.com/1.1 if not set
+	Client                      *http.Client // optional, default client with 30s timeout used if not set
+
+	once  sync.Once
+	mu    sync.Mutex // serializes posting
+	api   *anaconda.TwitterApi
+	limit rateLimit
+}
+
+// Publish to twitter
+func (t *Twitter) Publish(event rss.Event, formatter Formatter) error {
+	return t.PublishThread(event, single(formatter))
+}
+
+// Limits returns limits of tweet
+func (t *Twitter) Limits() Limits {
+	return TwitterLimits
+}
+
+// PublishThread tweets the first message with image, the rest tweeted as replies
+func (t *Twitter) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	log.Printf("[INFO] publish to twitter %+v", event.Title)
+	t.once.Do(t.init)
+
+	msgs := formatter(event, TwitterLimits)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.limit.check(); err != nil { // don't load and upload image if tweet can't be posted anyway
+		return errors.Wrap(err, "can't send to twitter")
+	}
+	v := url.Values{}
+	v.Set("tweet_mode", "extended")
+	if img := t.image(event); img != nil {
+		media, err := t.api.UploadMedia(base64.StdEncoding.EncodeToString(img.Data))
+		if err != nil {
+			log.Printf("[WARN] can't upload image to twitter, post without image, %v", err)
+		} else {
+			v.Set("media_ids", media.MediaIDString)
+		}
+	}
+	for i, msg := range msgs {
+		id, err := t.post(msg, v)
+		if err != nil {
+			return threadError(err, i, len(msgs))
+		}
+		log.Printf("[DEBUG] published to twitter %s", strings.Replace(msg, "\n", " ", -1))
+		v.Del("media_ids")
+		v.Set("in_reply_to_status_id", id)
+	}
+	return nil
+}
+
+// post makes a single tweet, fails with RateLimitError if rate limit exhausted. Returns id of the tweet.
+func (t *Twitter) post(msg string, v url.Values) (string, error) {
+	if err := t.limit.check(); err != nil {
+		return "", errors.Wrap(err, "can't send to twitter")
+	}
+	tweet, err := t.api.PostTweet(msg, v)
+	if err == nil {
+		return tweet.IdStr, nil
+	}
+	aerr, ok := err.(*anaconda.ApiError)
+	if !ok {
+		return "", errors.Wrap(err, "can't send to twitter")
+	}
+	if aerr.StatusCode == http.StatusTooManyRequests {
+		if t.limit.wait() == 0 { // no reset header
+			t.limit.exhaust(time.Now().Add(twitterDefaultLimitReset))
+		}
+		log.Printf("[WARN] twitter rate limit exceeded, %v", err)
+		return "", errors.Wrap(t.limit.check(), "can't send to twitter")
+	}
+	if permanentStatus(aerr.StatusCode) {
+		return "", Permanent(errors.Wrap(err, "can't send to twitter")) // duplicate status, auth errors, etc.
+	}
+	return "", errors.Wrap(err, "can't send to twitter")
+}
+
+func (t *Twitter) image(event rss.Event) *imageData {
+	if t.NoImages {
+		return nil
+	}
+	return loadImage(t.Client, event, twitterMaxImageSize)
+}
+
+func (t *Twitter) init() {
+	if t.Client == nil {
+		t.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	t.api = anaconda.NewTwitterApiWithCredentials(t.AccessToken, t.AccessSecret, t.ConsumerKey, t.ConsumerSecret)
+	t.api.HttpClient = rateLimitClient(t.Client, &t.limit)
+	t.api.ReturnRateLimitError(true) // handled here, anaconda retries out of order
+	if t.BaseURL != "" {
+		t.api.SetBaseUrl(strings.TrimSuffix(t.BaseURL, "/"))
+	}
+}
@@ -0,0 +1,144 @@
+package publisher
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	twitterDefaultAuthorizeURL = "https://twitter.com/i/oauth2/authorize"
+	twitterAuthScopes          = "tweet.read tweet.write users.read offline.access media.write"
+)
+
+// TwitterAuth gets the initial OAuth 2.0 refresh token for TwitterV2 with authorization code flow with PKCE.
+// User opens authorization url and approves access, twitter redirects to RedirectURL, served locally,
+// and the code from redirect exchanged for the token.
+type TwitterAuth struct {
+	ClientID, ClientSecret string // client secret for confidential clients only
+	RedirectURL            string // callback url registered for the app, i.e. http://127.0.0.1:8085/callback
+	AuthorizeURL           string // authorization page, https://twitter.com/i/oauth2/authorize if not set
+	Server                 string // api url, https://api.twitter.com if not set
+	Client                 *http.Client
+}
+
+// Run writes authorization url to out, serves RedirectURL till user approves access and returns refresh token
+func (a *TwitterAuth) Run(ctx context.Context, out io.Writer) (string, error) {
+	if a.AuthorizeURL == "" {
+		a.AuthorizeURL = twitterDefaultAuthorizeURL
+	}
+	if a.Server == "" {
+		a.Server = twitterV2DefaultServer
+	}
+	if a.Client == nil {
+		a.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	redirect, err := url.Parse(a.RedirectURL)
+	if err != nil || redirect.Host == "" {
+		return "", errors.Errorf("bad redirect url %q", a.RedirectURL)
+	}
+	verifier, state := randomToken(32), randomToken(16)
+	if verifier == "" || state == "" {
+		return "", errors.New("can't make pkce verifier")
+	}
+
+	ln, err := net.Listen("tcp", redirect.Host)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't listen on %s", redirect.Host)
+	}
+	codes, errs := make(chan string, 1), make(chan error, 1)
+	srv := &http.Server{ReadHeaderTimeout: 10 * time.Second, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case r.URL.Path != redirect.Path:
+			http.NotFound(w, r)
+		case q.Get("state") != state:
+			http.Error(w, "unexpected state", http.StatusBadRequest)
+		case q.Get("error") != "":
+			http.Error(w, "access not approved", http.StatusBadRequest)
+			select {
+			case errs <- errors.Errorf("access not approved, %s", q.Get("error")):
+			default:
+			}
+		default:
+			fmt.Fprintln(w, "access approved, the page can be closed") // nolint
+			select {
+			case codes <- q.Get("code"):
+			default:
+			}
+		}
+	})}
+	go srv.Serve(ln)  // nolint
+	defer srv.Close() // nolint
+
+	fmt.Fprintf(out, "open the url in browser and approve access:\n%s\n", a.authorizeURL(verifier, state)) // nolint
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err = <-errs:
+		return "", err
+	case code := <-codes:
+		return a.exchange(code, verifier)
+	}
+}
+
+// authorizeURL makes url of authorization page with s256 code challenge made from verifier
+func (a *TwitterAuth) authorizeURL(verifier, state string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{"response_type": {"code"}, "client_id": {a.ClientID}, "redirect_uri": {a.RedirectURL},
+		"scope": {twitterAuthScopes}, "state": {state}, "code_challenge_method": {"S256"},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(challenge[:])}}
+	return a.AuthorizeURL + "?" + q.Encode()
+}
+
+// exchange gets tokens for authorization code, returns refresh token
+func (a *TwitterAuth) exchange(code, verifier string) (string, error) {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {a.RedirectURL},
+		"code_verifier": {verifier}, "client_id": {a.ClientID}}
+	req, err := http.NewRequest("POST", a.Server+"/2/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "can't make token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.ClientSecret != "" {
+		req.SetBasicAuth(a.ClientID, a.ClientSecret)
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "can't get token")
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("can't get token, %s", responseError(resp))
+	}
+	res := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.Wrap(err, "can't decode token response")
+	}
+	if res.RefreshToken == "" {
+		return "", errors.New("no refresh token in response, offline.access scope not granted")
+	}
+	return res.RefreshToken, nil
+}
+
+// randomToken makes random url-safe string of n bytes, empty on error
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
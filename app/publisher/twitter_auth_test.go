@@ -0,0 +1,120 @@
+package publisher
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwitterAuthRun(t *testing.T) {
+	var challenge string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2/oauth2/token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "authorization_code", r.Form.Get("grant_type"))
+		assert.Equal(t, "code1", r.Form.Get("code"))
+		assert.Equal(t, "client1", r.Form.Get("client_id"))
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		assert.Equal(t, challenge, base64.RawURLEncoding.EncodeToString(sum[:]), "verifier matches challenge")
+		_, _, ok := r.BasicAuth()
+		assert.False(t, ok, "no basic auth for public client")
+		_, _ = w.Write([]byte(`{"token_type":"bearer","access_token":"access-1","refresh_token":"refresh-1","expires_in":7200}`))
+	}))
+	defer ts.Close()
+
+	redirect := "http://" + freeAddr(t) + "/callback"
+	auth := TwitterAuth{ClientID: "client1", RedirectURL: redirect, AuthorizeURL: "https://example.com/authorize", Server: ts.URL}
+	out := authBrowser(t, func(authURL *url.URL) string {
+		q := authURL.Query()
+		assert.Equal(t, "code", q.Get("response_type"))
+		assert.Equal(t, "client1", q.Get("client_id"))
+		assert.Equal(t, redirect, q.Get("redirect_uri"))
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.Contains(t, q.Get("scope"), "offline.access")
+		challenge = q.Get("code_challenge")
+		return redirect + "?code=code1&state=" + q.Get("state")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token, err := auth.Run(ctx, out)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-1", token)
+}
+
+func TestTwitterAuthRunDenied(t *testing.T) {
+	redirect := "http://" + freeAddr(t) + "/callback"
+	auth := TwitterAuth{ClientID: "client1", RedirectURL: redirect, Server: "http://127.0.0.1:1"}
+	out := authBrowser(t, func(authURL *url.URL) string {
+		assert.True(t, strings.HasPrefix(authURL.String(), twitterDefaultAuthorizeURL+"?"))
+		return redirect + "?error=access_denied&state=" + authURL.Query().Get("state")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := auth.Run(ctx, out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "access_denied")
+}
+
+func TestTwitterAuthRunNoRefreshToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client1", user)
+		assert.Equal(t, "csecret", pass)
+		_, _ = w.Write([]byte(`{"token_type":"bearer","access_token":"access-1","expires_in":7200}`))
+	}))
+	defer ts.Close()
+
+	redirect := "http://" + freeAddr(t) + "/callback"
+	auth := TwitterAuth{ClientID: "client1", ClientSecret: "csecret", RedirectURL: redirect, Server: ts.URL}
+	out := authBrowser(t, func(authURL *url.URL) string {
+		return redirect + "?code=code1&state=" + authURL.Query().Get("state")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := auth.Run(ctx, out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "offline.access")
+}
+
+// authBrowser returns writer for Run output, acts as a user approving the printed url and redirected back
+func authBrowser(t *testing.T, approve func(authURL *url.URL) string) io.Writer {
+	r, w := io.Pipe()
+	t.Cleanup(func() { _ = w.Close() })
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			u, err := url.Parse(scanner.Text())
+			if err != nil || u.Scheme == "" {
+				continue
+			}
+			resp, err := http.Get(approve(u)) // nolint
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}
+	}()
+	return w
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() // nolint
+	return ln.Addr().String()
+}
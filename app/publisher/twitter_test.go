@@ -0,0 +1,204 @@
+package publisher
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestTwitterPublish(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/statuses/update.json", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "title - link", r.Form.Get("status"))
+		assert.Contains(t, r.Header.Get("Authorization"), `oauth_consumer_key="ck"`)
+		w.Header().Set("x-rate-limit-remaining", "10")
+		w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		_, _ = w.Write([]byte(`{"id_str":"123"}`))
+	}))
+	defer ts.Close()
+
+	tw := Twitter{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", BaseURL: ts.URL}
+	err := tw.Publish(rss.Event{Title: "title", Link: "link"}, func(e rss.Event, l Limits) string {
+		assert.Equal(t, 279, l.MaxLen)
+		assert.Equal(t, 23, l.LinkLen)
+		return e.Title + " - " + e.Link
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), tw.limit.wait())
+}
+
+func TestTwitterPublishRateLimitExhausted(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 { // the last allowed request
+			w.Header().Set("x-rate-limit-remaining", "0")
+			w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Unix()+2, 10))
+		}
+		_, _ = w.Write([]byte(`{"id_str":"123"}`))
+	}))
+	defer ts.Close()
+
+	tw := Twitter{BaseURL: ts.URL}
+	require.NoError(t, tw.Publish(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.True(t, tw.limit.wait() > 0)
+
+	st := time.Now()
+	err := tw.Publish(rss.Event{Title: "t2"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.True(t, time.Since(st) < time.Second, "failed without waiting for reset, %v", time.Since(st))
+	_, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	tw.limit.reset = time.Time{}
+	require.NoError(t, tw.Publish(rss.Event{Title: "t2"}, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestTwitterPublishTooManyRequests(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("x-rate-limit-remaining", "0")
+			w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Unix()+2, 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errors":[{"code":88,"message":"Rate limit exceeded"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id_str":"123"}`))
+	}))
+	defer ts.Close()
+
+	tw := Twitter{BaseURL: ts.URL}
+	err := tw.Publish(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	reset, ok := RetryAfter(err)
+	assert.True(t, ok, "retried by caller after reset")
+	assert.True(t, reset.After(time.Now()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTwitterPublishFailed(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("x-rate-limit-remaining", "0")
+			w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+			_, _ = w.Write([]byte(`{"id_str":"123"}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":[{"code":187,"message":"Status is a duplicate."}]}`))
+	}))
+	defer ts.Close()
+
+	tw := Twitter{BaseURL: ts.URL}
+	require.NoError(t, tw.Publish(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) string { return e.Title }))
+
+	// limit exhausted, failed without waiting
+	err := tw.Publish(rss.Event{Title: "t2"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rate limit exceeded till")
+	assert.False(t, IsPermanent(err))
+	reset, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.True(t, reset.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	tw.limit.reset = time.Time{}
+	err = tw.Publish(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Status is a duplicate")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestTwitterPublishWithImage(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/img.png":
+			_, _ = w.Write(testPNG)
+		case "/1.1/media/upload.json":
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, base64.StdEncoding.EncodeToString(testPNG), r.Form.Get("media_data"))
+			_, _ = w.Write([]byte(`{"media_id":123,"media_id_string":"123"}`))
+		case "/statuses/update.json":
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "123", r.Form.Get("media_ids"))
+			_, _ = w.Write([]byte(`{"id_str":"1"}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	// upload url is fixed in the library, redirect all requests to test server
+	client := &http.Client{Transport: redirectTransport{target: ts.URL}}
+	tw := Twitter{BaseURL: ts.URL, Client: client}
+	ev := rss.Event{Title: "t1", Images: []rss.Image{{URL: ts.URL + "/img.png"}}}
+	require.NoError(t, tw.Publish(ev, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// rate limit exhausted, image not loaded and not uploaded
+	tw.limit.exhaust(time.Now().Add(time.Hour))
+	err := tw.Publish(ev, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	_, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// redirectTransport sends all requests to target host
+type redirectTransport struct {
+	target string
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.target)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRateLimitUpdate(t *testing.T) {
+	r := rateLimit{}
+	reset := time.Now().Add(time.Minute)
+	h := http.Header{}
+	h.Set("x-rate-limit-remaining", "0")
+	h.Set("x-rate-limit-reset", strconv.FormatInt(reset.Unix(), 10))
+	r.update(h)
+	assert.InDelta(t, time.Minute.Seconds(), r.wait().Seconds(), 1.5)
+
+	r.update(http.Header{}) // no headers, nothing changed
+	assert.True(t, r.wait() > 0)
+
+	h.Set("x-rate-limit-remaining", "bad")
+	r.update(h)
+	assert.True(t, r.wait() > 0)
+
+	h.Set("x-rate-limit-remaining", "1")
+	r.update(h)
+	assert.Equal(t, time.Duration(0), r.wait())
+
+	assert.NoError(t, r.check())
+
+	r.exhaust(time.Now().Add(time.Second))
+	assert.True(t, r.wait() > 0)
+	_, ok := RetryAfter(r.check())
+	assert.True(t, ok)
+}
@@ -0,0 +1,163 @@
+package publisher
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+const twitterURLLen = 23 // length of any url after shortening to t.co
+
+// twitterLightRanges are ranges of characters with weight 1 (latin, cyrillic, greek, etc. and some punctuation),
+// any other character has weight 2. Ranges from twitter-text v3 config.
+var twitterLightRanges = [][2]rune{{0x0000, 0x10FF}, {0x2000, 0x200D}, {0x2010, 0x201F}, {0x2032, 0x2037}}
+
+// twitterURLCandidate matches urls with scheme and bare domains, groups are scheme, host, tld and path
+var twitterURLCandidate = regexp.MustCompile(`(?i)(https?://)?((?:[\p{L}\p{N}](?:[\p{L}\p{N}-]*[\p{L}\p{N}])?\.)+` +
+	`(\p{L}{2,}))(?::\d{1,5})?([/?#][^\s]*)?`)
+
+// twitterSpecialCCTLDs are country code tlds making url from a short bare domain without path, like t.co
+var twitterSpecialCCTLDs = map[string]bool{"co": true, "tv": true}
+
+// twitterLen returns weighted length of the message as counted by twitter, like twitter-text v3 does.
+// Text normalized to NFC before counting. Characters from twitterLightRanges count 1, others, including CJK,
+// count 2. Emoji sequence, like a flag, emoji with skin tone or family joined by zero-width joiners, counts 2
+// as a whole. Any url counts 23.
+func twitterLen(s string) int {
+	s = norm.NFC.String(s)
+	res, pos := 0, 0
+	for _, loc := range twitterURLs(s) {
+		res += twitterWeightedLen(s[pos:loc[0]]) + twitterURLLen
+		pos = loc[1]
+	}
+	return res + twitterWeightedLen(s[pos:])
+}
+
+// twitterURLs returns byte positions of urls in s, as [start, end) pairs. Url should have a known tld, from
+// the public suffix list. Bare domain, without scheme, should be ascii, and short one with country code tld,
+// like example.de, makes url with path only, as twitter-text does.
+func twitterURLs(s string) (res [][2]int) {
+	for _, m := range twitterURLCandidate.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[0], m[1]
+		if r, _ := utf8.DecodeLastRuneInString(s[:start]); start > 0 && (isWordRune(r) || strings.ContainsRune("@$#＃.-/", r)) {
+			continue // part of the word, email or hashtag
+		}
+		end = start + len(trimURLTail(s[start:end]))
+		host, tld := strings.ToLower(s[m[4]:m[5]]), strings.ToLower(s[m[6]:m[7]])
+		if !knownTLD(tld) {
+			continue // unknown tld, i.e. end of the sentence without space
+		}
+		if m[2] < 0 { // no scheme
+			hasPath := m[8] >= 0 && m[8] < end
+			if !isASCII(host) || (len(tld) == 2 && strings.Count(host, ".") == 1 && !hasPath && !twitterSpecialCCTLDs[tld]) {
+				continue
+			}
+		}
+		res = append(res, [2]int{start, end})
+	}
+	return res
+}
+
+// knownTLD checks if lowercase tld is a top level domain from the public suffix list. Non-ascii tlds not checked
+// and considered unknown, so such urls counted with their full length
+func knownTLD(tld string) bool {
+	if !isASCII(tld) {
+		return false
+	}
+	_, icann := publicsuffix.PublicSuffix(tld)
+	return icann
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// trimURLTail removes punctuation which ends the sentence rather than the url, and unbalanced closing parenthesis
+func trimURLTail(u string) string {
+	for {
+		trimmed := strings.TrimRight(u, `.,;:!?'"`)
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == u {
+			return u
+		}
+		u = trimmed
+	}
+}
+
+// twitterWeightedLen returns weighted length of text without urls
+func twitterWeightedLen(s string) int {
+	res := 0
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if n := emojiLen(runes[i:]); n > 0 {
+			res += 2
+			i += n
+			continue
+		}
+		res += 2
+		for _, rng := range twitterLightRanges {
+			if runes[i] >= rng[0] && runes[i] <= rng[1] {
+				res--
+				break
+			}
+		}
+		i++
+	}
+	return res
+}
+
+// emojiLen returns number of runes of emoji sequence at the beginning of runes, 0 if it doesn't start with emoji.
+// Sequence includes variation selector, keycap, skin tone modifiers, tags and emoji joined with zero-width joiner.
+func emojiLen(runes []rune) int {
+	n := 0
+	switch r := runes[0]; {
+	case r >= 0x1F1E6 && r <= 0x1F1FF: // regional indicators, pair makes a flag
+		if len(runes) > 1 && runes[1] >= 0x1F1E6 && runes[1] <= 0x1F1FF {
+			return 2
+		}
+		return 1
+	case isPictographic(r):
+		n = 1
+	case strings.ContainsRune("#*0123456789©®", r) && len(runes) > 1 && (runes[1] == 0xFE0F || runes[1] == 0x20E3):
+		n = 1
+	default:
+		return 0
+	}
+	for n < len(runes) {
+		switch r := runes[n]; {
+		case r == 0xFE0F, r == 0x20E3, r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F:
+			n++
+		case r == 0x200D && n+1 < len(runes) && isPictographic(runes[n+1]):
+			n += 2
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// isPictographic checks if r is emoji base character, approximation of Extended_Pictographic unicode property
+func isPictographic(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, r >= 0x2600 && r <= 0x27BF, r >= 0x2300 && r <= 0x23FF,
+		r >= 0x2190 && r <= 0x21FF, r >= 0x25A0 && r <= 0x25FF, r >= 0x2B00 && r <= 0x2BFF, r >= 0x2934 && r <= 0x2935:
+		return true
+	}
+	return strings.ContainsRune("‼⁉™ℹⓂ〰〽㊗㊙", r)
+}
+
+// isWordRune checks if r is a letter, digit or underscore
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,90 @@
+package publisher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwitterLen(t *testing.T) {
+	tbl := []struct {
+		name string
+		inp  string
+		res  int
+	}{
+		{"empty", "", 0},
+		{"latin", "hello", 5},
+		{"cyrillic", "Привет мир", 10},
+		{"hiragana", "こんにちは", 10},
+		{"kanji", "日本語のテキスト", 16},
+		{"hangul", "한국어", 6},
+		{"punctuation in light ranges", "“quotes” — dash", 15},
+		{"ellipsis out of light ranges", "wait…", 6},
+		{"emoji", "😀", 2},
+		{"emoji with skin tone", "👍🏽", 2},
+		{"family joined by zwj", "👨‍👩‍👧‍👦", 2},
+		{"flags", "🇺🇸🇯🇵", 4},
+		{"emoji with variation selector", "❤️", 2},
+		{"keycap", "1️⃣", 2},
+		{"copyright as text", "©", 1},
+		{"copyright as emoji", "©️", 2},
+		{"decomposed, nfc", "e\u0301", 1},
+		{"url", "https://example.com/some/very/long/path/to/page?query=1", 23},
+		{"short url", "http://t.co", 23},
+		{"url with trailing dot", "see https://example.com.", 28},
+		{"url in parentheses", "(https://example.com/wiki/Go_(language))", 25},
+		{"bare domains", "example.com and example.org", 51},
+		{"unknown tld", "end.Start", 9},
+		{"unknown tld with scheme", "https://example.notatld/path", 28},
+		{"no tld", "http://localhost/x", 18},
+		{"cctld short domain", "example.de", 10},
+		{"cctld short domain with path", "example.de/path", 23},
+		{"cctld domain", "www.example.de", 23},
+		{"special cctld", "t.co", 23},
+		{"new gtld with path", "foo.shop/x", 23},
+		{"non-ascii bare domain", "пример.рф", 9},
+		{"email", "mail me@example.com", 19},
+		{"mixed", "日本語 https://example.com 😀", 33},
+		{"cjk fits limit", strings.Repeat("あ", 140), 280},
+		{"cjk over limit", strings.Repeat("あ", 141), 282},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, twitterLen(tt.inp))
+		})
+	}
+}
+
+// cases of weighted length tests of twitter-text conformance suite, conformance/validate.yml of
+// https://github.com/twitter/twitter-text, WeightedTweetsWithDiscountedEmojiCounterTest (v3 config, used by twitter)
+func TestTwitterLenConformance(t *testing.T) {
+	tbl := []struct {
+		description string
+		text        string
+		weighted    int
+	}{
+		{"Regular Tweet with url", "Hi http://test.co", 26},
+		{"Just an url", "http://test.co", 23},
+		{"Long tweet with url", strings.Repeat("a", 256) + " http://test.co", 280},
+		{"Long tweet with url, over the limit", strings.Repeat("a", 257) + " http://test.co", 281},
+		{"Tweet of 280 single byte characters", strings.Repeat("a", 280), 280},
+		{"Tweet of 281 single byte characters", strings.Repeat("a", 281), 281},
+		{"Tweet of 140 CJK characters", strings.Repeat("の", 140), 280},
+		{"Tweet of 141 CJK characters", strings.Repeat("の", 141), 282},
+		{"Count a mix of single byte single word, and double word unicode characters", "H🐱☺👨‍👩‍👧‍👦", 7},
+		{"Count unicode emoji chars inside the basic multilingual plane", "😷👾😡🔥💩", 10},
+		{"Count unicode emoji chars outside the basic multilingual plane with skin tone modifiers", "🙋🏽👨‍🎤", 4},
+		{"Count unicode emoji keycap sequence", "#️⃣", 2},
+		{"Count a mix of latin and emoji", "Hello 😀 world", 14},
+		{"Count url without protocol", "Hi example.com", 26},
+		{"Count multiple urls", "Hi http://test.co and https://example.com/path", 54},
+		{"Count characters in light weight ranges", "Latin ©à‐“′‷", 12},
+		{"Count characters out of light weight ranges", "‧‸", 4},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.description, func(t *testing.T) {
+			assert.Equal(t, tt.weighted, twitterLen(tt.text))
+		})
+	}
+}
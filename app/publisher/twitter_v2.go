@@ -0,0 +1,387 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/go-oauth/oauth"
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	twitterV2DefaultServer = "https://api.twitter.com"
+	twitterTokensBucket    = "tokens" // store bucket for oauth2 tokens, keyed by client id
+	twitterMaxAltLen       = 1000
+)
+
+// TokenStore keeps OAuth 2.0 tokens between restarts
+type TokenStore interface {
+	Load(bucket, key string, v interface{}) (bool, error)
+	Save(bucket, key string, v interface{}) error
+}
+
+// TwitterV2 implements publisher.Interface and posts tweets with twitter api v2.
+// Uses OAuth 1.0a user context if ClientID not set, OAuth 2.0 user token otherwise. OAuth 2.0 access token
+// refreshed on expiration, refresh token rotated on each refresh and the new one saved to TokenStore.
+// Event image uploaded with alt text, OAuth 2.0 token needs media.write scope for this.
+type TwitterV2 struct {
+	ConsumerKey, ConsumerSecret string // OAuth 1.0a
+	AccessToken, AccessSecret   string // OAuth 1.0a access token and secret, or optional initial OAuth 2.0 access token
+	ClientID, ClientSecret      string // OAuth 2.0, client secret for confidential clients only
+	RefreshToken                string // initial OAuth 2.0 refresh token, the saved one used if not changed since
+	TokenStore                  TokenStore
+
+	NoImages bool         // don't attach images
+	Server   string       // api url, https://api.twitter.com if not set
+	Client   *http.Client // optional, default client with 30s timeout used if not set
+
+	once   sync.Once
+	mu     sync.Mutex // serializes posting and token refresh
+	limit  rateLimit
+	oauth1 *oauth.Client
+	token  twitterToken
+}
+
+// twitterToken is OAuth 2.0 user token
+type twitterToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+	Initial      string    `json:"initial"` // refresh token from config, saved token discarded if changed
+}
+
+// twitterV2Error is error response of api v2
+type twitterV2Error struct {
+	Status int
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e *twitterV2Error) Error() string {
+	return fmt.Sprintf("status %d, %s: %s", e.Status, e.Title, e.Detail)
+}
+
+// Publish tweet with api v2
+func (t *TwitterV2) Publish(event rss.Event, formatter Formatter) error {
+	return t.PublishThread(event, single(formatter))
+}
+
+// Limits returns limits of tweet
+func (t *TwitterV2) Limits() Limits {
+	return TwitterLimits
+}
+
+// PublishThread tweets the first message with image, the rest tweeted as replies
+func (t *TwitterV2) PublishThread(event rss.Event, formatter ThreadFormatter) error {
+	log.Printf("[INFO] publish to twitter v2 %+v", event.Title)
+	t.once.Do(t.init)
+
+	msgs := formatter(event, TwitterLimits)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.limit.check(); err != nil { // don't load and upload image if tweet can't be posted anyway
+		return errors.Wrap(err, "can't send to twitter")
+	}
+	mediaID := ""
+	if img := t.image(event); img != nil {
+		var err error
+		if mediaID, err = t.uploadMedia(img); err != nil {
+			log.Printf("[WARN] can't upload image to twitter, post without image, %v", err)
+		}
+	}
+
+	replyTo := ""
+	for i, msg := range msgs {
+		id, err := t.tweet(msg, mediaID, replyTo)
+		if err != nil {
+			return threadError(err, i, len(msgs))
+		}
+		log.Printf("[DEBUG] published to twitter v2 %s", strings.Replace(msg, "\n", " ", -1))
+		replyTo, mediaID = id, ""
+	}
+	return nil
+}
+
+// tweet posts a single tweet, refreshes token and tries again if needed. Fails with RateLimitError
+// if rate limit exhausted. Returns id of the tweet.
+func (t *TwitterV2) tweet(msg, mediaID, replyTo string) (string, error) {
+	var err error
+	for i := 0; i < 2; i++ { // retry once after token refresh
+		if err = t.limit.check(); err != nil {
+			break
+		}
+		var id string
+		if id, err = t.post(msg, mediaID, replyTo); err == nil {
+			return id, nil
+		}
+		e, ok := errors.Cause(err).(*twitterV2Error)
+		if !ok {
+			break
+		}
+		if e.Status == http.StatusTooManyRequests {
+			if t.limit.wait() == 0 { // no reset header
+				t.limit.exhaust(time.Now().Add(twitterDefaultLimitReset))
+			}
+			log.Printf("[WARN] twitter rate limit exceeded, %v", err)
+			err = t.limit.check()
+			break
+		}
+		if e.Status == http.StatusUnauthorized && t.oauth1 == nil && i == 0 {
+			log.Printf("[DEBUG] twitter access token rejected, refresh")
+			t.token.AccessToken = ""
+			continue
+		}
+		if permanentStatus(e.Status) {
+			return "", Permanent(errors.Wrap(err, "can't send to twitter")) // duplicate content, auth errors, etc.
+		}
+		break
+	}
+	return "", errors.Wrap(err, "can't send to twitter")
+}
+
+func (t *TwitterV2) init() {
+	if t.Client == nil {
+		t.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	t.Client = rateLimitClient(t.Client, &t.limit)
+	if t.Server == "" {
+		t.Server = twitterV2DefaultServer
+	}
+	t.Server = strings.TrimSuffix(t.Server, "/")
+	if t.ClientID == "" {
+		t.oauth1 = &oauth.Client{Credentials: oauth.Credentials{Token: t.ConsumerKey, Secret: t.ConsumerSecret}}
+		return
+	}
+
+	t.token = twitterToken{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken, Initial: t.RefreshToken}
+	if t.TokenStore == nil {
+		return
+	}
+	saved := twitterToken{}
+	found, err := t.TokenStore.Load(twitterTokensBucket, t.ClientID, &saved)
+	if err != nil {
+		log.Printf("[WARN] can't load twitter token, %v", err)
+		return
+	}
+	if found && saved.Initial == t.RefreshToken {
+		t.token = saved
+	}
+}
+
+// post makes a single tweet request, with media attached if mediaID defined and as reply if replyTo defined.
+// Returns id of the tweet.
+func (t *TwitterV2) post(msg, mediaID, replyTo string) (string, error) {
+	tweet := struct {
+		Text  string `json:"text"`
+		Media *struct {
+			MediaIDs []string `json:"media_ids"`
+		} `json:"media,omitempty"`
+		Reply *struct {
+			InReplyTo string `json:"in_reply_to_tweet_id"`
+		} `json:"reply,omitempty"`
+	}{Text: msg}
+	if mediaID != "" {
+		tweet.Media = &struct {
+			MediaIDs []string `json:"media_ids"`
+		}{MediaIDs: []string{mediaID}}
+	}
+	if replyTo != "" {
+		tweet.Reply = &struct {
+			InReplyTo string `json:"in_reply_to_tweet_id"`
+		}{InReplyTo: replyTo}
+	}
+	body, err := json.Marshal(tweet)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal tweet")
+	}
+	resp := struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	if err = t.call("/2/tweets", "application/json", bytes.NewReader(body), &resp); err != nil {
+		return "", err
+	}
+	return resp.Data.ID, nil
+}
+
+func (t *TwitterV2) image(event rss.Event) *imageData {
+	if t.NoImages {
+		return nil
+	}
+	return loadImage(t.Client, event, twitterMaxImageSize)
+}
+
+// uploadMedia uploads image and sets its alt text, returns media id
+func (t *TwitterV2) uploadMedia(img *imageData) (string, error) {
+	body, contentType, err := multipartBody(map[string]string{"media_category": "tweet_image"}, "media", img)
+	if err != nil {
+		return "", err
+	}
+	resp := struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	if err = t.call("/2/media/upload", contentType, body, &resp); err != nil {
+		return "", errors.Wrap(err, "can't upload media")
+	}
+	if img.Alt == "" {
+		return resp.Data.ID, nil
+	}
+
+	meta := struct {
+		ID       string `json:"id"`
+		Metadata struct {
+			AltText struct {
+				Text string `json:"text"`
+			} `json:"alt_text"`
+		} `json:"metadata"`
+	}{ID: resp.Data.ID}
+	meta.Metadata.AltText.Text = trimRunes(img.Alt, twitterMaxAltLen)
+	metaBody, err := json.Marshal(meta)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal media metadata")
+	}
+	if err = t.call("/2/media/metadata", "application/json", bytes.NewReader(metaBody), nil); err != nil {
+		log.Printf("[WARN] can't set alt text of twitter media, %v", err) // image is still usable
+	}
+	return resp.Data.ID, nil
+}
+
+// call makes authorized api request, decodes json response to resp if not nil
+func (t *TwitterV2) call(path, contentType string, body io.Reader, resp interface{}) error {
+	req, err := http.NewRequest("POST", t.Server+path, body)
+	if err != nil {
+		return errors.Wrapf(err, "can't make %s request", path)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err = t.authorize(req); err != nil {
+		return err
+	}
+
+	httpResp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close() // nolint
+	if httpResp.StatusCode != http.StatusCreated && httpResp.StatusCode != http.StatusOK {
+		e := twitterV2Error{Status: httpResp.StatusCode}
+		_ = json.NewDecoder(httpResp.Body).Decode(&e)
+		return &e
+	}
+	if resp == nil {
+		return nil
+	}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil && err != io.EOF { // empty body leaves resp as is
+		return errors.Wrapf(err, "can't decode %s response", path)
+	}
+	return nil
+}
+
+// authorize sets authorization header, OAuth 1.0a signature or OAuth 2.0 bearer token
+func (t *TwitterV2) authorize(req *http.Request) error {
+	if t.oauth1 != nil {
+		creds := oauth.Credentials{Token: t.AccessToken, Secret: t.AccessSecret}
+		return errors.Wrap(t.oauth1.SetAuthorizationHeader(req.Header, &creds, req.Method, req.URL, nil), "can't sign request")
+	}
+	if t.token.AccessToken == "" || (!t.token.Expiry.IsZero() && time.Now().After(t.token.Expiry.Add(-time.Minute))) {
+		if err := t.refresh(); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token.AccessToken)
+	return nil
+}
+
+// twitterRefreshMu serializes token refresh of all publishers, so publishers with the same client
+// don't use the same single-use refresh token
+var twitterRefreshMu sync.Mutex
+
+// refresh gets new access token with refresh token. Refresh token is single-use,
+// the new one saved to the store right away, otherwise it is lost on restart.
+// Token rotated by another publisher of the same client loaded from the store and used instead, if still valid.
+func (t *TwitterV2) refresh() error {
+	twitterRefreshMu.Lock()
+	defer twitterRefreshMu.Unlock()
+	if t.reload() {
+		return nil
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {t.token.RefreshToken}, "client_id": {t.ClientID}}
+	req, err := http.NewRequest("POST", t.Server+"/2/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "can't make token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if t.ClientSecret != "" {
+		req.SetBasicAuth(t.ClientID, t.ClientSecret)
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "can't refresh token")
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("can't refresh token, %s", responseError(resp))
+		if permanentStatus(resp.StatusCode) { // revoked or already used refresh token, needs new authorization
+			return Permanent(err)
+		}
+		return err
+	}
+
+	res := struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return errors.Wrap(err, "can't decode token response")
+	}
+	t.token.AccessToken = res.AccessToken
+	if res.RefreshToken != "" {
+		t.token.RefreshToken = res.RefreshToken
+	}
+	t.token.Expiry = time.Time{}
+	if res.ExpiresIn > 0 {
+		t.token.Expiry = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	log.Printf("[INFO] twitter token refreshed, expires %s", t.token.Expiry.Format(time.RFC3339))
+	if t.TokenStore != nil {
+		if err = t.TokenStore.Save(twitterTokensBucket, t.ClientID, t.token); err != nil {
+			log.Printf("[WARN] can't save twitter token, %v", err)
+		}
+	}
+	return nil
+}
+
+// reload loads token saved to the store if it was rotated since the current one was loaded.
+// Returns true if the loaded access token is valid and no refresh needed.
+func (t *TwitterV2) reload() bool {
+	if t.TokenStore == nil {
+		return false
+	}
+	saved := twitterToken{}
+	found, err := t.TokenStore.Load(twitterTokensBucket, t.ClientID, &saved)
+	if err != nil {
+		log.Printf("[WARN] can't load twitter token, %v", err)
+		return false
+	}
+	if !found || saved.Initial != t.token.Initial || saved.RefreshToken == t.token.RefreshToken {
+		return false
+	}
+	log.Printf("[DEBUG] twitter token rotated by another publisher, use the saved one")
+	t.token = saved
+	return saved.AccessToken != "" && (saved.Expiry.IsZero() || time.Now().Before(saved.Expiry.Add(-time.Minute)))
+}
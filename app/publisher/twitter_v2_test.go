@@ -0,0 +1,275 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestTwitterV2PublishOAuth1(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2/tweets", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		auth := r.Header.Get("Authorization")
+		assert.Contains(t, auth, `OAuth `)
+		assert.Contains(t, auth, `oauth_consumer_key="ck"`)
+		assert.Contains(t, auth, `oauth_token="at"`)
+		req := struct{ Text string }{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "title - link", req.Text)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"data":{"id":"123","text":"title - link"}}`))
+	}))
+	defer ts.Close()
+
+	tw := TwitterV2{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", Server: ts.URL}
+	err := tw.Publish(rss.Event{Title: "title", Link: "link"}, func(e rss.Event, l Limits) string {
+		assert.Equal(t, 279, l.MaxLen)
+		assert.Equal(t, 23, l.LinkLen)
+		return e.Title + " - " + e.Link
+	})
+	require.NoError(t, err)
+}
+
+func TestTwitterV2PublishOAuth2(t *testing.T) {
+	var refreshes, tweets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/oauth2/token":
+			n := atomic.AddInt32(&refreshes, 1)
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+			assert.Equal(t, "client1", r.Form.Get("client_id"))
+			user, pass, ok := r.BasicAuth()
+			assert.True(t, ok)
+			assert.Equal(t, "client1", user)
+			assert.Equal(t, "csecret", pass)
+			if n == 1 {
+				assert.Equal(t, "refresh-initial", r.Form.Get("refresh_token"))
+				_, _ = w.Write([]byte(`{"token_type":"bearer","access_token":"access-1","refresh_token":"refresh-1","expires_in":7200}`))
+				return
+			}
+			assert.Equal(t, "refresh-1", r.Form.Get("refresh_token"), "rotated token used")
+			_, _ = w.Write([]byte(`{"token_type":"bearer","access_token":"access-2","refresh_token":"refresh-2","expires_in":7200}`))
+		case "/2/tweets":
+			n := atomic.AddInt32(&tweets, 1)
+			if n == 2 { // access token revoked
+				assert.Equal(t, "Bearer access-1", r.Header.Get("Authorization"))
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"title":"Unauthorized","detail":"Unauthorized","status":401}`))
+				return
+			}
+			if n == 1 {
+				assert.Equal(t, "Bearer access-1", r.Header.Get("Authorization"))
+			} else {
+				assert.Equal(t, "Bearer access-2", r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"data":{"id":"123"}}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	st := &tokenStoreMock{data: map[string][]byte{}}
+	tw := TwitterV2{ClientID: "client1", ClientSecret: "csecret", RefreshToken: "refresh-initial", TokenStore: st, Server: ts.URL}
+	fmtr := func(e rss.Event, l Limits) string { return e.Title }
+	require.NoError(t, tw.Publish(rss.Event{Title: "t1"}, fmtr))
+	require.NoError(t, tw.Publish(rss.Event{Title: "t2"}, fmtr), "refreshed after 401")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&refreshes))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&tweets))
+
+	saved := twitterToken{}
+	found, err := st.Load(twitterTokensBucket, "client1", &saved)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, "access-2", saved.AccessToken)
+	assert.Equal(t, "refresh-2", saved.RefreshToken)
+	assert.Equal(t, "refresh-initial", saved.Initial)
+	assert.True(t, saved.Expiry.After(time.Now().Add(time.Hour)))
+
+	// new publisher, i.e. after restart, uses saved token
+	tw2 := TwitterV2{ClientID: "client1", ClientSecret: "csecret", RefreshToken: "refresh-initial", TokenStore: st, Server: ts.URL}
+	require.NoError(t, tw2.Publish(rss.Event{Title: "t3"}, fmtr))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&refreshes), "no refresh needed")
+
+	// refresh token changed in config, saved token discarded
+	tw3 := TwitterV2{ClientID: "client1", RefreshToken: "refresh-new", TokenStore: st, Server: ts.URL}
+	tw3.once.Do(tw3.init)
+	assert.Equal(t, "refresh-new", tw3.token.RefreshToken)
+	assert.Equal(t, "", tw3.token.AccessToken)
+}
+
+func TestTwitterV2RefreshRotatedByAnother(t *testing.T) {
+	var refreshes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/oauth2/token":
+			atomic.AddInt32(&refreshes, 1)
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "refresh-initial", r.Form.Get("refresh_token"), "single-use token used once")
+			_, _ = w.Write([]byte(`{"token_type":"bearer","access_token":"access-1","refresh_token":"refresh-1","expires_in":7200}`))
+		case "/2/tweets":
+			assert.Equal(t, "Bearer access-1", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"data":{"id":"123"}}`))
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	st := &tokenStoreMock{data: map[string][]byte{}}
+	tw1 := TwitterV2{ClientID: "client1", RefreshToken: "refresh-initial", TokenStore: st, Server: ts.URL}
+	tw2 := TwitterV2{ClientID: "client1", RefreshToken: "refresh-initial", TokenStore: st, Server: ts.URL}
+	tw2.once.Do(tw2.init) // loaded before tw1 rotated the token
+	fmtr := func(e rss.Event, l Limits) string { return e.Title }
+	require.NoError(t, tw1.Publish(rss.Event{Title: "t1"}, fmtr))
+	require.NoError(t, tw2.Publish(rss.Event{Title: "t2"}, fmtr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+	assert.Equal(t, "refresh-1", tw2.token.RefreshToken)
+}
+
+func TestTwitterV2PublishFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2/oauth2/token" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request","error_description":"Value passed for the token was invalid."}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"title":"Forbidden","detail":"You are not allowed to create a Tweet with duplicate content.","status":403}`))
+	}))
+	defer ts.Close()
+
+	fmtr := func(e rss.Event, l Limits) string { return e.Title }
+	tw := TwitterV2{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", Server: ts.URL}
+	err := tw.Publish(rss.Event{Title: "t1"}, fmtr)
+	require.Error(t, err)
+	assert.EqualError(t, err, "can't send to twitter: status 403, Forbidden: You are not allowed to create a Tweet with duplicate content.")
+	assert.True(t, IsPermanent(err))
+
+	tw2 := TwitterV2{ClientID: "client1", RefreshToken: "bad", Server: ts.URL}
+	err = tw2.Publish(rss.Event{Title: "t1"}, fmtr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't refresh token, status 400 Bad Request")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestTwitterV2PublishTooManyRequests(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("x-rate-limit-remaining", "0")
+			w.Header().Set("x-rate-limit-reset", "1") // long ago, wait is zero
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	tw := TwitterV2{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", Server: ts.URL}
+	err := tw.Publish(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err, "reset unknown, not retried till 15m window reset")
+	assert.Contains(t, err.Error(), "rate limit exceeded till")
+	assert.False(t, IsPermanent(err))
+	reset, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.True(t, reset.After(time.Now().Add(14*time.Minute)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTwitterV2PublishWithImage(t *testing.T) {
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		switch r.URL.Path {
+		case "/img.png":
+			_, _ = w.Write(testPNG)
+		case "/2/media/upload":
+			assert.Contains(t, r.Header.Get("Authorization"), `oauth_consumer_key="ck"`)
+			require.NoError(t, r.ParseMultipartForm(1024))
+			assert.Equal(t, "tweet_image", r.FormValue("media_category"))
+			_, h, err := r.FormFile("media")
+			require.NoError(t, err)
+			assert.Equal(t, "image/png", h.Header.Get("Content-Type"))
+			_, _ = w.Write([]byte(`{"data":{"id":"m1"}}`))
+		case "/2/media/metadata":
+			req := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, map[string]interface{}{"id": "m1", "metadata": map[string]interface{}{
+				"alt_text": map[string]interface{}{"text": "image alt"}}}, req)
+		case "/2/tweets":
+			req := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, map[string]interface{}{"text": "t1", "media": map[string]interface{}{"media_ids": []interface{}{"m1"}}}, req)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	tw := TwitterV2{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", Server: ts.URL}
+	ev := rss.Event{Title: "t1", Images: []rss.Image{{URL: ts.URL + "/img.png", Alt: "image alt"}}}
+	require.NoError(t, tw.Publish(ev, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.Equal(t, []string{"/img.png", "/2/media/upload", "/2/media/metadata", "/2/tweets"}, calls)
+
+	// rate limit exhausted, image not loaded and not uploaded
+	tw.limit.exhaust(time.Now().Add(time.Hour))
+	err := tw.Publish(ev, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	_, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Len(t, calls, 4)
+}
+
+func TestTwitterV2PublishThread(t *testing.T) {
+	var tweets []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		tweets = append(tweets, req)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"data":{"id":"%d"}}`, len(tweets))))
+	}))
+	defer ts.Close()
+
+	tw := TwitterV2{ConsumerKey: "ck", ConsumerSecret: "cs", AccessToken: "at", AccessSecret: "as", Server: ts.URL}
+	err := tw.PublishThread(rss.Event{Title: "t1"}, func(e rss.Event, l Limits) []string { return []string{"m1", "m2", "m3"} })
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"text": "m1"},
+		{"text": "m2", "reply": map[string]interface{}{"in_reply_to_tweet_id": "1"}},
+		{"text": "m3", "reply": map[string]interface{}{"in_reply_to_tweet_id": "2"}},
+	}, tweets)
+}
+
+type tokenStoreMock struct {
+	data map[string][]byte
+}
+
+func (s *tokenStoreMock) Load(bucket, key string, v interface{}) (bool, error) {
+	b, ok := s.data[bucket+"/"+key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func (s *tokenStoreMock) Save(bucket, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	s.data[bucket+"/"+key] = b
+	return err
+}
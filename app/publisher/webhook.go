@@ -0,0 +1,185 @@
+package publisher
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+// webhook body types
+const (
+	WebhookJSON = "json"
+	WebhookForm = "form"
+	WebhookText = "text"
+)
+
+// WebhookDefaultRetries is number of retries of webhook request if not defined by config
+const WebhookDefaultRetries = 3
+
+const (
+	webhookDefaultMaxLen     = 4000
+	webhookDefaultSigHeader  = "X-Signature-256"
+	webhookDefaultRetryDelay = time.Second
+)
+
+// webhookContentTypes maps body type to content type header
+var webhookContentTypes = map[string]string{
+	WebhookJSON: "application/json",
+	WebhookForm: "application/x-www-form-urlencoded",
+	WebhookText: "text/plain; charset=utf-8",
+}
+
+// webhookBodies are default body templates for body types
+var webhookBodies = map[string]string{
+	WebhookJSON: `{"text": {{json .Message}}}`,
+	WebhookForm: `text={{urlquery .Message}}`,
+	WebhookText: `{{.Message}}`,
+}
+
+// Webhook implements publisher.Interface and sends http request with body made from template.
+// The body template gets rss.Event fields and formatted message as .Message, "json" function
+// encodes value as json string. Requests failed with network error or 5xx status retried.
+type Webhook struct {
+	URL             string
+	Method          string            // POST if not set
+	BodyType        string            // WebhookJSON, WebhookForm or WebhookText, json if not set
+	Body            string            // body template, default for body type if not set
+	Headers         map[string]string // custom headers
+	Secret          string            // if set, body signed with hmac-sha256 as "sha256=<hex>"
+	SignatureHeader string            // header for signature, X-Signature-256 if not set
+	Retries         int               // number of retries on network errors and 5xx, 0 for no retries
+	RetryDelay      time.Duration     // delay before the first retry, doubled on each next one, 1s if not set
+	MaxLen          int               // max length of formatted message, 4000 if not set
+	Client          *http.Client      // optional, default client with 30s timeout used if not set
+
+	once  sync.Once
+	templ *template.Template
+	err   error
+}
+
+// webhookData passed to body template
+type webhookData struct {
+	rss.Event
+	Message string
+}
+
+// Validate sets defaults and parses body template
+func (w *Webhook) Validate() error {
+	w.once.Do(func() {
+		if w.Client == nil {
+			w.Client = &http.Client{Timeout: 30 * time.Second}
+		}
+		if w.Method == "" {
+			w.Method = "POST"
+		}
+		if w.BodyType == "" {
+			w.BodyType = WebhookJSON
+		}
+		if _, ok := webhookContentTypes[w.BodyType]; !ok {
+			w.err = errors.Errorf("unknown body type %q", w.BodyType)
+			return
+		}
+		if w.Body == "" {
+			w.Body = webhookBodies[w.BodyType]
+		}
+		if w.SignatureHeader == "" {
+			w.SignatureHeader = webhookDefaultSigHeader
+		}
+		if w.RetryDelay == 0 {
+			w.RetryDelay = webhookDefaultRetryDelay
+		}
+		if w.MaxLen == 0 {
+			w.MaxLen = webhookDefaultMaxLen
+		}
+		funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}}
+		w.templ, w.err = template.New("webhook").Funcs(funcs).Parse(w.Body)
+		w.err = errors.Wrap(w.err, "can't parse webhook body template")
+	})
+	return w.err
+}
+
+// Limits returns max length of formatted message
+func (w *Webhook) Limits() Limits {
+	w.Validate() // nolint, reported by Publish
+	return Limits{MaxLen: w.MaxLen}
+}
+
+// Publish sends formatted message to webhook
+func (w *Webhook) Publish(event rss.Event, formatter Formatter) error {
+	log.Printf("[INFO] publish to webhook %s %+v", w.URL, event.Title)
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	msg := formatter(event, w.Limits())
+
+	body := bytes.Buffer{}
+	if err := w.templ.Execute(&body, webhookData{Event: event, Message: msg}); err != nil {
+		return errors.Wrap(err, "can't make webhook body")
+	}
+
+	delay := w.RetryDelay
+	var err error
+	for i := 0; i <= w.Retries; i++ {
+		if i > 0 {
+			log.Printf("[DEBUG] retry webhook %s in %v, %v", w.URL, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		if retry, err = w.send(body.Bytes()); err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't send to webhook")
+	}
+	log.Printf("[DEBUG] published to webhook %s", strings.Replace(msg, "\n", " ", -1))
+	return nil
+}
+
+// send makes a single webhook request, returns true if failed request can be retried
+func (w *Webhook) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(w.Method, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "can't make request")
+	}
+	req.Header.Set("Content-Type", webhookContentTypes[w.BodyType])
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		_, _ = mac.Write(body)
+		req.Header.Set(w.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode >= 300 {
+		err = errors.New(responseError(resp))
+		if permanentStatus(resp.StatusCode) {
+			return false, Permanent(err)
+		}
+		return resp.StatusCode >= 500, err
+	}
+	return false, nil
+}
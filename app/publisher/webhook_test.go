@@ -0,0 +1,105 @@
+package publisher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func TestWebhookPublish(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway) // two first calls failed
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"content": "title \"1\" - link1", "guid": "guid1"}`, string(body))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer 123", r.Header.Get("Authorization"))
+		mac := hmac.New(sha256.New, []byte("secret"))
+		_, _ = mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Signature-256"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	wh := Webhook{URL: ts.URL, Body: `{"content": {{json .Message}}, "guid": "{{.GUID}}"}`,
+		Headers: map[string]string{"Authorization": "Bearer 123"}, Secret: "secret", Retries: 2, RetryDelay: time.Millisecond}
+	err := wh.Publish(rss.Event{Title: `title "1"`, Link: "link1", GUID: "guid1"}, func(e rss.Event, l Limits) string {
+		assert.Equal(t, 4000, l.MaxLen)
+		return e.Title + " - " + e.Link
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookPublishForm(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "title & more", r.PostForm.Get("text"))
+		assert.Equal(t, "", r.Header.Get("X-Signature-256"))
+	}))
+	defer ts.Close()
+
+	wh := Webhook{URL: ts.URL, Method: "PUT", BodyType: WebhookForm}
+	err := wh.Publish(rss.Event{Title: "title & more"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.NoError(t, err)
+}
+
+func TestWebhookPublishFailed(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/bad-request" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid payload"))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	wh := Webhook{URL: ts.URL, Retries: 2, RetryDelay: time.Millisecond}
+	err := wh.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "500 Internal Server Error")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "initial call and 2 retries")
+
+	atomic.StoreInt32(&calls, 0)
+	wh = Webhook{URL: ts.URL, Retries: 0}
+	require.Error(t, wh.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string { return e.Title }))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no retries with zero retries")
+
+	atomic.StoreInt32(&calls, 0)
+	wh = Webhook{URL: ts.URL + "/bad-request", Retries: 2, RetryDelay: time.Millisecond}
+	err = wh.Publish(rss.Event{Title: "title"}, func(e rss.Event, l Limits) string { return e.Title })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400 Bad Request, invalid payload")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no retries on 4xx")
+}
+
+func TestWebhookValidate(t *testing.T) {
+	wh := Webhook{URL: "http://example.com", Body: "{{.Message"}
+	assert.Error(t, wh.Validate())
+
+	wh = Webhook{URL: "http://example.com", BodyType: "xml"}
+	assert.EqualError(t, wh.Validate(), `unknown body type "xml"`)
+
+	wh = Webhook{URL: "http://example.com", BodyType: WebhookText}
+	require.NoError(t, wh.Validate())
+	assert.Equal(t, "{{.Message}}", wh.Body)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+// pubSet keeps publishers made by setup, keyed by name. Publisher with unchanged config reused on reload,
+// so it keeps its rate limit state, tokens and sessions. Publishers made for reload kept aside till commit,
+// so failed reload doesn't change the set.
+type pubSet struct {
+	mu   sync.Mutex
+	pubs map[string]pubEntry
+	next map[string]pubEntry // made by the last make, not committed yet
+}
+
+// pubEntry is publisher made for config
+type pubEntry struct {
+	conf config.Publisher
+	pub  publisher.Interface
+}
+
+// make returns publishers for names used by feeds, the current one reused if its config not changed.
+// The set replaced by them on commit, publishers not in names dropped.
+func (s *pubSet) make(publishers map[string]config.Publisher, names []string, st store.Interface) (map[string]publisher.Interface, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = nil
+	made := map[string]pubEntry{}
+	for _, name := range names {
+		if _, ok := made[name]; ok {
+			continue
+		}
+		conf := publishers[name]
+		if prev, ok := s.pubs[name]; ok && reflect.DeepEqual(prev.conf, conf) {
+			made[name] = prev
+			continue
+		}
+		p, err := makePublisher(conf, st)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't make publisher %s", name)
+		}
+		if _, ok := s.pubs[name]; ok {
+			log.Printf("[INFO] publisher %s changed", name)
+		}
+		made[name] = pubEntry{conf: conf, pub: p}
+	}
+	s.next = made
+	res := make(map[string]publisher.Interface, len(made))
+	for name, e := range made {
+		res[name] = e.pub
+	}
+	return res, nil
+}
+
+// commit replaces the set with publishers made by the last make, called once the whole setup succeeded
+func (s *pubSet) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next != nil {
+		s.pubs, s.next = s.next, nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestPubSetMake(t *testing.T) {
+	conf := map[string]config.Publisher{
+		"p1": {Type: config.TypeTwitter, ConsumerKey: "k", ConsumerSecret: "s", AccessToken: "t", AccessSecret: "s"},
+		"p2": {Type: config.TypeMastodon, Server: "https://example.com", AccessToken: "t"},
+	}
+	s := &pubSet{}
+	pubs, err := s.make(conf, []string{"p1", "p2", "p1"}, &store.Memory{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pubs))
+	s.commit()
+
+	// p1 not changed, p2 changed
+	conf["p2"] = config.Publisher{Type: config.TypeMastodon, Server: "https://example.com", AccessToken: "t2"}
+	reloaded, err := s.make(conf, []string{"p1", "p2"}, &store.Memory{})
+	require.NoError(t, err)
+	assert.Same(t, pubs["p1"], reloaded["p1"], "unchanged publisher reused")
+	assert.NotSame(t, pubs["p2"], reloaded["p2"], "changed publisher made again")
+
+	// reload not committed, i.e. failed after make, set not changed
+	again, err := s.make(conf, []string{"p1", "p2"}, &store.Memory{})
+	require.NoError(t, err)
+	assert.NotSame(t, reloaded["p2"], again["p2"], "uncommitted publisher not reused")
+	s.commit()
+
+	// failed to make, set not changed
+	conf["p3"] = config.Publisher{Type: "unknown"}
+	_, err = s.make(conf, []string{"p1", "p3"}, &store.Memory{})
+	assert.EqualError(t, err, `can't make publisher p3: unknown publisher type "unknown"`)
+	s.commit()
+	reloaded2, err := s.make(conf, []string{"p1", "p2"}, &store.Memory{})
+	require.NoError(t, err)
+	assert.Same(t, pubs["p1"], reloaded2["p1"])
+	assert.Same(t, again["p2"], reloaded2["p2"])
+
+	_, err = s.make(conf, []string{"p1"}, &store.Memory{})
+	require.NoError(t, err)
+	s.commit()
+	assert.Equal(t, 1, len(s.pubs), "unused publishers dropped")
+}
+
+func TestReloadFeedsFailedKeepsPublishers(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.yml")
+	conf := `
+feeds:
+  - url: http://example.com/rss
+    template: "%s"
+    publisher: hook
+publishers:
+  hook:
+    type: webhook
+    url: %s
+`
+	require.NoError(t, os.WriteFile(fname, []byte(fmt.Sprintf(conf, "{{.Title}}", "http://example.com/hook1")), 0o600))
+	pubs := &pubSet{}
+	_, err := setup(opts{Config: fname}, &store.Memory{}, nil, pubs)
+	require.NoError(t, err)
+	pubs.commit()
+	hook := pubs.pubs["hook"].pub
+
+	// publisher changed, template broken, reload failed after publishers made
+	require.NoError(t, os.WriteFile(fname, []byte(fmt.Sprintf(conf, "{{.Titel}}", "http://example.com/hook2")), 0o600))
+	err = reloadFeeds(opts{Config: fname}, &store.Memory{}, nil, pubs, &feedSet{})
+	require.Error(t, err)
+	assert.Same(t, hook, pubs.pubs["hook"].pub, "publishers not replaced by failed reload")
+	assert.Equal(t, "http://example.com/hook1", pubs.pubs["hook"].conf.URL)
+}
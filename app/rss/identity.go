@@ -0,0 +1,206 @@
+package rss
+
+import (
+	"crypto/sha1" // nolint
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/denisbrodbeck/striphtmltags"
+	"github.com/mmcdole/gofeed"
+)
+
+// item identity strategies
+const (
+	IdentityGUID           = "guid"            // item guid (atom id)
+	IdentityLink           = "link"            // item link as is
+	IdentityNormalizedLink = "normalized_link" // item link without scheme, www, fragment, tracking params and trailing slash
+	IdentityTitleDate      = "title_date"      // hash of item title and publication date
+)
+
+// trackingParams are query params removed from normalized link, in addition to utm_*
+var trackingParams = map[string]bool{"fbclid": true, "gclid": true, "yclid": true, "mc_cid": true, "mc_eid": true,
+	"ref": true, "_hsenc": true, "_hsmi": true}
+
+// itemID returns identity of the item, by Identity strategy. Items without the value used by the strategy,
+// i.e. without guid, identified by normalized link, or by title and date hash if there is no link either.
+// Empty id returned if nothing identifies the item.
+func (n *Notify) itemID(item *gofeed.Item) string {
+	switch n.Identity {
+	case IdentityLink:
+		if link := strings.TrimSpace(item.Link); link != "" {
+			return link
+		}
+	case IdentityNormalizedLink: // the same as fallback
+	case IdentityTitleDate:
+		return titleDateHash(item)
+	default:
+		if guid := strings.TrimSpace(item.GUID); guid != "" {
+			return guid
+		}
+	}
+	if link := normalizeLink(item.Link); link != "" {
+		return link
+	}
+	return titleDateHash(item)
+}
+
+// identity returns Identity strategy, guid if not set
+func (n *Notify) identity() string {
+	if n.Identity == "" {
+		return IdentityGUID
+	}
+	return n.Identity
+}
+
+// identity returns identity strategy of seen ids, guid if not set
+func (s *state) identity() string {
+	if s.Identity == "" {
+		return IdentityGUID
+	}
+	return s.Identity
+}
+
+// normalizeLink makes link comparable regardless of scheme, www prefix, host case, fragment, tracking params,
+// order of query params and trailing slash. Empty string returned for empty link.
+func normalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(link, "/")
+	}
+	q := u.Query()
+	for k := range q {
+		if strings.HasPrefix(strings.ToLower(k), "utm_") || trackingParams[strings.ToLower(k)] {
+			q.Del(k)
+		}
+	}
+	res := strings.TrimPrefix(strings.ToLower(u.Host), "www.") + strings.TrimSuffix(u.EscapedPath(), "/")
+	if len(q) > 0 {
+		res += "?" + q.Encode() // encoded sorted by key
+	}
+	return res
+}
+
+// titleDateHash returns hash of item title and publication (or update) date, empty if item has no title.
+// Description used instead of the title for items without it.
+func titleDateHash(item *gofeed.Item) string {
+	text := strings.TrimSpace(item.Title)
+	if text == "" {
+		text = strings.TrimSpace(item.Description)
+	}
+	if text == "" {
+		return ""
+	}
+	date := ""
+	switch {
+	case item.PublishedParsed != nil:
+		date = item.PublishedParsed.UTC().Format(time.RFC3339)
+	case item.UpdatedParsed != nil:
+		date = item.UpdatedParsed.UTC().Format(time.RFC3339)
+	}
+	h := sha1.Sum([]byte(text + "\n" + date)) // nolint
+	return "sha1:" + hex.EncodeToString(h[:])
+}
+
+// revision of the item, its update time and content
+type revision struct {
+	Updated time.Time `json:"updated,omitempty"` // zero if not defined
+	Hash    string    `json:"hash"`              // hash of item text
+}
+
+// itemRevision returns revision of the item. Title, description and content hashed as text, without html tags
+// and with whitespace normalized, so changed markup or formatting is not a new revision
+func itemRevision(item *gofeed.Item) revision {
+	text := func(s string) string { return strings.Join(strings.Fields(striphtmltags.StripTags(s)), " ") }
+	h := sha1.Sum([]byte(strings.Join([]string{text(item.Title), text(item.Description), text(item.Content)}, "\n"))) // nolint
+	res := revision{Hash: hex.EncodeToString(h[:8])}
+	if item.UpdatedParsed != nil {
+		res.Updated = *item.UpdatedParsed
+	}
+	return res
+}
+
+// updates checks if r is update of prev revision. Text should be changed, and if both revisions have update time,
+// r should be updated later, so changed counters or rolled back update time are not updates
+func (r revision) updates(prev revision) bool {
+	if r.Hash == prev.Hash {
+		return false
+	}
+	if !r.Updated.IsZero() && !prev.Updated.IsZero() {
+		return r.Updated.After(prev.Updated)
+	}
+	return true
+}
+
+// dedupKeys returns keys matching the item to recently seen ones regardless of identity strategy:
+// guid, normalized link and title with publication date. Edited item with a new guid matches by link,
+// re-published one with a new link by title and date. Title alone is not a key, as recurring titles,
+// i.e. "Weekly digest", are different items. Items without publication date have no title key.
+func dedupKeys(guid, link, title string, published time.Time) []string {
+	res := []string{}
+	if guid = strings.TrimSpace(guid); guid != "" {
+		res = append(res, "guid:"+guid)
+	}
+	if link = normalizeLink(link); link != "" {
+		res = append(res, "link:"+link)
+	}
+	if title = strings.ToLower(strings.Join(strings.Fields(title), " ")); title != "" && !published.IsZero() {
+		res = append(res, "title:"+title+"|"+published.UTC().Format(time.RFC3339))
+	}
+	return res
+}
+
+// itemDedupKeys returns dedupKeys of the feed item
+func itemDedupKeys(item *gofeed.Item) []string {
+	var published time.Time
+	if item.PublishedParsed != nil {
+		published = *item.PublishedParsed
+	}
+	return dedupKeys(item.GUID, item.Link, item.Title, published)
+}
+
+// recentItem is an item seen within dedup window
+type recentItem struct {
+	Keys []string  `json:"keys"`
+	TS   time.Time `json:"ts"`
+}
+
+// isRecent checks if any of keys belongs to item seen within window before now
+func (s *state) isRecent(keys []string, now time.Time, window time.Duration) bool {
+	for _, r := range s.Recent {
+		if now.Sub(r.TS) > window {
+			continue
+		}
+		for _, k := range r.Keys {
+			for _, key := range keys {
+				if k == key {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// remember adds item keys to recent items and drops items seen before window.
+// Nothing kept with zero window.
+func (s *state) remember(keys []string, now time.Time, window time.Duration) {
+	recent := s.Recent[:0]
+	for _, r := range s.Recent {
+		if now.Sub(r.TS) <= window {
+			recent = append(recent, r)
+		}
+	}
+	s.Recent = recent
+	if window > 0 && len(keys) > 0 {
+		s.Recent = append(s.Recent, recentItem{Keys: keys, TS: now})
+	}
+	if max := s.maxKept(); len(s.Recent) > max {
+		s.Recent = s.Recent[len(s.Recent)-max:]
+	}
+	if len(s.Recent) == 0 {
+		s.Recent = nil
+	}
+}
@@ -0,0 +1,163 @@
+package rss
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestNotifyItemID(t *testing.T) {
+	published := time.Date(2021, 1, 5, 10, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{GUID: "g1", Link: "https://www.example.com/post/1/?utm_source=rss", Title: "t1",
+		PublishedParsed: &published}
+	noGUID := &gofeed.Item{Link: "https://www.example.com/post/1/", Title: "t1", PublishedParsed: &published}
+	titleOnly := &gofeed.Item{Title: "t1", PublishedParsed: &published}
+
+	tbl := []struct {
+		identity string
+		item     *gofeed.Item
+		res      string
+	}{
+		{"", item, "g1"},
+		{IdentityGUID, item, "g1"},
+		{IdentityGUID, noGUID, "example.com/post/1"},
+		{IdentityLink, item, "https://www.example.com/post/1/?utm_source=rss"},
+		{IdentityNormalizedLink, item, "example.com/post/1"},
+		{IdentityNormalizedLink, titleOnly, "sha1:51de8868730095ad18edc3ade6b40a04b92dbb79"},
+		{IdentityTitleDate, item, "sha1:51de8868730095ad18edc3ade6b40a04b92dbb79"},
+		{IdentityGUID, &gofeed.Item{}, ""},
+	}
+	for _, tt := range tbl {
+		n := Notify{Identity: tt.identity}
+		assert.Equal(t, tt.res, n.itemID(tt.item), "%s %+v", tt.identity, tt.item)
+	}
+
+	other := time.Date(2021, 1, 6, 10, 0, 0, 0, time.UTC)
+	n := Notify{Identity: IdentityTitleDate}
+	assert.NotEqual(t, n.itemID(titleOnly), n.itemID(&gofeed.Item{Title: "t1", PublishedParsed: &other}))
+}
+
+func TestNormalizeLink(t *testing.T) {
+	tbl := []struct {
+		inp, res string
+	}{
+		{"", ""},
+		{"https://example.com/post/1", "example.com/post/1"},
+		{" http://WWW.Example.com/post/1/ ", "example.com/post/1"},
+		{"https://example.com/post/1#comments", "example.com/post/1"},
+		{"https://example.com/?p=1&utm_source=rss&utm_medium=feed&fbclid=abc", "example.com?p=1"},
+		{"https://example.com/post?b=2&a=1", "example.com/post?a=1&b=2"},
+		{"https://example.com/Post/1", "example.com/Post/1"},
+		{"/post/1/", "/post/1"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, normalizeLink(tt.inp), tt.inp)
+	}
+}
+
+func TestNotifyDedupWindow(t *testing.T) {
+	feed := func(items ...*gofeed.Item) *gofeed.Feed { return &gofeed.Feed{Items: items} }
+	published := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	later := published.Add(7 * 24 * time.Hour)
+	n := Notify{Feed: "f1", DedupWindow: time.Hour}
+	st := state{}
+	events, err := n.feedEvents(feed(
+		&gofeed.Item{GUID: "g1", Link: "https://example.com/1", Title: "First post", PublishedParsed: &published},
+		&gofeed.Item{GUID: "d1", Link: "https://example.com/d1", Title: "Weekly digest", PublishedParsed: &published},
+	), &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "first run")
+	assert.Equal(t, []string{"guid:g1", "link:example.com/1", "title:first post|2021-01-01T10:00:00Z"}, st.Recent[1].Keys)
+
+	// edited with a new guid, re-published with a new link, recurring title and a new item
+	events, err = n.feedEvents(feed(
+		&gofeed.Item{GUID: "g3", Link: "https://example.com/3", Title: "Third post"},
+		&gofeed.Item{GUID: "d2", Link: "https://example.com/d2", Title: "Weekly digest", PublishedParsed: &later},
+		&gofeed.Item{GUID: "g1-r", Link: "https://example.com/1-republished", Title: " first  Post", PublishedParsed: &published},
+		&gofeed.Item{GUID: "g1-e", Link: "https://example.com/1?utm_source=rss", Title: "First post, edited"},
+		&gofeed.Item{GUID: "g1", Link: "https://example.com/1", Title: "First post", PublishedParsed: &published},
+	), &st)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, "Weekly digest", events[0].Title, "the same title published later is a new item")
+	assert.Equal(t, "Third post", events[1].Title)
+	assert.Equal(t, []string{"d1", "g1", "g1-e", "g1-r"}, st.Seen, "duplicates marked as seen")
+
+	assert.Equal(t, []string{"guid:g1", "link:example.com/1"}, dedupKeys("g1", "https://example.com/1", "First post", time.Time{}),
+		"no title key without date")
+
+	// outside of the window
+	st = state{Seen: []string{"g1"}, Recent: []recentItem{{Keys: []string{"guid:g1", "link:example.com/1"},
+		TS: time.Now().Add(-2 * time.Hour)}}}
+	events, err = n.feedEvents(feed(&gofeed.Item{GUID: "g2", Link: "https://example.com/1", Title: "t"}), &st)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+
+	// dedup disabled
+	n = Notify{Feed: "f1"}
+	st = state{Seen: []string{"g1"}, Recent: []recentItem{{Keys: []string{"guid:g1", "link:example.com/1"}, TS: time.Now()}}}
+	events, err = n.feedEvents(feed(&gofeed.Item{GUID: "g2", Link: "https://example.com/1", Title: "t"}), &st)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestNotifyDedupWindowPublished(t *testing.T) {
+	var reqs int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := `<item><guid>g1</guid><link>https://example.com/1</link><title>First</title></item>`
+		if atomic.AddInt32(&reqs, 1) > 1 { // new item without guid
+			items = `<item><link>https://example.com/2?utm_source=rss</link><title>Second</title>` +
+				`<pubDate>Fri, 01 Jan 2021 10:00:00 GMT</pubDate></item>` + items
+		}
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><rss version="2.0"><channel><title>t</title>` + items + `</channel></rss>`))
+	}))
+	defer ts.Close()
+
+	n := Notify{Feed: ts.URL, Duration: 10 * time.Millisecond, Timeout: time.Second, Store: &store.Memory{}, DedupWindow: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	events := []Event{}
+	for ev := range n.Go(ctx) {
+		events = append(events, ev)
+	}
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, "example.com/2", events[0].GUID, "guid of event is its id")
+
+	recent := n.loadState().Recent
+	require.Equal(t, 2, len(recent))
+	assert.Equal(t, []string{"link:example.com/2", "title:second|2021-01-01T10:00:00Z"}, recent[1].Keys,
+		"published item has the same keys as skipped one, without id as guid")
+}
+
+func TestNotifyIdentityChanged(t *testing.T) {
+	f := &gofeed.Feed{Items: []*gofeed.Item{{GUID: "g2", Link: "https://example.com/2"}, {GUID: "g1", Link: "https://example.com/1"}}}
+	n := Notify{Feed: "f1", Identity: IdentityNormalizedLink}
+	st := state{Seen: []string{"g1"}}
+	events, err := n.feedEvents(f, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "all items marked as seen")
+	assert.Equal(t, []string{"example.com/1", "example.com/2"}, st.Seen)
+	assert.Equal(t, IdentityNormalizedLink, st.Identity)
+
+	f.Items = append([]*gofeed.Item{{GUID: "g3", Link: "https://example.com/3"}}, f.Items...)
+	events, err = n.feedEvents(f, &st)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, "example.com/3", events[0].ID)
+	assert.Equal(t, "g3", events[0].GUID)
+
+	n = Notify{Feed: "f1"}
+	st = state{Seen: []string{"g1"}}
+	events, err = n.feedEvents(f, &st)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(events), "state without identity is guid")
+}
@@ -0,0 +1,98 @@
+package rss
+
+import (
+	"strings"
+
+	"github.com/denisbrodbeck/striphtmltags"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// Image of the rss item or channel
+type Image struct {
+	URL  string
+	Type string // mime type, empty if not known
+	Alt  string // alternative text, media description or item title
+}
+
+// Image returns the first image of the item, or channel image if the item has no images. Nil if none.
+func (e Event) Image() *Image {
+	if len(e.Images) > 0 {
+		return &e.Images[0]
+	}
+	return e.ChanImage
+}
+
+// itemImages collects images of the item from media tags, image enclosures and item (itunes) image.
+// Alt text taken from media description or title, item title used if not set.
+func itemImages(item *gofeed.Item) []Image {
+	alt := strings.TrimSpace(striphtmltags.StripTags(item.Title))
+	res := []Image{}
+	seen := map[string]bool{}
+	add := func(img Image) {
+		if img.URL == "" || seen[img.URL] {
+			return
+		}
+		if img.Alt == "" {
+			img.Alt = alt
+		}
+		seen[img.URL] = true
+		res = append(res, img)
+	}
+
+	media := item.Extensions["media"]
+	contents := media["content"]
+	for _, g := range media["group"] {
+		contents = append(contents, g.Children["content"]...)
+	}
+	for _, c := range contents {
+		if c.Attrs["medium"] == "image" || strings.HasPrefix(c.Attrs["type"], "image/") {
+			add(Image{URL: c.Attrs["url"], Type: c.Attrs["type"], Alt: mediaText(c.Children)})
+		}
+	}
+	for _, enc := range item.Enclosures {
+		if strings.HasPrefix(enc.Type, "image/") {
+			add(Image{URL: enc.URL, Type: enc.Type})
+		}
+	}
+	for _, t := range media["thumbnail"] {
+		add(Image{URL: t.Attrs["url"], Alt: mediaText(media)})
+	}
+	if item.Image != nil {
+		add(Image{URL: item.Image.URL, Alt: item.Image.Title})
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// chanImage returns channel image, nil if not defined
+func chanImage(feed *gofeed.Feed) *Image {
+	if feed.Image == nil || feed.Image.URL == "" {
+		return nil
+	}
+	alt := feed.Image.Title
+	if alt == "" {
+		alt = strings.TrimSpace(feed.Title)
+	}
+	return &Image{URL: feed.Image.URL, Alt: alt}
+}
+
+// mediaText returns media:description, or media:title if no description
+func mediaText(elems map[string][]ext.Extension) string {
+	for _, name := range []string{"description", "title"} {
+		if e := elems[name]; len(e) > 0 && strings.TrimSpace(e[0].Value) != "" {
+			return strings.TrimSpace(striphtmltags.StripTags(e[0].Value))
+		}
+	}
+	return ""
+}
+
+// ImageURL returns url of the event's image, empty if none
+func (e Event) ImageURL() string {
+	if img := e.Image(); img != nil {
+		return img.URL
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package rss
+
+import (
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestItemImages(t *testing.T) {
+	feed := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+<channel>
+	<title>Blog</title>
+	<image><url>https://example.com/logo.png</url><title>Blog logo</title></image>
+	<item>
+		<title>Post &lt;b&gt;1&lt;/b&gt;</title>
+		<guid>1</guid>
+		<enclosure url="https://example.com/ep1.mp3" type="audio/mpeg" length="100"/>
+		<enclosure url="https://example.com/pic1.jpg" type="image/jpeg" length="100"/>
+		<media:content url="https://example.com/media1.png" medium="image">
+			<media:description>media description</media:description>
+		</media:content>
+		<media:content url="https://example.com/video.mp4" type="video/mp4"/>
+		<media:thumbnail url="https://example.com/thumb1.jpg"/>
+		<itunes:image href="https://example.com/pic1.jpg"/>
+	</item>
+	<item>
+		<title>Post 2</title>
+		<guid>2</guid>
+		<media:group>
+			<media:content url="https://example.com/group.webp" type="image/webp"/>
+		</media:group>
+	</item>
+	<item>
+		<title>Post 3</title>
+		<guid>3</guid>
+	</item>
+</channel>
+</rss>`
+	f, err := gofeed.NewParser().ParseString(feed)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(f.Items))
+
+	assert.Equal(t, []Image{
+		{URL: "https://example.com/media1.png", Alt: "media description"},
+		{URL: "https://example.com/pic1.jpg", Type: "image/jpeg", Alt: "Post 1"},
+		{URL: "https://example.com/thumb1.jpg", Alt: "Post 1"},
+	}, itemImages(f.Items[0]))
+	assert.Equal(t, []Image{{URL: "https://example.com/group.webp", Type: "image/webp", Alt: "Post 2"}}, itemImages(f.Items[1]))
+	assert.Nil(t, itemImages(f.Items[2]))
+
+	n := Notify{Feed: "http://example.com/rss"}
+	ev := n.makeEvent(f, f.Items[0])
+	assert.Equal(t, "https://example.com/media1.png", ev.Image().URL)
+	ev = n.makeEvent(f, f.Items[2])
+	assert.Equal(t, &Image{URL: "https://example.com/logo.png", Alt: "Blog logo"}, ev.Image())
+	assert.Nil(t, Event{}.Image())
+}
@@ -0,0 +1,100 @@
+package rss
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// Escaped returns copy of the event with all text values escaped by escape, i.e. for publisher's markup
+func (e Event) Escaped(escape func(string) string) Event {
+	e.ChanTitle, e.ChanLink, e.Title, e.Link, e.Text = escape(e.ChanTitle), escape(e.ChanLink), escape(e.Title), escape(e.Link), escape(e.Text)
+	e.Author, e.EnclosureURL, e.Duration = escape(e.Author), escape(e.EnclosureURL), escape(e.Duration)
+	if e.Categories != nil {
+		cats := make([]string, len(e.Categories))
+		for i, c := range e.Categories {
+			cats[i] = escape(c)
+		}
+		e.Categories = cats
+	}
+	if e.Images != nil {
+		images := make([]Image, len(e.Images))
+		for i, img := range e.Images {
+			images[i] = Image{URL: escape(img.URL), Type: img.Type, Alt: escape(img.Alt)}
+		}
+		e.Images = images
+	}
+	if e.ChanImage != nil {
+		e.ChanImage = &Image{URL: escape(e.ChanImage.URL), Type: e.ChanImage.Type, Alt: escape(e.ChanImage.Alt)}
+	}
+	return e
+}
+
+// itemAuthor returns author name of the item from author, dc:creator or itunes:author
+func itemAuthor(item *gofeed.Item) string {
+	names := []string{}
+	for _, p := range item.Authors {
+		if p != nil && strings.TrimSpace(p.Name) != "" {
+			names = append(names, strings.TrimSpace(p.Name))
+		}
+	}
+	if len(names) == 0 && item.Author != nil {
+		names = append(names, strings.TrimSpace(item.Author.Name))
+	}
+	if len(names) == 0 && item.ITunesExt != nil {
+		names = append(names, strings.TrimSpace(item.ITunesExt.Author))
+	}
+	return strings.Join(names, ", ")
+}
+
+// itemCategories returns unique non-empty categories of the item
+func itemCategories(item *gofeed.Item) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, c := range item.Categories {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		res = append(res, c)
+	}
+	return res
+}
+
+// itemEnclosure returns the first enclosure which is not an image, i.e. podcast episode audio. Nil if none.
+func itemEnclosure(item *gofeed.Item) *gofeed.Enclosure {
+	for _, enc := range item.Enclosures {
+		if enc != nil && enc.URL != "" && !strings.HasPrefix(enc.Type, "image/") {
+			return enc
+		}
+	}
+	return nil
+}
+
+// itemDuration returns itunes:duration normalized to "h:mm:ss" or "m:ss". Duration can be set in seconds,
+// as "mm:ss" or as "hh:mm:ss", unrecognized value returned as is.
+func itemDuration(item *gofeed.Item) string {
+	if item.ITunesExt == nil {
+		return ""
+	}
+	d := strings.TrimSpace(item.ITunesExt.Duration)
+	parts := strings.Split(d, ":")
+	if len(parts) > 3 {
+		return d
+	}
+	secs := 0
+	for _, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return d
+		}
+		secs = secs*60 + v
+	}
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
@@ -0,0 +1,92 @@
+package rss
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeEvent(t *testing.T) {
+	feed := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+	<title>Podcast</title>
+	<link> https://example.com </link>
+	<item>
+		<title>Episode 1</title>
+		<link>https://example.com/1</link>
+		<guid>1</guid>
+		<pubDate>Fri, 17 May 2024 10:00:00 GMT</pubDate>
+		<dc:creator>Umputun</dc:creator>
+		<category>tech</category>
+		<category> go </category>
+		<category>tech</category>
+		<itunes:image href="https://example.com/cover.jpg"/>
+		<enclosure url="https://example.com/ep1.mp3" type="audio/mpeg" length="100"/>
+		<itunes:duration>3723</itunes:duration>
+	</item>
+	<item>
+		<title>Episode 2</title>
+		<guid>2</guid>
+		<itunes:author>Bobuk</itunes:author>
+	</item>
+</channel>
+</rss>`
+	f, err := gofeed.NewParser().Parse(strings.NewReader(feed))
+	require.NoError(t, err)
+	n := Notify{Feed: "http://example.com/rss"}
+
+	ev := n.makeEvent(f, f.Items[0])
+	assert.Equal(t, "https://example.com", ev.ChanLink)
+	assert.Equal(t, time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC), ev.Published.UTC())
+	assert.True(t, ev.Updated.IsZero())
+	assert.Equal(t, "Umputun", ev.Author)
+	assert.Equal(t, []string{"tech", "go"}, ev.Categories)
+	assert.Equal(t, "https://example.com/ep1.mp3", ev.EnclosureURL)
+	assert.Equal(t, "audio/mpeg", ev.EnclosureType)
+	assert.Equal(t, "1:02:03", ev.Duration)
+	assert.Equal(t, "https://example.com/cover.jpg", ev.ImageURL())
+
+	ev = n.makeEvent(f, f.Items[1])
+	assert.Equal(t, "Bobuk", ev.Author)
+	assert.Nil(t, ev.Categories)
+	assert.Equal(t, "", ev.EnclosureURL)
+	assert.Equal(t, "", ev.Duration)
+	assert.Equal(t, "", ev.ImageURL())
+}
+
+func TestItemDuration(t *testing.T) {
+	tbl := []struct {
+		inp, res string
+	}{
+		{"", ""},
+		{"45", "0:45"},
+		{"3723", "1:02:03"},
+		{"42:15", "42:15"},
+		{"75:00", "1:15:00"},
+		{"01:02:03", "1:02:03"},
+		{" 00:59:59 ", "59:59"},
+		{"1h 20m", "1h 20m"},
+		{"1:2:3:4", "1:2:3:4"},
+	}
+	for _, tt := range tbl {
+		item := gofeed.Item{ITunesExt: &ext.ITunesItemExtension{Duration: tt.inp}}
+		assert.Equal(t, tt.res, itemDuration(&item), tt.inp)
+	}
+}
+
+func TestEventEscaped(t *testing.T) {
+	ev := Event{Title: "a&b", Categories: []string{"c&d"}, Images: []Image{{URL: "http://example.com/?a=1&b=2", Alt: "x&y"}}}
+	res := ev.Escaped(func(s string) string { return strings.Replace(s, "&", "&amp;", -1) })
+	assert.Equal(t, "a&amp;b", res.Title)
+	assert.Equal(t, []string{"c&amp;d"}, res.Categories)
+	assert.Equal(t, "http://example.com/?a=1&amp;b=2", res.ImageURL())
+	assert.Equal(t, "x&amp;y", res.Images[0].Alt)
+	assert.Equal(t, "c&d", ev.Categories[0], "original not changed")
+	assert.Equal(t, "x&y", ev.Images[0].Alt, "original not changed")
+}
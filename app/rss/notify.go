@@ -3,8 +3,13 @@
 package rss
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,24 +18,74 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	stateBucket = "feeds" // store bucket for per-feed state
+	maxSeen     = 1000    // max number of seen ids and recent items kept in feed state, unless the feed is larger
+
+	maxFetchDelay = 24 * time.Hour // max delay of the next fetch requested by feed server
+)
+
 // Notify on RSS change
 type Notify struct {
 	Feed     string
 	Duration time.Duration
 	Timeout  time.Duration
+	Store    Store   // optional, keeps seen items between restarts
+	MaxBatch int     // max number of events sent per refresh, 0 for unlimited
+	WebSub   *WebSub // optional, updates pushed by hub if feed advertises it, instead of polling
+	Adaptive bool    // learn refresh interval from the feed, Duration is the min interval
+
+	DegradedAfter int // number of consecutive failures making feed degraded, 5 if not set
 
-	once   sync.Once
-	ctx    context.Context
-	cancel context.CancelFunc
+	Identity    string        // item identity strategy, IdentityGUID if not set
+	DedupWindow time.Duration // items matching recently seen ones by guid, link or title within the window not sent
+	Updates     bool          // send events for updated items, seen before with another version
+
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	healthMu sync.Mutex
+	health   Health
+}
+
+// Store defines persistent storage for feed state, keyed by bucket and key
+type Store interface {
+	Load(bucket, key string, v interface{}) (found bool, err error)
+	Save(bucket, key string, v interface{}) error
 }
 
 // Event from RSS
 type Event struct {
-	ChanTitle string
-	Title     string
-	Link      string
-	Text      string
-	GUID      string
+	Feed          string // source feed url
+	ChanTitle     string
+	ChanLink      string // channel (site) link
+	Title         string
+	Link          string
+	Text          string
+	GUID          string    // item guid, or ID for items without guid
+	ID            string    // item identity by Notify.Identity strategy
+	Version       string    // item version, hash of item text changed by item update
+	Update        bool      // item seen before and updated since, with changed text and newer updated time if defined
+	Published     time.Time // zero if not defined
+	Updated       time.Time // zero if not defined
+	Author        string
+	Categories    []string
+	EnclosureURL  string  // media enclosure, i.e. podcast episode audio
+	EnclosureType string  // mime type of enclosure
+	Duration      string  // podcast episode duration, "1:02:03" or "42:15"
+	Images        []Image // item images, the most relevant first
+	ChanImage     *Image  // channel image, nil if not defined
+}
+
+// state of the feed, persisted in Store
+type state struct {
+	Seen         []string            `json:"seen"`                    // ids of seen items, the most recent last
+	Identity     string              `json:"identity,omitempty"`      // identity strategy of seen ids, guid if empty
+	Recent       []recentItem        `json:"recent,omitempty"`        // items seen within dedup window
+	Revisions    map[string]revision `json:"revisions,omitempty"`     // revisions of seen items by id, kept with Updates only
+	FeedSize     int                 `json:"feed_size,omitempty"`     // number of items in the last fetched feed
+	ETag         string              `json:"etag,omitempty"`          // entity tag of the last fetched feed, for conditional get
+	LastModified string              `json:"last_modified,omitempty"` // last modification time of the last fetched feed
 }
 
 // Go starts notifier and returns events channel
@@ -40,49 +95,115 @@ func (n *Notify) Go(ctx context.Context) <-chan Event {
 
 	ch := make(chan Event)
 
-	// wait for duration, can be terminated by ctx
-	waitOrCancel := func(ctx context.Context) bool {
-		select {
-		case <-ctx.Done():
-			return false
-		case <-time.After(n.Duration):
-			return true
-		}
-	}
-
 	go func() {
-
+		var sub *subscription    // websub subscription, nil if not subscribed
+		var discovered time.Time // time of the last hub discovery, zero if not done yet
 		defer func() {
+			if sub != nil {
+				n.WebSub.unsubscribe(sub)
+			}
 			close(ch)
 			n.cancel()
 		}()
 
 		fp := gofeed.NewParser()
-		fp.Client = &http.Client{Timeout: n.Timeout}
+		client := &http.Client{Timeout: n.Timeout}
 		log.Printf("[DEBUG] notifier uses http timeout %v", n.Timeout)
-		lastGUID := ""
-		for {
-			feedData, err := fp.ParseURL(n.Feed)
+		st := n.loadState()
+		var notBefore time.Time // the next fetch time allowed by feed server, with cache-control or retry-after
+
+		// parse feed and send its new events
+		process := func(body []byte) (*gofeed.Feed, error) {
+			feedData, err := fp.Parse(bytes.NewReader(body))
 			if err != nil {
-				log.Printf("[WARN] failed to fetch/parse url from %s, %v", n.Feed, err)
-				if !waitOrCancel(n.ctx) {
-					return
-				}
-				continue
+				return nil, errors.Wrap(err, "can't parse feed")
+			}
+			events, err := n.feedEvents(feedData, &st)
+			if err != nil {
+				log.Printf("[WARN] can't get events from %s, %v", n.Feed, err)
+			}
+			keys := map[string][]string{} // dedup keys of items by id, made from items as for skipped ones
+			for _, item := range feedData.Items {
+				keys[n.itemID(item)] = itemDedupKeys(item)
 			}
-			event, err := n.feedEvent(feedData)
-			if lastGUID != event.GUID && err == nil {
-				if lastGUID != "" { // don't notify on initial change
-					log.Printf("[INFO] new event %s - %s", event.GUID, event.Title)
-					ch <- event
+			for _, event := range events {
+				if event.Update {
+					log.Printf("[INFO] updated event %s - %s", event.ID, event.Title)
 				} else {
-					log.Printf("[INFO] ignore first event %s - %s", event.GUID, event.Title)
+					log.Printf("[INFO] new event %s - %s", event.ID, event.Title)
+				}
+				ch <- event
+				st.markSeen(event.ID)
+				st.remember(keys[event.ID], time.Now(), n.DedupWindow)
+				if n.Updates {
+					st.setRevision(event.ID, revision{Updated: event.Updated, Hash: event.Version})
+				}
+				n.saveState(st)
+			}
+			return feedData, nil
+		}
+
+		interval := n.Duration // refresh interval, learned from the feed with adaptive schedule
+		for {
+			wait := interval
+			if !sub.active() && !time.Now().Before(notBefore) { // poll unless updates pushed by websub hub
+				validators := st
+				// hub discovered with the first fetch, and again if there was no subscription for a while
+				discover := n.WebSub != nil && sub == nil && (discovered.IsZero() || time.Since(discovered) > websubDiscovery)
+				if discover { // full feed needed to discover hub
+					validators = state{}
+				}
+				body, header, err := n.fetch(n.ctx, client, validators)
+				notBefore = nextFetch(header, time.Now())
+				var feedData *gofeed.Feed
+				if err == nil && body != nil {
+					feedData, err = process(body)
+				}
+				health := n.setHealth(err)
+				switch {
+				case err != nil:
+					wait = n.backoff(health.Failures)
+				case body == nil:
+					log.Printf("[DEBUG] feed %s not modified", n.Feed)
+				default:
+					// validators saved after all events sent, so not sent events fetched again after restart
+					if st.ETag != header.Get("ETag") || st.LastModified != header.Get("Last-Modified") {
+						st.ETag, st.LastModified = header.Get("ETag"), header.Get("Last-Modified")
+						n.saveState(st)
+					}
+					if discover {
+						sub = n.subscribe(header, body)
+						discovered = time.Now()
+					}
+					if n.Adaptive && n.adaptiveInterval(body, feedData) != interval {
+						interval = n.adaptiveInterval(body, feedData)
+						wait = interval
+						log.Printf("[INFO] refresh interval of %s adapted to %v", n.Feed, interval)
+					}
+				}
+				if notBefore.After(time.Now().Add(wait)) {
+					log.Printf("[DEBUG] next fetch of %s not before %s", n.Feed, notBefore.Format(time.RFC3339))
+				}
+			}
+			if sub != nil && sub.renewDue() {
+				if err := n.WebSub.renew(sub); err != nil {
+					log.Printf("[WARN] can't renew websub subscription for %s, %v", n.Feed, err)
 				}
-				lastGUID = event.GUID
 			}
-			if !waitOrCancel(n.ctx) {
+
+			var updates chan []byte // nil channel never ready if not subscribed
+			if sub != nil {
+				updates = sub.updates
+			}
+			select {
+			case <-n.ctx.Done():
 				log.Print("[WARN] notifier canceled")
 				return
+			case <-time.After(wait):
+			case body := <-updates:
+				if _, err := process(body); err != nil {
+					log.Printf("[WARN] bad websub content for %s, %v", n.Feed, err)
+				}
 			}
 		}
 	}()
@@ -90,6 +211,94 @@ func (n *Notify) Go(ctx context.Context) <-chan Event {
 	return ch
 }
 
+// subscribe discovers websub hub of the feed and subscribes to it, nil returned if no hub advertised.
+// Failed subscription returned too, it is requested again later.
+func (n *Notify) subscribe(header http.Header, body []byte) *subscription {
+	hub, topic := discoverHub(header, body)
+	if hub == "" {
+		log.Printf("[DEBUG] no websub hub for %s, polling", n.Feed)
+		return nil
+	}
+	if topic == "" {
+		topic = n.Feed
+	}
+	sub, err := n.WebSub.subscribe(hub, topic)
+	if err != nil {
+		log.Printf("[WARN] can't subscribe to %s on websub hub, polling, %v", n.Feed, err)
+		return sub
+	}
+	log.Printf("[INFO] websub subscription for %s requested from %s", n.Feed, hub)
+	return sub
+}
+
+// fetch gets feed content and response headers. Request is conditional if validators of the previous response
+// defined in st, and nil body returned if feed not modified. Headers returned for error status too.
+func (n *Notify) fetch(ctx context.Context, client *http.Client, st state) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.Feed, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can't make request")
+	}
+	req.Header.Set("User-Agent", "rss2twitter")
+	if st.ETag != "" {
+		req.Header.Set("If-None-Match", st.ETag)
+	}
+	if st.LastModified != "" {
+		req.Header.Set("If-Modified-Since", st.LastModified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp.Header, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.Header, errors.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can't read body")
+	}
+	return body, resp.Header, nil
+}
+
+// nextFetch returns the earliest time of the next fetch allowed by response headers, Cache-Control max-age
+// and Retry-After. Zero time returned if not limited, the delay is limited by maxFetchDelay.
+func nextFetch(header http.Header, now time.Time) (res time.Time) {
+	if header == nil {
+		return res
+	}
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	for _, d := range strings.Split(cacheControl, ",") {
+		d = strings.TrimSpace(d)
+		if !strings.HasPrefix(d, "max-age=") || strings.Contains(cacheControl, "no-cache") {
+			continue
+		}
+		maxAge, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+		if err != nil {
+			continue
+		}
+		age, _ := strconv.Atoi(header.Get("Age"))
+		res = now.Add(time.Duration(maxAge-age) * time.Second)
+	}
+	if ra := header.Get("Retry-After"); ra != "" {
+		t := now
+		if secs, err := strconv.Atoi(ra); err == nil {
+			t = now.Add(time.Duration(secs) * time.Second)
+		} else if date, err := http.ParseTime(ra); err == nil {
+			t = date
+		}
+		if t.After(res) {
+			res = t
+		}
+	}
+	if res.After(now.Add(maxFetchDelay)) {
+		res = now.Add(maxFetchDelay)
+	}
+	return res
+}
+
 // Shutdown notifier
 func (n *Notify) Shutdown() {
 	log.Print("[DEBUG] shutdown initiated")
@@ -97,20 +306,255 @@ func (n *Notify) Shutdown() {
 	<-n.ctx.Done()
 }
 
-// feedEvent gets latest item from rss feed
-func (n *Notify) feedEvent(feed *gofeed.Feed) (e Event, err error) {
+// Latest fetches the feed and returns up to max most recent items, ordered from the oldest. Seen state not used or changed.
+func (n *Notify) Latest(max int) ([]Event, error) {
+	body, _, err := n.fetch(context.Background(), &http.Client{Timeout: n.Timeout}, state{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch url from %s", n.Feed)
+	}
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse feed %s", n.Feed)
+	}
+	items := []*gofeed.Item{}
+	for i := len(feed.Items) - 1; i >= 0; i-- { // feeds usually list the most recent items first
+		items = append(items, feed.Items[i])
+	}
+	sortByPublished(items)
+	if max > 0 && len(items) > max {
+		items = items[len(items)-max:]
+	}
+	res := []Event{}
+	for _, item := range items {
+		res = append(res, n.makeEvent(feed, item))
+	}
+	return res, nil
+}
+
+// feedEvents gets all unseen items from rss feed, ordered by publication time from the oldest.
+// On the very first run, with nothing seen yet, all items marked as seen and no events returned. The same done
+// if identity strategy changed, as seen ids are not comparable with new ones.
+// Items matching recently seen ones within DedupWindow, i.e. edited with a new guid, marked as seen and skipped.
+// If MaxBatch defined and there are more unseen items, only MaxBatch most recent returned and the rest marked as seen.
+// With Updates, seen items with a new revision, i.e. changed text and newer update time, returned after unseen ones,
+// as events with Update set. Items seen before their revisions kept, i.e. before Updates enabled, are not reported
+// as updated, just revisions recorded.
+func (n *Notify) feedEvents(feed *gofeed.Feed, st *state) (res []Event, err error) {
 	if len(feed.Items) == 0 {
-		return e, errors.New("no items in rss feed")
+		return nil, errors.New("no items in rss feed")
+	}
+
+	now := time.Now()
+	st.FeedSize = len(feed.Items)                           // set before marking items seen, so ids still in the feed are not dropped
+	if len(st.Seen) == 0 || st.identity() != n.identity() { // don't notify on initial run
+		if len(st.Seen) > 0 {
+			log.Printf("[INFO] identity of %s changed from %s to %s, all items marked as seen", n.Feed, st.identity(), n.identity())
+			st.Seen, st.Revisions = nil, nil
+		}
+		log.Printf("[INFO] ignore first event %s - %s", n.itemID(feed.Items[0]), feed.Items[0].Title)
+		for i := len(feed.Items) - 1; i >= 0; i-- {
+			item := feed.Items[i]
+			st.markSeen(n.itemID(item))
+			st.remember(itemDedupKeys(item), now, n.DedupWindow)
+			if n.Updates {
+				st.setRevision(n.itemID(item), itemRevision(item))
+			}
+		}
+		st.Identity = n.Identity
+		n.saveState(*st)
+		return nil, nil
+	}
+
+	unseen, updated := []*gofeed.Item{}, []*gofeed.Item{}
+	// state changed by skipped items or versions of items seen before
+	changed := false
+	for i := len(feed.Items) - 1; i >= 0; i-- { // feeds usually list the most recent items first
+		item := feed.Items[i]
+		id := n.itemID(item)
+		if id == "" {
+			log.Printf("[WARN] no guid, link or title for rss entry of %s, skipped", n.Feed)
+			continue
+		}
+		if st.isSeen(id) {
+			if !n.Updates {
+				continue
+			}
+			if rev, ok := st.Revisions[id]; !ok {
+				st.setRevision(id, itemRevision(item))
+				changed = true
+			} else if itemRevision(item).updates(rev) {
+				updated = append(updated, item)
+			}
+			continue
+		}
+		if keys := itemDedupKeys(item); n.DedupWindow > 0 && st.isRecent(keys, now, n.DedupWindow) {
+			log.Printf("[INFO] skip duplicate event %s - %s, seen within %v", id, item.Title, n.DedupWindow)
+			st.markSeen(id)
+			changed = true
+			continue
+		}
+		unseen = append(unseen, item)
 	}
-	if feed.Items[0].GUID == "" {
-		return e, errors.Errorf("no guid for rss entry %+v", feed.Items[0])
+	sortByPublished(unseen)
+	sortByUpdated(updated)
+
+	if n.MaxBatch > 0 && len(unseen) > n.MaxBatch {
+		skipped := unseen[:len(unseen)-n.MaxBatch]
+		log.Printf("[WARN] %d new items in %s, only %d most recent will be published", len(unseen), n.Feed, n.MaxBatch)
+		for _, item := range skipped {
+			log.Printf("[INFO] skip event %s - %s", n.itemID(item), item.Title)
+			st.markSeen(n.itemID(item))
+			st.remember(itemDedupKeys(item), now, n.DedupWindow)
+		}
+		changed = true
+		unseen = unseen[len(unseen)-n.MaxBatch:]
+	}
+	if n.MaxBatch > 0 && len(updated) > n.MaxBatch {
+		skipped := updated[:len(updated)-n.MaxBatch]
+		log.Printf("[WARN] %d updated items in %s, only %d most recent will be published", len(updated), n.Feed, n.MaxBatch)
+		for _, item := range skipped {
+			log.Printf("[INFO] skip updated event %s - %s", n.itemID(item), item.Title)
+			st.setRevision(n.itemID(item), itemRevision(item))
+		}
+		changed = true
+		updated = updated[len(updated)-n.MaxBatch:]
+	}
+	if changed {
+		n.saveState(*st)
+	}
+
+	for _, item := range unseen {
+		res = append(res, n.makeEvent(feed, item))
+	}
+	for _, item := range updated {
+		ev := n.makeEvent(feed, item)
+		ev.Update = true
+		res = append(res, ev)
 	}
+	return res, nil
+}
 
-	e.ChanTitle = feed.Title
-	e.Title = feed.Items[0].Title
-	e.Link = feed.Items[0].Link
-	e.Text = feed.Items[0].Description
-	e.GUID = feed.Items[0].GUID
+// sortByPublished sorts items by publication (or update) time, from the oldest.
+// Items kept in the original order if any of them has no time defined.
+func sortByPublished(items []*gofeed.Item) {
+	itemTime := func(item *gofeed.Item) *time.Time {
+		if item.PublishedParsed != nil {
+			return item.PublishedParsed
+		}
+		return item.UpdatedParsed
+	}
+	for _, item := range items {
+		if itemTime(item) == nil {
+			return
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return itemTime(items[i]).Before(*itemTime(items[j])) })
+}
 
-	return e, nil
+// sortByUpdated sorts items by update time, from the oldest. Items without update time kept in the original order
+// before the others.
+func sortByUpdated(items []*gofeed.Item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].UpdatedParsed == nil || items[j].UpdatedParsed == nil {
+			return items[i].UpdatedParsed == nil && items[j].UpdatedParsed != nil
+		}
+		return items[i].UpdatedParsed.Before(*items[j].UpdatedParsed)
+	})
+}
+
+func (n *Notify) makeEvent(feed *gofeed.Feed, item *gofeed.Item) Event {
+	res := Event{
+		Feed:       n.Feed,
+		ChanTitle:  feed.Title,
+		ChanLink:   strings.TrimSpace(feed.Link),
+		Title:      item.Title,
+		Link:       item.Link,
+		Text:       item.Description,
+		GUID:       item.GUID,
+		ID:         n.itemID(item),
+		Version:    itemRevision(item).Hash,
+		Author:     itemAuthor(item),
+		Categories: itemCategories(item),
+		Duration:   itemDuration(item),
+		Images:     itemImages(item),
+		ChanImage:  chanImage(feed),
+	}
+	if res.GUID == "" {
+		res.GUID = res.ID
+	}
+	if item.PublishedParsed != nil {
+		res.Published = *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		res.Updated = *item.UpdatedParsed
+	}
+	if enc := itemEnclosure(item); enc != nil {
+		res.EnclosureURL, res.EnclosureType = enc.URL, enc.Type
+	}
+	return res
+}
+
+// loadState gets feed state from the store, empty state if not stored yet or no store defined
+func (n *Notify) loadState() (res state) {
+	if n.Store == nil {
+		return res
+	}
+	found, err := n.Store.Load(stateBucket, n.Feed, &res)
+	if err != nil {
+		log.Printf("[WARN] can't load state for %s, %v", n.Feed, err)
+		return state{}
+	}
+	if found {
+		log.Printf("[DEBUG] loaded state for %s, %d seen items", n.Feed, len(res.Seen))
+	}
+	return res
+}
+
+func (n *Notify) saveState(st state) {
+	if n.Store == nil {
+		return
+	}
+	if err := n.Store.Save(stateBucket, n.Feed, st); err != nil {
+		log.Printf("[WARN] can't save state for %s, %v", n.Feed, err)
+	}
+}
+
+func (s *state) isSeen(id string) bool {
+	for _, g := range s.Seen {
+		if g == id {
+			return true
+		}
+	}
+	return false
+}
+
+// markSeen adds id to seen list, drops the oldest ids, with their revisions, if list grows above maxKept
+func (s *state) markSeen(id string) {
+	if id == "" || s.isSeen(id) {
+		return
+	}
+	s.Seen = append(s.Seen, id)
+	if max := s.maxKept(); len(s.Seen) > max {
+		for _, dropped := range s.Seen[:len(s.Seen)-max] {
+			delete(s.Revisions, dropped)
+		}
+		s.Seen = s.Seen[len(s.Seen)-max:]
+	}
+}
+
+// maxKept returns max number of seen ids and recent items kept, maxSeen or the size of the feed if it is larger,
+// so items still listed in the feed are never dropped and published again
+func (s *state) maxKept() int {
+	if s.FeedSize > maxSeen {
+		return s.FeedSize
+	}
+	return maxSeen
+}
+
+// setRevision keeps revision of the seen item
+func (s *state) setRevision(id string, rev revision) {
+	if s.Revisions == nil {
+		s.Revisions = map[string]revision{}
+	}
+	s.Revisions[id] = rev
 }
@@ -6,12 +6,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mmcdole/gofeed"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/store"
 )
 
 func TestNotify(t *testing.T) {
@@ -35,9 +39,12 @@ func TestNotify(t *testing.T) {
 	st := time.Now()
 	e := <-ch
 	t.Logf("%+v", e)
-	e.Text = ""
-	assert.Equal(t, Event{ChanTitle: "Радио-Т", Title: "Радио-Т 626",
-		Link: "https://radio-t.com/p/2018/12/01/podcast-626/", GUID: "https://radio-t.com/p/2018/12/01//podcast-626/"}, e)
+	assert.Equal(t, time.Date(2018, 12, 1, 18, 11, 19, 0, time.UTC), e.Published.UTC())
+	assert.Equal(t, 16, len(e.Version))
+	e.Text, e.Published, e.Version = "", time.Time{}, ""
+	assert.Equal(t, Event{Feed: ts.URL, ChanTitle: "Радио-Т", Title: "Радио-Т 626",
+		Link: "https://radio-t.com/p/2018/12/01/podcast-626/", GUID: "https://radio-t.com/p/2018/12/01//podcast-626/",
+		ID: "https://radio-t.com/p/2018/12/01//podcast-626/", Author: "Umputun, Bobuk, Gray, Ksenks", EnclosureURL: "http://cdn.radio-t.com/rt_podcast626.mp3", EnclosureType: "audio/mp3"}, e)
 	assert.True(t, time.Since(st) >= time.Millisecond*250)
 
 	select {
@@ -46,3 +53,368 @@ func TestNotify(t *testing.T) {
 	default:
 	}
 }
+
+func TestNotifyLatest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile("testdata/f1.xml")
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	st := &store.Memory{}
+	notify := Notify{Feed: ts.URL, Timeout: time.Second, Store: st}
+	events, err := notify.Latest(3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(events))
+	assert.Equal(t, "Радио-Т 623", events[0].Title)
+	assert.Equal(t, "Радио-Т 625", events[2].Title)
+	assert.Equal(t, state{}, notify.loadState(), "state not changed")
+
+	events, err = notify.Latest(0)
+	require.NoError(t, err)
+	assert.Equal(t, 20, len(events))
+
+	_, err = (&Notify{Feed: ts.URL + "/bad\x00", Timeout: time.Second}).Latest(3)
+	assert.Error(t, err)
+}
+
+func TestNotifyConditionalGet(t *testing.T) {
+	var reqs int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&reqs, 1)
+		if n > 1 {
+			assert.Equal(t, `"v1"`, r.Header.Get("If-None-Match"))
+			assert.Equal(t, "Sat, 01 Dec 2018 18:11:19 GMT", r.Header.Get("If-Modified-Since"))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		assert.Equal(t, "", r.Header.Get("If-None-Match"))
+		data, err := os.ReadFile("testdata/f1.xml")
+		require.NoError(t, err)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Sat, 01 Dec 2018 18:11:19 GMT")
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	st := &store.Memory{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	notify := Notify{Feed: ts.URL, Duration: 10 * time.Millisecond, Timeout: time.Second, Store: st}
+	for range notify.Go(ctx) {
+	}
+	assert.True(t, atomic.LoadInt32(&reqs) > 2)
+	saved := notify.loadState()
+	assert.Equal(t, `"v1"`, saved.ETag)
+	assert.Equal(t, "Sat, 01 Dec 2018 18:11:19 GMT", saved.LastModified)
+	assert.Equal(t, 20, len(saved.Seen))
+
+	// restarted notifier sends saved validators with the first request
+	atomic.StoreInt32(&reqs, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	restarted := Notify{Feed: ts.URL, Duration: 10 * time.Millisecond, Timeout: time.Second, Store: st}
+	for range restarted.Go(ctx) {
+	}
+}
+
+func TestNotifyCacheControl(t *testing.T) {
+	var reqs int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	notify := Notify{Feed: ts.URL, Duration: 10 * time.Millisecond, Timeout: time.Second}
+	for range notify.Go(ctx) {
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reqs), "next fetch in 60s")
+}
+
+func TestNextFetch(t *testing.T) {
+	now := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		header http.Header
+		res    time.Time
+	}{
+		{nil, time.Time{}},
+		{http.Header{}, time.Time{}},
+		{http.Header{"Cache-Control": {"public, max-age=300"}}, now.Add(5 * time.Minute)},
+		{http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, now.Add(200 * time.Second)},
+		{http.Header{"Cache-Control": {"no-cache, max-age=300"}}, time.Time{}},
+		{http.Header{"Cache-Control": {"max-age=bad"}}, time.Time{}},
+		{http.Header{"Retry-After": {"120"}}, now.Add(2 * time.Minute)},
+		{http.Header{"Retry-After": {"Fri, 17 May 2024 11:00:00 GMT"}}, now.Add(time.Hour)},
+		{http.Header{"Retry-After": {"120"}, "Cache-Control": {"max-age=600"}}, now.Add(10 * time.Minute)},
+		{http.Header{"Cache-Control": {"max-age=31536000"}}, now.Add(maxFetchDelay)},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, nextFetch(tt.header, now), "case %d", i)
+	}
+}
+
+func TestNotifyWithState(t *testing.T) {
+	var fnum int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(fmt.Sprintf("testdata/f%d.xml", atomic.LoadInt32(&fnum)))
+		require.NoError(t, err)
+		w.WriteHeader(200)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	st := &store.Memory{}
+
+	// first run, all items marked as seen and nothing sent
+	notify := Notify{Feed: ts.URL, Duration: time.Millisecond * 50, Timeout: time.Millisecond * 100, Store: st}
+	ch := notify.Go(context.Background())
+	time.Sleep(time.Millisecond * 120)
+	notify.Shutdown()
+	for e := range ch {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	var s state
+	found, err := st.Load(stateBucket, ts.URL, &s)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, 20, len(s.Seen))
+
+	// feed updated while notifier is down, restarted notifier should catch up
+	atomic.StoreInt32(&fnum, 2)
+	notify2 := Notify{Feed: ts.URL, Duration: time.Millisecond * 50, Timeout: time.Millisecond * 100, Store: st}
+	ch = notify2.Go(context.Background())
+	e := <-ch
+	assert.Equal(t, "Радио-Т 626", e.Title)
+	assert.Equal(t, ts.URL, e.Feed)
+	notify2.Shutdown()
+	for e := range ch {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	found, err = st.Load(stateBucket, ts.URL, &s)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, 21, len(s.Seen))
+	assert.Equal(t, "https://radio-t.com/p/2018/12/01//podcast-626/", s.Seen[20])
+}
+
+func TestNotifyFirstStart(t *testing.T) {
+	var fnum int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(fmt.Sprintf("testdata/f%d.xml", atomic.LoadInt32(&fnum)))
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	// fresh state file, as with --state on the first start
+	st, err := store.NewFile(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	notify := Notify{Feed: ts.URL, Duration: 20 * time.Millisecond, Timeout: time.Second, Store: st}
+	ch := notify.Go(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case e := <-ch:
+		t.Fatalf("existing item %q published on the first start", e.Title)
+	default:
+	}
+
+	// the first item added after start is published
+	atomic.StoreInt32(&fnum, 2)
+	select {
+	case e := <-ch:
+		assert.Equal(t, "Радио-Т 626", e.Title)
+	case <-time.After(time.Second):
+		t.Fatal("new item not published")
+	}
+	notify.Shutdown()
+	for e := range ch {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestStateMarkSeen(t *testing.T) {
+	s := state{}
+	for i := 0; i < maxSeen+10; i++ {
+		s.markSeen(fmt.Sprintf("guid-%d", i))
+	}
+	s.markSeen("guid-1009") // duplicate ignored
+	s.markSeen("")          // empty ignored
+	assert.Equal(t, maxSeen, len(s.Seen))
+	assert.Equal(t, "guid-10", s.Seen[0])
+	assert.True(t, s.isSeen("guid-1009"))
+	assert.False(t, s.isSeen("guid-9"))
+}
+
+func TestNotifyFeedEvents(t *testing.T) {
+	tm := func(s string) *time.Time {
+		res, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return &res
+	}
+	feed := &gofeed.Feed{Title: "feed", Items: []*gofeed.Item{
+		{GUID: "g5", Title: "t5", PublishedParsed: tm("2021-01-05T00:00:00Z")},
+		{GUID: "g3", Title: "t3", PublishedParsed: tm("2021-01-03T00:00:00Z")},
+		{GUID: "g4", Title: "t4", PublishedParsed: tm("2021-01-04T00:00:00Z")},
+		{GUID: "g2", Title: "t2", PublishedParsed: tm("2021-01-02T00:00:00Z")},
+		{GUID: "g1", Title: "t1", PublishedParsed: tm("2021-01-01T00:00:00Z")},
+	}}
+
+	t.Run("first run", func(t *testing.T) {
+		n := Notify{Feed: "f1"}
+		st := state{}
+		events, err := n.feedEvents(feed, &st)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+		assert.Equal(t, []string{"g1", "g2", "g4", "g3", "g5"}, st.Seen)
+	})
+
+	t.Run("unseen items in publication order", func(t *testing.T) {
+		n := Notify{Feed: "f1"}
+		st := state{Seen: []string{"g1", "g2", "g4"}} // g4 seen, but listed below unseen g3
+		events, err := n.feedEvents(feed, &st)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(events))
+		assert.Equal(t, "t3", events[0].Title)
+		assert.Equal(t, "t5", events[1].Title)
+		assert.Equal(t, "f1", events[1].Feed)
+		assert.Equal(t, "feed", events[1].ChanTitle)
+	})
+
+	t.Run("capped batch", func(t *testing.T) {
+		n := Notify{Feed: "f1", MaxBatch: 2}
+		st := state{Seen: []string{"g1"}}
+		events, err := n.feedEvents(feed, &st)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(events))
+		assert.Equal(t, "t4", events[0].Title)
+		assert.Equal(t, "t5", events[1].Title)
+		assert.Equal(t, []string{"g1", "g2", "g3"}, st.Seen, "skipped items marked as seen")
+	})
+
+	t.Run("no publication time, feed order", func(t *testing.T) {
+		n := Notify{Feed: "f1"}
+		st := state{Seen: []string{"x"}}
+		f := &gofeed.Feed{Items: []*gofeed.Item{{GUID: "g2", Title: "t2"}, {Title: "no guid"}, {GUID: "g1", Title: "t1"}}}
+		events, err := n.feedEvents(f, &st)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(events))
+		assert.Equal(t, "t1", events[0].Title)
+		assert.Equal(t, "no guid", events[1].Title)
+		assert.Equal(t, "sha1:", events[1].ID[:5], "identified by title and date")
+		assert.Equal(t, events[1].ID, events[1].GUID)
+		assert.Equal(t, "t2", events[2].Title)
+	})
+
+	t.Run("feed larger than max seen", func(t *testing.T) {
+		n := Notify{Feed: "f1", Updates: true, DedupWindow: time.Hour}
+		st := state{}
+		large := &gofeed.Feed{}
+		for i := maxSeen + 99; i >= 0; i-- {
+			large.Items = append(large.Items, &gofeed.Item{GUID: fmt.Sprintf("g%d", i), Title: fmt.Sprintf("t%d", i)})
+		}
+		events, err := n.feedEvents(large, &st)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+		assert.Equal(t, maxSeen+100, len(st.Seen))
+		assert.Equal(t, maxSeen+100, len(st.Recent))
+		assert.Equal(t, maxSeen+100, len(st.Revisions))
+
+		large.Items = append([]*gofeed.Item{{GUID: "new", Title: "new"}}, large.Items...)
+		events, err = n.feedEvents(large, &st)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(events), "items still in the feed not published again")
+		assert.Equal(t, "new", events[0].Title)
+	})
+
+	t.Run("empty feed", func(t *testing.T) {
+		n := Notify{Feed: "f1"}
+		_, err := n.feedEvents(&gofeed.Feed{}, &state{})
+		assert.Error(t, err)
+	})
+}
+
+func TestNotifyFeedEventsUpdates(t *testing.T) {
+	tm := func(s string) *time.Time {
+		res, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return &res
+	}
+	feed := &gofeed.Feed{Items: []*gofeed.Item{
+		{GUID: "g2", Title: "t2", Description: "d2", UpdatedParsed: tm("2021-01-02T00:00:00Z")},
+		{GUID: "g1", Title: "t1", Description: "d1", UpdatedParsed: tm("2021-01-01T00:00:00Z")},
+		{GUID: "g0", Title: "t0", Description: "d0"},
+	}}
+	n := Notify{Feed: "f1", Updates: true}
+	st := state{}
+	events, err := n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "first run")
+	assert.Equal(t, 3, len(st.Revisions))
+
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "nothing changed")
+
+	feed.Items[0].Description = "d2, 5 comments"                                  // g2 changed, without newer update time
+	feed.Items[1].UpdatedParsed = tm("2021-01-03T00:00:00Z")                      // g1 updated
+	feed.Items[1].Description = "d1 changed"                                      // g1 changed
+	feed.Items[2].Description = "d0 changed"                                      // g0 changed, no update time at all
+	feed.Items = append([]*gofeed.Item{{GUID: "g3", Title: "t3"}}, feed.Items...) // new item
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(events))
+	assert.Equal(t, "t3", events[0].Title)
+	assert.False(t, events[0].Update)
+	assert.Equal(t, "t0", events[1].Title)
+	assert.True(t, events[1].Update)
+	assert.Equal(t, "t1", events[2].Title)
+	assert.True(t, events[2].Update)
+	assert.NotEqual(t, st.Revisions["g1"].Hash, events[2].Version, "revision recorded when event sent")
+	for _, ev := range events {
+		st.markSeen(ev.ID)
+		st.setRevision(ev.ID, revision{Updated: ev.Updated, Hash: ev.Version})
+	}
+
+	feed.Items[2].UpdatedParsed = tm("2021-01-04T00:00:00Z")
+	feed.Items[2].Description = "<p>d1 \n changed</p>" // markup and whitespace changed only
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "same text is not an update")
+
+	feed.Items[2].UpdatedParsed = tm("2021-01-02T00:00:00Z")
+	feed.Items[2].Description = "d1 rolled back"
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "rolled back update time is not an update")
+
+	n = Notify{Feed: "f1"}
+	feed.Items[2].UpdatedParsed = tm("2021-01-05T00:00:00Z")
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "updates ignored")
+
+	n = Notify{Feed: "f1", Updates: true}
+	st = state{Seen: []string{"g0", "g1", "g2", "g3"}}
+	events, err = n.feedEvents(feed, &st)
+	require.NoError(t, err)
+	assert.Empty(t, events, "no revisions kept before")
+	assert.Equal(t, 4, len(st.Revisions))
+}
+
+func TestStateRevisions(t *testing.T) {
+	s := state{}
+	for i := 0; i < maxSeen+10; i++ {
+		s.markSeen(fmt.Sprintf("guid-%d", i))
+		s.setRevision(fmt.Sprintf("guid-%d", i), revision{Hash: "v1"})
+	}
+	assert.Equal(t, maxSeen, len(s.Revisions))
+	assert.Equal(t, "v1", s.Revisions["guid-10"].Hash)
+	_, ok := s.Revisions["guid-9"]
+	assert.False(t, ok, "dropped with seen id")
+}
@@ -0,0 +1,152 @@
+package rss
+
+import (
+	"encoding/xml"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	maxBackoff     = time.Hour     // max delay between fetches of failing feed
+	maxAdaptive    = 6 * time.Hour // max refresh interval of adaptive schedule
+	adaptiveItems  = 10            // number of the most recent items used to learn publishing cadence
+	adaptiveChecks = 4             // number of checks per typical interval between items
+
+	defaultDegradedAfter = 5 // number of consecutive failures making feed degraded, if DegradedAfter not set
+)
+
+// Health of the notifier
+type Health struct {
+	Degraded    bool      // true after DegradedAfter consecutive failures, till the next successful fetch
+	Failures    int       // number of consecutive fetch failures
+	LastError   string    // error of the last failed fetch
+	LastSuccess time.Time // time of the last successful fetch, zero if none
+}
+
+// Health returns the current health of the notifier
+func (n *Notify) Health() Health {
+	n.healthMu.Lock()
+	defer n.healthMu.Unlock()
+	return n.health
+}
+
+// setHealth updates health after fetch and returns the updated one.
+// Degradation and recovery logged once, repeated failures of degraded feed logged as debug.
+func (n *Notify) setHealth(err error) Health {
+	n.healthMu.Lock()
+	defer n.healthMu.Unlock()
+	if err == nil {
+		if n.health.Degraded {
+			log.Printf("[INFO] feed %s recovered after %d failures", n.Feed, n.health.Failures)
+		}
+		n.health = Health{LastSuccess: time.Now()}
+		return n.health
+	}
+
+	n.health.Failures++
+	n.health.LastError = err.Error()
+	switch {
+	case n.health.Degraded:
+		log.Printf("[DEBUG] failed to fetch/parse url from %s, %d failures, %v", n.Feed, n.health.Failures, err)
+	case n.health.Failures >= n.degradedAfter():
+		n.health.Degraded = true
+		log.Printf("[WARN] feed %s degraded, %d consecutive failures, %v", n.Feed, n.health.Failures, err)
+	default:
+		log.Printf("[WARN] failed to fetch/parse url from %s, %v", n.Feed, err)
+	}
+	return n.health
+}
+
+// degradedAfter returns number of consecutive failures making feed degraded
+func (n *Notify) degradedAfter() int {
+	if n.DegradedAfter <= 0 {
+		return defaultDegradedAfter
+	}
+	return n.DegradedAfter
+}
+
+// backoff returns delay after consecutive failures, doubled from Duration with each failure up to maxBackoff.
+// Random jitter, up to half of the delay, added so feeds failed at the same time are not retried together.
+func (n *Notify) backoff(failures int) time.Duration {
+	d := n.Duration
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff && n.Duration < maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // nolint
+}
+
+// adaptiveInterval returns refresh interval learned from the feed. Update period declared by the feed with
+// ttl or sy:updatePeriod used if defined, a fraction of the median interval between recent items otherwise.
+// Result is between Duration and maxAdaptive, Duration if nothing learned.
+func (n *Notify) adaptiveInterval(body []byte, feed *gofeed.Feed) time.Duration {
+	res := declaredPeriod(body)
+	if res == 0 {
+		res = medianInterval(feed) / adaptiveChecks
+	}
+	switch {
+	case res < n.Duration:
+		return n.Duration
+	case res > maxAdaptive:
+		return maxAdaptive
+	}
+	return res
+}
+
+// declaredPeriod returns update period declared by rss channel, with ttl (minutes) or sy:updatePeriod and
+// sy:updateFrequency. Zero if not declared.
+func declaredPeriod(body []byte) time.Duration {
+	var ttl, period time.Duration
+	frequency := 1
+	periods := map[string]time.Duration{"hourly": time.Hour, "daily": 24 * time.Hour, "weekly": 7 * 24 * time.Hour,
+		"monthly": 30 * 24 * time.Hour, "yearly": 365 * 24 * time.Hour}
+	scanChannel(body, func(el xml.StartElement, text func() string) {
+		switch el.Name.Local {
+		case "ttl":
+			if mins, err := strconv.Atoi(text()); err == nil && mins > 0 {
+				ttl = time.Duration(mins) * time.Minute
+			}
+		case "updatePeriod":
+			period = periods[strings.ToLower(text())]
+		case "updateFrequency":
+			if f, err := strconv.Atoi(text()); err == nil && f > 0 {
+				frequency = f
+			}
+		}
+	})
+	if ttl > 0 {
+		return ttl
+	}
+	return period / time.Duration(frequency)
+}
+
+// medianInterval returns median interval between publication times of the most recent items, zero if unknown
+func medianInterval(feed *gofeed.Feed) time.Duration {
+	times := []time.Time{}
+	for _, item := range feed.Items {
+		if item.PublishedParsed != nil {
+			times = append(times, *item.PublishedParsed)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	if len(times) > adaptiveItems {
+		times = times[:adaptiveItems]
+	}
+	if len(times) < 2 {
+		return 0
+	}
+	intervals := make([]time.Duration, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		intervals = append(intervals, times[i-1].Sub(times[i]))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	return intervals[len(intervals)/2]
+}
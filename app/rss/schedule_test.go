@@ -0,0 +1,108 @@
+package rss
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyHealth(t *testing.T) {
+	var reqs, failing int32 = 0, 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, err := os.ReadFile("testdata/f1.xml")
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := Notify{Feed: ts.URL, Duration: time.Millisecond, Timeout: time.Second, DegradedAfter: 3}
+	ch := notify.Go(ctx)
+	assert.Eventually(t, func() bool { return notify.Health().Degraded }, 5*time.Second, time.Millisecond)
+	h := notify.Health()
+	assert.True(t, h.Failures >= 3)
+	assert.Equal(t, "status 500 Internal Server Error", h.LastError)
+	assert.True(t, h.LastSuccess.IsZero())
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Eventually(t, func() bool { return !notify.Health().Degraded }, 5*time.Second, time.Millisecond)
+	h = notify.Health()
+	assert.Equal(t, 0, h.Failures)
+	assert.False(t, h.LastSuccess.IsZero())
+	cancel()
+	for range ch {
+	}
+}
+
+func TestNotifyBackoff(t *testing.T) {
+	n := Notify{Duration: 30 * time.Second}
+	tbl := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, 30 * time.Second}, {2, time.Minute}, {3, 2 * time.Minute}, {8, maxBackoff}, {100, maxBackoff},
+	}
+	for _, tt := range tbl {
+		for i := 0; i < 10; i++ {
+			d := n.backoff(tt.failures)
+			assert.True(t, d >= tt.max/2 && d <= tt.max, "%d failures, %v", tt.failures, d)
+		}
+	}
+
+	n = Notify{Duration: 2 * time.Hour}
+	d := n.backoff(5)
+	assert.True(t, d >= time.Hour && d <= 2*time.Hour, "refresh longer than max backoff not shortened, %v", d)
+}
+
+func TestAdaptiveInterval(t *testing.T) {
+	f1, err := os.ReadFile("testdata/f1.xml")
+	require.NoError(t, err)
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(f1))
+	require.NoError(t, err)
+	assert.InDelta(t, float64(7*24*time.Hour), float64(medianInterval(feed)), float64(time.Hour), "weekly podcast")
+
+	n := Notify{Duration: 30 * time.Second}
+	assert.Equal(t, maxAdaptive, n.adaptiveInterval(f1, feed))
+
+	ttl := []byte(`<rss><channel><ttl>60</ttl><item><title>i1</title></item></channel></rss>`)
+	assert.Equal(t, time.Hour, n.adaptiveInterval(ttl, &gofeed.Feed{}))
+	n = Notify{Duration: 2 * time.Hour}
+	assert.Equal(t, 2*time.Hour, n.adaptiveInterval(ttl, &gofeed.Feed{}), "not less than refresh")
+	n = Notify{Duration: time.Minute}
+	assert.Equal(t, time.Minute, n.adaptiveInterval([]byte(`<rss><channel></channel></rss>`), &gofeed.Feed{}),
+		"nothing learned")
+}
+
+func TestDeclaredPeriod(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res time.Duration
+	}{
+		{`<rss><channel><title>t</title></channel></rss>`, 0},
+		{`<rss><channel><ttl>30</ttl></channel></rss>`, 30 * time.Minute},
+		{`<rss><channel><ttl>bad</ttl></channel></rss>`, 0},
+		{`<rss xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><sy:updatePeriod>hourly</sy:updatePeriod>` +
+			`<sy:updateFrequency>2</sy:updateFrequency></channel></rss>`, 30 * time.Minute},
+		{`<rss xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><sy:updatePeriod>daily</sy:updatePeriod>` +
+			`</channel></rss>`, 24 * time.Hour},
+		{`<rss><channel><item><ttl>30</ttl></item></channel></rss>`, 0},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, declaredPeriod([]byte(tt.inp)), tt.inp)
+	}
+}
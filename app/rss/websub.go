@@ -0,0 +1,329 @@
+package rss
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // nolint
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+const (
+	websubLease     = 10 * 24 * time.Hour // default lease requested from hub
+	websubRetry     = time.Hour           // subscription requested again if not verified by hub in this time
+	websubDiscovery = 24 * time.Hour      // hub discovered again after this time, if feed had no hub or subscription failed
+	websubMaxBody   = 10 * 1024 * 1024    // max size of content pushed by hub
+	websubUpdateBuf = 10                  // number of pushed updates buffered for notifier
+)
+
+// WebSub is callback endpoint of WebSub (PubSubHubbub) subscriptions. Notifier with WebSub discovers the hub
+// advertised by the feed, subscribes to it and gets updates pushed by the hub instead of polling.
+// Polling used if the feed has no hub, or while subscription is not verified or expired.
+type WebSub struct {
+	URL    string        // public url of the callback endpoint, served by ServeHTTP, subscription id appended to it
+	Lease  time.Duration // lease requested from hub, hub may grant a different one, 10 days if not set
+	Client *http.Client  // client for hub requests, with 10s timeout if not set
+
+	once sync.Once
+	mu   sync.Mutex
+	subs map[string]*subscription // keyed by subscription id
+}
+
+// subscription to the topic on the hub
+type subscription struct {
+	id, hub, topic string
+	secret         string      // secret for content signature, empty for http hubs
+	updates        chan []byte // content pushed by hub
+
+	mu        sync.Mutex
+	mode      string // mode requested from hub, "subscribe" or "unsubscribe"
+	requested time.Time
+	lease     time.Duration // lease granted by hub, zero until verified
+	expires   time.Time
+	denied    bool
+}
+
+func (w *WebSub) init() {
+	w.subs = map[string]*subscription{}
+	if w.Lease == 0 {
+		w.Lease = websubLease
+	}
+	if w.Client == nil {
+		w.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+}
+
+// ServeHTTP handles intent verification (GET) and content distribution (POST) requests from hubs
+func (w *WebSub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.once.Do(w.init)
+	w.mu.Lock()
+	sub, ok := w.subs[path.Base(r.URL.Path)]
+	w.mu.Unlock()
+	if !ok {
+		http.Error(rw, "unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		challenge, err := w.verify(sub, r.URL.Query())
+		if err != nil {
+			log.Printf("[WARN] websub verification of %s failed, %v", sub.topic, err)
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(challenge))
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, websubMaxBody))
+		if err != nil {
+			http.Error(rw, "can't read body", http.StatusBadRequest)
+			return
+		}
+		// invalid content ignored, but accepted as required by spec
+		rw.WriteHeader(http.StatusAccepted)
+		if sub.secret != "" && !validSignature(r.Header.Get("X-Hub-Signature"), sub.secret, body) {
+			log.Printf("[WARN] websub content for %s ignored, bad signature", sub.topic)
+			return
+		}
+		log.Printf("[DEBUG] websub content for %s, %d bytes", sub.topic, len(body))
+		select {
+		case sub.updates <- body:
+		default:
+			log.Printf("[WARN] websub content for %s dropped, too many pending updates", sub.topic)
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify checks intent verification request of the hub and returns challenge to confirm it
+func (w *WebSub) verify(sub *subscription, q url.Values) (string, error) {
+	if q.Get("hub.topic") != sub.topic {
+		return "", errors.Errorf("unexpected topic %q", q.Get("hub.topic"))
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	mode := q.Get("hub.mode")
+	switch {
+	case mode == "denied":
+		log.Printf("[WARN] websub subscription to %s denied by %s, %s", sub.topic, sub.hub, q.Get("hub.reason"))
+		sub.denied = true
+		return "", nil
+	case mode != sub.mode:
+		return "", errors.Errorf("unexpected mode %q", mode)
+	case q.Get("hub.challenge") == "":
+		return "", errors.New("no challenge")
+	case mode == "unsubscribe":
+		w.mu.Lock()
+		delete(w.subs, sub.id)
+		w.mu.Unlock()
+		log.Printf("[INFO] websub unsubscribed from %s", sub.topic)
+		return q.Get("hub.challenge"), nil
+	}
+	sub.lease = w.Lease
+	if secs, err := strconv.Atoi(q.Get("hub.lease_seconds")); err == nil && secs > 0 {
+		sub.lease = time.Duration(secs) * time.Second
+	}
+	sub.expires = time.Now().Add(sub.lease)
+	log.Printf("[INFO] websub subscribed to %s on %s, lease %v", sub.topic, sub.hub, sub.lease)
+	return q.Get("hub.challenge"), nil
+}
+
+// subscribe requests subscription to the topic from the hub. Subscription is active after hub's verification.
+func (w *WebSub) subscribe(hub, topic string) (*subscription, error) {
+	w.once.Do(w.init)
+	sub := &subscription{id: randomHex(16), hub: hub, topic: topic, updates: make(chan []byte, websubUpdateBuf)}
+	if strings.HasPrefix(hub, "https://") { // secret should be sent to https hub only
+		sub.secret = randomHex(32)
+	}
+	w.mu.Lock()
+	w.subs[sub.id] = sub
+	w.mu.Unlock()
+	return sub, w.request(sub, "subscribe")
+}
+
+// renew requests subscription again, to extend the lease or if the previous request not verified
+func (w *WebSub) renew(sub *subscription) error {
+	return w.request(sub, "subscribe")
+}
+
+// unsubscribe requests hub to stop the subscription, updates not delivered to notifier anymore
+func (w *WebSub) unsubscribe(sub *subscription) {
+	if err := w.request(sub, "unsubscribe"); err != nil {
+		log.Printf("[WARN] can't unsubscribe from %s, %v", sub.topic, err)
+		w.mu.Lock()
+		delete(w.subs, sub.id)
+		w.mu.Unlock()
+	}
+}
+
+// request sends subscription request to the hub, hub verifies it asynchronously with callback
+func (w *WebSub) request(sub *subscription, mode string) error {
+	sub.mu.Lock()
+	sub.mode, sub.requested = mode, time.Now()
+	sub.mu.Unlock()
+
+	form := url.Values{"hub.callback": {strings.TrimSuffix(w.URL, "/") + "/" + sub.id}, "hub.mode": {mode},
+		"hub.topic": {sub.topic}}
+	if mode == "subscribe" {
+		form.Set("hub.lease_seconds", strconv.Itoa(int(w.Lease.Seconds())))
+		if sub.secret != "" {
+			form.Set("hub.secret", sub.secret)
+		}
+	}
+	resp, err := w.Client.PostForm(sub.hub, form)
+	if err != nil {
+		return errors.Wrapf(err, "can't send %s request to %s", mode, sub.hub)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s request to %s failed, status %s, %s", mode, sub.hub, resp.Status, strings.TrimSpace(string(body)))
+	}
+	log.Printf("[DEBUG] websub %s request for %s sent to %s", mode, sub.topic, sub.hub)
+	return nil
+}
+
+// active checks if subscription verified by hub and its lease not expired
+func (s *subscription) active() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.denied && time.Now().Before(s.expires)
+}
+
+// renewDue checks if subscription should be requested again, i.e. lease expires soon or request not verified
+func (s *subscription) renewDue() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.denied {
+		return false
+	}
+	if s.lease == 0 || time.Now().After(s.expires) {
+		return time.Since(s.requested) > websubRetry
+	}
+	return time.Until(s.expires) < s.lease/10
+}
+
+// discoverHub finds hub and self (topic) urls in Link headers or feed's link elements, rel="hub" and rel="self".
+// Only channel level links checked, search stops on the first item. Empty hub returned if not advertised.
+func discoverHub(header http.Header, body []byte) (hub, self string) {
+	for _, h := range header.Values("Link") {
+		for _, l := range strings.Split(h, ",") {
+			parts := strings.Split(l, ";")
+			href := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if !strings.HasPrefix(p, "rel=") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimPrefix(p, "rel="), `"`)) {
+					if rel == "hub" && hub == "" {
+						hub = href
+					}
+					if rel == "self" && self == "" {
+						self = href
+					}
+				}
+			}
+		}
+	}
+	if hub != "" {
+		return hub, self
+	}
+
+	scanChannel(body, func(el xml.StartElement, _ func() string) {
+		if el.Name.Local != "link" {
+			return
+		}
+		var rel, href string
+		for _, a := range el.Attr {
+			switch a.Name.Local {
+			case "rel":
+				rel = a.Value
+			case "href":
+				href = strings.TrimSpace(a.Value)
+			}
+		}
+		if rel == "hub" && hub == "" {
+			hub = href
+		}
+		if rel == "self" && self == "" {
+			self = href
+		}
+	})
+	return hub, self
+}
+
+// scanChannel calls visit for each channel (feed) level element of rss or atom document, till the first item.
+// Visitor can get text content of the element with text function.
+func scanChannel(body []byte, visit func(el xml.StartElement, text func() string)) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if el.Name.Local == "item" || el.Name.Local == "entry" {
+			return
+		}
+		visit(el, func() string {
+			var text string
+			if err := dec.DecodeElement(&text, &el); err != nil {
+				return ""
+			}
+			return strings.TrimSpace(text)
+		})
+	}
+}
+
+// validSignature checks X-Hub-Signature header, "method=hex(hmac(secret, body))"
+func validSignature(signature, secret string, body []byte) bool {
+	parts := strings.SplitN(signature, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	hashes := map[string]func() hash.Hash{"sha1": sha1.New, "sha256": sha256.New, "sha384": sha512.New384, "sha512": sha512.New}
+	h, ok := hashes[parts[0]]
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	_, _ = mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// randomHex makes random hex string of n bytes
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("[WARN] can't make random string, %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,210 @@
+package rss
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyWebSub(t *testing.T) {
+	f1, err := os.ReadFile("testdata/f1.xml")
+	require.NoError(t, err)
+	f2, err := os.ReadFile("testdata/f2.xml")
+	require.NoError(t, err)
+
+	ws := &WebSub{}
+	cb := httptest.NewServer(ws)
+	defer cb.Close()
+	ws.URL = cb.URL + "/websub/"
+
+	var mu sync.Mutex
+	var modes []string
+	verify := func(form url.Values, challenge string) {
+		q := url.Values{"hub.mode": {form.Get("hub.mode")}, "hub.topic": {form.Get("hub.topic")},
+			"hub.challenge": {challenge}, "hub.lease_seconds": {"3600"}}
+		resp, err := http.Get(form.Get("hub.callback") + "?" + q.Encode())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, challenge, string(body))
+	}
+	push := func(form url.Values, signature string) {
+		req, err := http.NewRequest(http.MethodPost, form.Get("hub.callback"), strings.NewReader(string(f2)))
+		require.NoError(t, err)
+		req.Header.Set("X-Hub-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+	hub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		modes = append(modes, r.Form.Get("hub.mode"))
+		mu.Unlock()
+		assert.Equal(t, "http://example.com/self", r.Form.Get("hub.topic"))
+		w.WriteHeader(http.StatusAccepted)
+		form := r.Form
+		if form.Get("hub.mode") == "unsubscribe" {
+			go verify(form, "bye")
+			return
+		}
+		assert.Equal(t, "864000", form.Get("hub.lease_seconds"))
+		require.NotEmpty(t, form.Get("hub.secret"), "secret sent to https hub")
+		go func() {
+			verify(form, "hello")
+			push(form, "sha256=0123") // bad signature, ignored
+			mac := hmac.New(sha256.New, []byte(form.Get("hub.secret")))
+			_, _ = mac.Write(f2)
+			push(form, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}()
+	}))
+	defer hub.Close()
+	ws.Client = hub.Client()
+
+	var fetches int32
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Add("Link", `<`+hub.URL+`>; rel="hub"`)
+		w.Header().Add("Link", `<http://example.com/self>; rel="self"`)
+		_, _ = w.Write(f1)
+	}))
+	defer feed.Close()
+
+	notify := Notify{Feed: feed.URL, Duration: 50 * time.Millisecond, Timeout: time.Second, WebSub: ws}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := notify.Go(ctx)
+
+	select {
+	case e := <-ch:
+		assert.Equal(t, "Радио-Т 626", e.Title, "event from pushed content")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pushed event")
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "no polling while subscribed")
+
+	cancel()
+	for range ch {
+	}
+	assert.Eventually(t, func() bool {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		return len(ws.subs) == 0
+	}, time.Second, 10*time.Millisecond, "unsubscribed and verified")
+	mu.Lock()
+	assert.Equal(t, []string{"subscribe", "unsubscribe"}, modes)
+	mu.Unlock()
+}
+
+func TestNotifyWebSubNoHub(t *testing.T) {
+	var fetches, conditional int32
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>t</title><link>https://example.com</link>` +
+			`<item><title>i1</title><guid>g1</guid></item></channel></rss>`))
+	}))
+	defer feed.Close()
+
+	ws := &WebSub{URL: "http://127.0.0.1/websub"}
+	notify := Notify{Feed: feed.URL, Duration: 20 * time.Millisecond, Timeout: time.Second, WebSub: ws}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	for range notify.Go(ctx) {
+	}
+	assert.True(t, atomic.LoadInt32(&fetches) > 3, "polling")
+	assert.Equal(t, atomic.LoadInt32(&fetches)-1, atomic.LoadInt32(&conditional), "only the first fetch is full")
+	assert.Equal(t, 0, len(ws.subs))
+}
+
+func TestWebSubVerify(t *testing.T) {
+	ws := &WebSub{URL: "http://example.com/cb"}
+	ws.once.Do(ws.init)
+	sub := &subscription{id: "id1", hub: "http://hub", topic: "http://example.com/feed", mode: "subscribe",
+		updates: make(chan []byte, 1)}
+	ws.subs["id1"] = sub
+
+	check := func(path string, q url.Values, code int, body string) {
+		rec := httptest.NewRecorder()
+		ws.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+q.Encode(), nil))
+		assert.Equal(t, code, rec.Code, q)
+		if code == http.StatusOK {
+			assert.Equal(t, body, rec.Body.String())
+		}
+	}
+	check("/cb/other", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {sub.topic}, "hub.challenge": {"c1"}},
+		http.StatusNotFound, "")
+	check("/cb/id1", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://other"}, "hub.challenge": {"c1"}},
+		http.StatusNotFound, "")
+	check("/cb/id1", url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {sub.topic}, "hub.challenge": {"c1"}},
+		http.StatusNotFound, "")
+	assert.False(t, sub.active())
+
+	check("/cb/id1", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {sub.topic}, "hub.challenge": {"c1"},
+		"hub.lease_seconds": {"1000"}}, http.StatusOK, "c1")
+	assert.True(t, sub.active())
+	assert.False(t, sub.renewDue())
+	sub.expires = time.Now().Add(99 * time.Second)
+	assert.True(t, sub.renewDue(), "less than 10% of lease left")
+
+	check("/cb/id1", url.Values{"hub.mode": {"denied"}, "hub.topic": {sub.topic}, "hub.reason": {"no way"}},
+		http.StatusOK, "")
+	assert.False(t, sub.active())
+	assert.False(t, sub.renewDue())
+}
+
+func TestDiscoverHub(t *testing.T) {
+	f1, err := os.ReadFile("testdata/f1.xml")
+	require.NoError(t, err)
+	hub, self := discoverHub(http.Header{}, f1)
+	assert.Equal(t, "http://pubsubhubbub.appspot.com/", hub)
+	assert.Equal(t, "http://feeds.feedburner.com/radio-t", self)
+
+	header := http.Header{"Link": {`<https://hub.example.com/>; rel="hub", <https://example.com/feed>; rel="self"`}}
+	hub, self = discoverHub(header, f1)
+	assert.Equal(t, "https://hub.example.com/", hub, "header preferred")
+	assert.Equal(t, "https://example.com/feed", self)
+
+	atom := `<feed xmlns="http://www.w3.org/2005/Atom"><title>t</title><link href="https://example.com/"/>` +
+		`<entry><link rel="hub" href="https://hub.example.com/"/></entry></feed>`
+	hub, _ = discoverHub(http.Header{}, []byte(atom))
+	assert.Equal(t, "", hub, "links of entries ignored")
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte("content")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+	assert.True(t, validSignature("sha256="+sig, "secret", body))
+	assert.False(t, validSignature("sha256="+sig, "other", body))
+	assert.False(t, validSignature("md5="+sig, "secret", body))
+	assert.False(t, validSignature("sha256=zz", "secret", body))
+	assert.False(t, validSignature("", "secret", body))
+}
@@ -0,0 +1,138 @@
+// Package store implements persistent key-value storage for the service state.
+// Values are grouped in buckets and kept json-encoded, similar to BoltDB-style local KV.
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Interface defines bucketed key-value storage
+type Interface interface {
+	Load(bucket, key string, v interface{}) (found bool, err error)
+	Save(bucket, key string, v interface{}) error
+	Delete(bucket, key string) error
+	Keys(bucket string) ([]string, error)
+}
+
+// Memory implements Interface with in-memory map, nothing persisted
+type Memory struct {
+	mu   sync.RWMutex
+	data map[string]map[string]json.RawMessage
+}
+
+// Load value for bucket and key to v, returns false if not found
+func (m *Memory) Load(bucket, key string, v interface{}) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	raw, ok := m.data[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, errors.Wrapf(err, "can't unmarshal %s/%s", bucket, key)
+	}
+	return true, nil
+}
+
+// Save v for bucket and key, overwrites existing value
+func (m *Memory) Save(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal %s/%s", bucket, key)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = map[string]map[string]json.RawMessage{}
+	}
+	if _, ok := m.data[bucket]; !ok {
+		m.data[bucket] = map[string]json.RawMessage{}
+	}
+	m.data[bucket][key] = raw
+	return nil
+}
+
+// Delete key from bucket, no error if missing
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data[bucket], key)
+	return nil
+}
+
+// Keys returns sorted list of all keys in bucket
+func (m *Memory) Keys(bucket string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make([]string, 0, len(m.data[bucket]))
+	for k := range m.data[bucket] {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// File implements Interface with all the data kept in memory and flushed to json file on every change.
+// The file is written to temp location and renamed, so partial writes never corrupt the state.
+type File struct {
+	Memory
+	path    string
+	flushMu sync.Mutex
+}
+
+// NewFile makes File store and loads its content from path, if exists
+func NewFile(path string) (*File, error) {
+	res := File{path: path}
+	content, err := os.ReadFile(path) // nolint
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &res, nil
+		}
+		return nil, errors.Wrapf(err, "can't read %s", path)
+	}
+	if err := json.Unmarshal(content, &res.data); err != nil {
+		return nil, errors.Wrapf(err, "can't parse %s", path)
+	}
+	return &res, nil
+}
+
+// Save v for bucket and key and flush the file
+func (f *File) Save(bucket, key string, v interface{}) error {
+	if err := f.Memory.Save(bucket, key, v); err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+// Delete key from bucket and flush the file
+func (f *File) Delete(bucket, key string) error {
+	if err := f.Memory.Delete(bucket, key); err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+func (f *File) flush() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+	f.mu.RLock()
+	content, err := json.Marshal(f.data)
+	f.mu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "can't marshal store")
+	}
+	if err = os.MkdirAll(filepath.Dir(f.path), 0o750); err != nil {
+		return errors.Wrapf(err, "can't make directory for %s", f.path)
+	}
+	tmp := f.path + ".tmp"
+	if err = os.WriteFile(tmp, content, 0o600); err != nil {
+		return errors.Wrapf(err, "can't write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, f.path), "can't rename %s", tmp)
+}
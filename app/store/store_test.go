@@ -0,0 +1,65 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	m := Memory{}
+	var v []string
+	found, err := m.Load("b1", "k1", &v)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, m.Save("b1", "k1", []string{"a", "b"}))
+	require.NoError(t, m.Save("b1", "k2", []string{"c"}))
+	require.NoError(t, m.Save("b2", "k1", []string{"d"}))
+
+	found, err = m.Load("b1", "k1", &v)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"a", "b"}, v)
+
+	keys, err := m.Keys("b1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k1", "k2"}, keys)
+
+	require.NoError(t, m.Delete("b1", "k1"))
+	require.NoError(t, m.Delete("b1", "k-missing"))
+	keys, err = m.Keys("b1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2"}, keys)
+
+	var i int
+	_, err = m.Load("b1", "k2", &i)
+	assert.Error(t, err, "wrong type")
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "state.json")
+	f, err := NewFile(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Save("b1", "k1", map[string]int{"a": 1}))
+	require.NoError(t, f.Save("b1", "k2", map[string]int{"b": 2}))
+	require.NoError(t, f.Delete("b1", "k2"))
+
+	f2, err := NewFile(path)
+	require.NoError(t, err)
+	var v map[string]int
+	found, err := f2.Load("b1", "k1", &v)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, map[string]int{"a": 1}, v)
+	found, err = f2.Load("b1", "k2", &v)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, os.WriteFile(path, []byte("bad json"), 0o600))
+	_, err = NewFile(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/umputun/rss2twitter/app/config"
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+const (
+	shortLinkLen   = 30 // max length of host and path shown by shorten template function, only host shown if longer
+	checkTmplItems = 5  // number of the latest feed items rendered by --check-template
+)
+
+// templateFuncs are functions available in message templates
+var templateFuncs = template.FuncMap{
+	"hashtags":     hashtags,
+	"truncate":     truncate,
+	"lower":        strings.ToLower,
+	"upper":        strings.ToUpper,
+	"title":        title,
+	"replace":      func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"regexReplace": regexReplace,
+	"default":      defaultValue,
+	"date":         date,
+	"shorten":      shorten,
+}
+
+// msgTemplate is message template compiled once, source kept for message length calculation
+type msgTemplate struct {
+	*template.Template
+	src string
+}
+
+// sampleEvent used to check templates, has all fields set
+var sampleEvent = rss.Event{
+	Feed:          "https://example.com/rss",
+	ChanTitle:     "Example Blog",
+	ChanLink:      "https://example.com",
+	Title:         "Sample title",
+	Link:          "https://example.com/posts/1",
+	Text:          "Sample text of the post.",
+	GUID:          "https://example.com/posts/1",
+	Published:     time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC),
+	Updated:       time.Date(2024, 5, 17, 11, 0, 0, 0, time.UTC),
+	Author:        "John Doe",
+	Categories:    []string{"first", "second", "third"},
+	EnclosureURL:  "https://example.com/posts/1.mp3",
+	EnclosureType: "audio/mpeg",
+	Duration:      "1:02:03",
+	Images:        []rss.Image{{URL: "https://example.com/posts/1.jpg", Type: "image/jpeg", Alt: "Sample image"}},
+	ChanImage:     &rss.Image{URL: "https://example.com/logo.png", Alt: "Example Blog"},
+}
+
+// newTemplate compiles message template and checks it with sample event. Syntax errors, unknown functions
+// and references to unknown fields reported as error.
+func newTemplate(src string) (*msgTemplate, error) {
+	tmpl, err := template.New("msg").Funcs(templateFuncs).Parse(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse template %q", src)
+	}
+	// index out of range depends on the item, i.e. {{index .Categories 5}}, not an error of the template
+	if err = tmpl.Execute(io.Discard, sampleEvent); err != nil && !strings.Contains(err.Error(), "index out of range") {
+		return nil, errors.Wrapf(err, "can't apply template %q to sample event", src)
+	}
+	return &msgTemplate{Template: tmpl, src: src}, nil
+}
+
+// String returns template source
+func (t *msgTemplate) String() string {
+	return t.src
+}
+
+// checkTemplate renders the latest items of the feed with its template to w, as they would be published to each
+// destination of the feed, with its limits. Feed taken from config file if defined, from command line options otherwise.
+func checkTemplate(o opts, w io.Writer) error {
+	pubConfs := map[string]config.Publisher{"twitter": {Type: config.TypeTwitter}}
+	if o.Config == "" {
+		o.Feeds = []string{o.CheckTmpl}
+	}
+	if o.Config != "" {
+		conf, err := config.Load(o.Config)
+		if err != nil {
+			return err
+		}
+		pubConfs = conf.Publishers
+	}
+	o.Dry = true // nothing published by preview
+	feeds, err := setup(o, &store.Memory{}, nil, &pubSet{})
+	if err != nil {
+		return err
+	}
+	for _, f := range feeds {
+		if f.conf.URL != o.CheckTmpl {
+			continue
+		}
+		n := rss.Notify{Feed: f.conf.URL, Timeout: f.conf.Timeout}
+		events, err := n.Latest(checkTmplItems)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "template %q, %d latest items of %s\n", f.tmpl, len(events), f.conf.URL) // nolint
+		for _, name := range f.conf.PublisherNames() {
+			lim, err := previewLimits(pubConfs[name])
+			if err != nil {
+				return errors.Wrapf(err, "can't get limits of publisher %s", name)
+			}
+			fmt.Fprintf(w, "\n== %s (%s), max length %d\n", name, pubConfs[name].Type, lim.MaxLen) // nolint
+			for _, ev := range events {
+				msgs := []string{formatMsg(ev, f.tmpl, lim)}
+				if f.conf.Thread {
+					msgs = formatThread(ev, f.tmpl, lim, f.conf.ThreadLink == config.ThreadLinkLast)
+				}
+				fmt.Fprintf(w, "\n%s\n", strings.Join(msgs, "\n\n")) // nolint
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("feed %s not defined in %s", o.CheckTmpl, o.Config)
+}
+
+// previewLimits returns limits of publisher made for config, twitter limits if publisher doesn't report them.
+// Nothing published with it, so credentials are not used.
+func previewLimits(p config.Publisher) (publisher.Limits, error) {
+	pub, err := makePublisher(p, &store.Memory{})
+	if err != nil {
+		return publisher.Limits{}, err
+	}
+	if l, ok := pub.(publisher.Limiter); ok {
+		return l.Limits(), nil
+	}
+	return publisher.TwitterLimits, nil
+}
+
+// hashtags makes space separated hashtags from categories, i.e. "#golang #MachineLearning".
+// Multi-word categories joined in camel case, characters not allowed in hashtags dropped, duplicates skipped.
+func hashtags(categories []string) string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, c := range categories {
+		var b strings.Builder
+		for _, word := range strings.FieldsFunc(c, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' }) {
+			if len(strings.Fields(c)) > 1 {
+				word = title(word)
+			}
+			b.WriteString(word)
+		}
+		tag := b.String()
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		res = append(res, "#"+tag)
+	}
+	return strings.Join(res, " ")
+}
+
+// truncate cuts s to max runes on the word boundary, with "..." at the end if cut
+func truncate(max int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	snippet := runes[:max-3]
+	if !unicode.IsSpace(runes[max-3]) { // snippet ends inside the word, cut to the previous one
+		for i := len(snippet) - 1; i > 0; i-- {
+			if unicode.IsSpace(snippet[i]) {
+				snippet = snippet[:i]
+				break
+			}
+		}
+	}
+	return strings.TrimRightFunc(string(snippet), unicode.IsSpace) + "..."
+}
+
+// title makes the first letter of each word upper case
+func title(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) || runes[i-1] == '-' {
+			runes[i] = unicode.ToTitle(r)
+		}
+	}
+	return string(runes)
+}
+
+// regexReplace replaces all matches of regular expression in s, repl can refer to groups as $1
+func regexReplace(expr, repl, s string) (string, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// defaultValue returns def if v is empty, i.e. empty string, empty list or zero time, v otherwise
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
+
+// date formats time with go layout, i.e. "2006-01-02", empty for zero time
+func date(layout string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(layout)
+}
+
+// shorten makes short readable form of the link for display, without scheme. Destinations turn it into a link,
+// so it is never cut to a broken one: host and path shown if they fit shortLinkLen and the link has no query,
+// only host otherwise. Not a replacement of the link, .Link should be in the message to lead to the item.
+func shorten(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return link
+	}
+	res := u.Host + strings.TrimSuffix(u.Path, "/")
+	if u.RawQuery != "" || utf8.RuneCountInString(res) > shortLinkLen {
+		return u.Host
+	}
+	return res
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/rss"
+	"github.com/umputun/rss2twitter/app/store"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	ev := rss.Event{Title: "Hello world", Link: "https://www.example.com/blog/2024/05/17/some-very-long-post-name/?utm=1",
+		Text: "Some text for the post", Categories: []string{"golang", "machine learning", "C++", "Golang", " "},
+		Published: time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)}
+
+	tbl := []struct {
+		tmpl, res string
+	}{
+		{`{{hashtags .Categories}}`, "#golang #MachineLearning #C"},
+		{`{{truncate 12 .Text}}`, "Some text..."},
+		{`{{.Text | truncate 100}}`, "Some text for the post"},
+		{`{{lower .Title}} {{upper .Title}} {{title .Title}}`, "hello world HELLO WORLD Hello World"},
+		{`{{replace "world" "there" .Title}}`, "Hello there"},
+		{`{{regexReplace "(\\w+) (\\w+)" "$2 $1" .Title}}`, "world Hello"},
+		{`{{default "anonymous" .Author}} {{default "none" .Title}}`, "anonymous Hello world"},
+		{`{{default "no tags" .Categories}} {{default "no tags" .Images}}`, "[golang machine learning C++ Golang  ] no tags"},
+		{`{{date "2006-01-02" .Published}}|{{date "2006-01-02" .Updated}}`, "2024-05-17|"},
+		{`{{shorten .Link}}`, "www.example.com"},
+		{`{{shorten "https://example.com/blog/post-1/"}} {{shorten "https://example.com/?p=1"}}`, "example.com/blog/post-1 example.com"},
+		{`{{shorten "https://example.com/"}} {{shorten "not a link"}}`, "example.com not a link"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			tmpl, err := newTemplate(tt.tmpl)
+			require.NoError(t, err)
+			buf := bytes.Buffer{}
+			require.NoError(t, tmpl.Execute(&buf, ev))
+			assert.Equal(t, tt.res, buf.String())
+		})
+	}
+
+	_, err := newTemplate(`{{regexReplace "(" "" .Title}}`)
+	assert.Error(t, err, "bad regexp reported on sample event")
+}
+
+func TestNewTemplate(t *testing.T) {
+	tbl := []struct {
+		tmpl string
+		err  string
+	}{
+		{"{{.Title}} - {{.Link}}", ""},
+		{`{{.Title}} {{index .Categories 2}} {{.ChanImage.URL}} {{date "2006" .Published}}`, ""},
+		{`{{.Title}} {{index .Categories 3}} {{(index .Images 1).URL}}`, ""},
+		{"{{blah .Title}}", `can't parse template "{{blah .Title}}": template: msg:1: function "blah" not defined`},
+		{"{{.Title", `can't parse template "{{.Title": template: msg:1: unclosed action`},
+		{"{{.Titel}}", `can't apply template "{{.Titel}}" to sample event: template: msg:1:2: executing "msg" ` +
+			`at <.Titel>: can't evaluate field Titel in type rss.Event`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			tmpl, err := newTemplate(tt.tmpl)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.tmpl, tmpl.String())
+		})
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile("rss/testdata/f1.xml")
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	buf := bytes.Buffer{}
+	err := checkTemplate(opts{CheckTmpl: ts.URL, Template: "{{.Title}} - {{.Link}}", TimeOut: time.Second}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("template \"{{.Title}} - {{.Link}}\", 5 latest items of %s\n\n", ts.URL)+
+		"== twitter (twitter), max length 279\n\n"+
+		"Радио-Т 621 - https://radio-t.com/p/2018/10/27/podcast-621/\n\n"+
+		"Радио-Т 622 - https://radio-t.com/p/2018/11/03/podcast-622/\n\n"+
+		"Радио-Т 623 - https://radio-t.com/p/2018/11/10/podcast-623/\n\n"+
+		"Радио-Т 624 - https://radio-t.com/p/2018/11/17/podcast-624/\n\n"+
+		"Радио-Т 625 - https://radio-t.com/p/2018/11/24/podcast-625/\n", buf.String())
+
+	err = checkTemplate(opts{CheckTmpl: ts.URL, Template: "{{.Titel}}"}, &buf)
+	assert.Error(t, err)
+
+	err = checkTemplate(opts{CheckTmpl: "http://example.com/other", Config: "config/testdata/config.yml"}, &buf)
+	assert.Error(t, err)
+}
+
+func TestCheckTemplatePublishers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile("rss/testdata/f1.xml")
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	conf := fmt.Sprintf(`
+feeds:
+  - url: %s
+    template: "{{.Title}} - {{.Link}}"
+    publishers: [tg, toot]
+publishers:
+  tg:
+    type: telegram
+    token: token
+    channel: "@channel"
+    parse_mode: HTML
+  toot:
+    type: mastodon
+    server: https://mastodon.example.com
+    access_token: token
+    max_len: 40
+`, ts.URL)
+	fname := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(fname, []byte(conf), 0o600))
+
+	buf := bytes.Buffer{}
+	err := checkTemplate(opts{CheckTmpl: ts.URL, Config: fname, TimeOut: time.Second, Template: "{{.Title}}",
+		UpdateTmpl: "{{.Title}}"}, &buf)
+	require.NoError(t, err)
+	out := buf.String()
+	assert.Contains(t, out, "== tg (telegram), max length 4096\n\nРадио-Т 621 - https://radio-t.com/p/2018/10/27/podcast-621/\n")
+	assert.Contains(t, out, "== toot (mastodon), max length 40\n\nРадио-Т 621 - https://radio-t.com/p/2018/10/27/podcast-621/\n")
+	assert.Less(t, strings.Index(out, "== tg"), strings.Index(out, "== toot"))
+}
+
+// mustTemplate compiles template, panics on error
+func mustTemplate(src string) *msgTemplate {
+	tmpl, err := newTemplate(src)
+	if err != nil {
+		panic(err)
+	}
+	return tmpl
+}
+
+func TestSetupBadTemplate(t *testing.T) {
+	_, err := setup(opts{Feeds: []string{"http://example.com/rss"}, Template: "{{blah .Title}}", Dry: true}, &store.Memory{}, nil, &pubSet{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `bad template for http://example.com/rss: can't parse template "{{blah .Title}}": `+
+		`template: msg:1: function "blah" not defined`)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/denisbrodbeck/striphtmltags"
+
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+const (
+	maxThreadLen     = 10 // max number of messages in thread, text not fitting them trimmed
+	minThreadTextLen = 20 // min length of text in the first message of thread, no thread made if less
+)
+
+// threadFormatter makes publisher's thread formatter for the template
+func threadFormatter(tmpl *msgTemplate, linkLast bool) publisher.ThreadFormatter {
+	return func(r rss.Event, lim publisher.Limits) []string {
+		return formatThread(r, tmpl, lim, linkLast)
+	}
+}
+
+// formatThread splits rss event to thread of messages if the text doesn't fit a single message.
+// The first message made with template and as much of the text as fits, the rest of the text split to replies
+// on sentence or word boundaries. All messages numbered with " i/n" suffix. With linkLast the first message made
+// without link, and the link added to the last one.
+// A single message made by formatMsg returned if template has no text or the message fits as is.
+func formatThread(ev rss.Event, tmpl *msgTemplate, lim publisher.Limits, linkLast bool) []string {
+	msg := formatMsg(ev, tmpl, lim)
+	if _, err := execTempl(ev, tmpl, lim); err != nil { // backup message made by formatMsg
+		return []string{msg}
+	}
+	noText := ev
+	noText.Text = ""
+	if applyTempl(noText, tmpl, lim) == applyTempl(ev, tmpl, lim) || lim.Escape != nil { // splitting may break escaped sequences
+		return []string{msg}
+	}
+	unlimited := lim
+	unlimited.MaxLen = math.MaxInt32
+	if msg == formatMsg(ev, tmpl, unlimited) {
+		return []string{msg}
+	}
+
+	max := lim.MaxLen
+	numLen := lim.Len(fmt.Sprintf(" %d/%d", maxThreadLen, maxThreadLen))
+	ev.Title = striphtmltags.StripTags(ev.Title)
+	text := strings.TrimSpace(striphtmltags.StripTags(ev.Text))
+	link := ev.Link
+	if linkLast {
+		ev.Link = ""
+	}
+
+	// length of the first message without text, link counted as by publisher
+	probe := ev
+	probe.Text = ""
+	if lim.LinkLen > 0 && probe.Link != "" {
+		probe.Link = strings.Repeat("x", lim.LinkLen)
+	}
+	firstMax := max - lim.Len(applyTempl(probe, tmpl, lim)) - numLen
+	if firstMax < minThreadTextLen {
+		return []string{msg}
+	}
+
+	ev.Text, text = cutText(text, firstMax, lim)
+	first := applyTempl(ev, tmpl, lim)
+	if linkLast { // remove separator left from the link
+		first = strings.TrimRight(first, " -–—|:\n")
+	}
+	msgs := []string{first}
+	for text != "" && len(msgs) < maxThreadLen {
+		var part string
+		part, text = cutText(text, max-numLen, lim)
+		msgs = append(msgs, part)
+	}
+	if text != "" { // too long for thread, trim the last message
+		msgs[len(msgs)-1] = strings.TrimSpace(trimWithDots(msgs[len(msgs)-1]+" "+text, max-numLen, lim))
+	}
+
+	if linkLast && link != "" {
+		linkLen := lim.LinkLen
+		if linkLen == 0 {
+			linkLen = lim.Len(link)
+		}
+		last := msgs[len(msgs)-1]
+		switch {
+		case len(msgs) > 1 && lim.Len(last)+1+linkLen <= max-numLen:
+			msgs[len(msgs)-1] = last + "\n" + link
+		case len(msgs) < maxThreadLen:
+			msgs = append(msgs, link)
+		default:
+			msgs[len(msgs)-1] = strings.TrimSpace(trimWithDots(last, max-numLen-1-linkLen, lim)) + "\n" + link
+		}
+	}
+
+	if len(msgs) == 1 {
+		return msgs
+	}
+	for i := range msgs {
+		msgs[i] += fmt.Sprintf(" %d/%d", i+1, len(msgs))
+	}
+	return msgs
+}
+
+// cutText cuts the beginning of s fitting max, on the sentence boundary if a sentence ends in the second half
+// of the fitting part, on the word boundary otherwise. Returns the beginning and the rest, both trimmed.
+func cutText(s string, max int, lim publisher.Limits) (head, tail string) {
+	if lim.Len(s) <= max {
+		return s, ""
+	}
+	runes := []rune(s)
+	n := sort.Search(len(runes), func(i int) bool { return lim.Len(string(runes[:i+1])) > max }) // runes fitting max
+	cut := -1
+	for i := n - 1; i >= n/2; i-- {
+		if runes[i] == '\n' || (strings.ContainsRune(".!?", runes[i]) && unicode.IsSpace(runes[i+1])) {
+			cut = i + 1
+			break
+		}
+	}
+	if cut < 0 {
+		cut = n // no spaces, cut the word
+		for i := n; i > 0; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+	}
+	return strings.TrimSpace(string(runes[:cut])), strings.TrimSpace(string(runes[cut:]))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rss2twitter/app/publisher"
+	"github.com/umputun/rss2twitter/app/rss"
+)
+
+func Test_formatThread(t *testing.T) {
+	text := "Lorem ipsum dolor sit amet, consetetur sadipscing elitr. Sed diam nonumy eirmod tempor invidunt ut labore " +
+		"et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores et ea rebum. " +
+		"Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet."
+	ev := rss.Event{Title: "Title", Link: "https://example.com/some/long/link", Text: text}
+	lim := publisher.Limits{MaxLen: 100, LinkLen: 23}
+
+	tbl := []struct {
+		name     string
+		inp      rss.Event
+		tmpl     string
+		linkLast bool
+		res      []string
+	}{
+		{"fits", rss.Event{Title: "Title", Link: "https://example.com", Text: "short text"}, "{{.Title}}: {{.Text}} - {{.Link}}",
+			false, []string{"Title: short text - https://example.com"}},
+		{"no text in template", ev, "{{.Title}} - {{.Link}}", false, []string{"Title - https://example.com/some/long/link"}},
+		{"link first", ev, "{{.Title}}: {{.Text}} - {{.Link}}", false, []string{
+			"Title: Lorem ipsum dolor sit amet, consetetur sadipscing elitr. - https://example.com/some/long/link 1/4",
+			"Sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam 2/4",
+			"voluptua. At vero eos et accusam et justo duo dolores et ea rebum. 3/4",
+			"Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet. 4/4",
+		}},
+		{"spaces in template", ev, "{{ .Title }}: {{ .Text }} - {{ .Link }}", false, []string{
+			"Title: Lorem ipsum dolor sit amet, consetetur sadipscing elitr. - https://example.com/some/long/link 1/4",
+			"Sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam 2/4",
+			"voluptua. At vero eos et accusam et justo duo dolores et ea rebum. 3/4",
+			"Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet. 4/4",
+		}},
+		{"link last", ev, "{{.Title}}: {{.Text}} - {{.Link}}", true, []string{
+			"Title: Lorem ipsum dolor sit amet, consetetur sadipscing elitr. 1/5",
+			"Sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam 2/5",
+			"voluptua. At vero eos et accusam et justo duo dolores et ea rebum. 3/5",
+			"Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet. 4/5",
+			"https://example.com/some/long/link 5/5",
+		}},
+		{"link last, added to last reply", rss.Event{Title: "Title", Link: "https://example.com", Text: text[:121]},
+			"{{.Title}}: {{.Text}} - {{.Link}}", true, []string{
+				"Title: Lorem ipsum dolor sit amet, consetetur sadipscing elitr. 1/2",
+				"Sed diam nonumy eirmod tempor invidunt ut labore et dolore magna\nhttps://example.com 2/2",
+			}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res := formatThread(tt.inp, mustTemplate(tt.tmpl), lim, tt.linkLast)
+			assert.Equal(t, tt.res, res)
+			for _, msg := range res {
+				assert.True(t, lim.Len(msg) <= lim.MaxLen+lim.Len(tt.inp.Link), msg)
+			}
+		})
+	}
+}
+
+func Test_formatThreadTooLong(t *testing.T) {
+	ev := rss.Event{Title: "Title", Link: "https://example.com", Text: strings.Repeat("word ", 300)}
+	res := formatThread(ev, mustTemplate("{{.Title}} {{.Text}} {{.Link}}"), publisher.Limits{MaxLen: 100}, true)
+	require.Equal(t, maxThreadLen, len(res))
+	assert.True(t, strings.HasSuffix(res[0], " 1/10"))
+	assert.True(t, strings.HasSuffix(res[9], "word...\nhttps://example.com 10/10"), res[9])
+	for _, msg := range res {
+		assert.True(t, len(msg) <= 100, msg)
+	}
+}
+
+func Test_cutText(t *testing.T) {
+	lim := publisher.Limits{}
+	tbl := []struct {
+		inp        string
+		max        int
+		head, tail string
+	}{
+		{"short text", 20, "short text", ""},
+		{"First sentence. Second one is longer", 25, "First sentence.", "Second one is longer"},
+		{"Some words without sentence end", 20, "Some words without", "sentence end"},
+		{"Tiny. Some long sentence here", 20, "Tiny. Some long", "sentence here"},
+		{"Line one\nline two is here", 15, "Line one", "line two is here"},
+		{"nospacesatalltoolong", 10, "nospacesat", "alltoolong"},
+	}
+	for _, tt := range tbl {
+		head, tail := cutText(tt.inp, tt.max, lim)
+		assert.Equal(t, tt.head, head, tt.inp)
+		assert.Equal(t, tt.tail, tail, tt.inp)
+	}
+}